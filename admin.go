@@ -0,0 +1,70 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+)
+
+// adminAuthConfigured reports whether any form of admin authentication has
+// been configured. The admin listener refuses to start without it.
+func adminAuthConfigured() bool {
+	return *flagAdminToken != "" || *flagAdminCA != ""
+}
+
+// adminTLSConfig returns the TLS configuration for the admin listener, or nil
+// if the admin listener should serve plain HTTP.
+func adminTLSConfig() (*tls.Config, error) {
+	if *flagAdminCert == "" && *flagAdminKey == "" {
+		if *flagAdminCA != "" {
+			return nil, errors.New("-admin-ca requires -admin-cert and -admin-key")
+		}
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(*flagAdminCert, *flagAdminKey)
+	if err != nil {
+		return nil, fmt.Errorf("loading admin certificate: %v", err)
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if *flagAdminCA != "" {
+		pem, err := ioutil.ReadFile(*flagAdminCA)
+		if err != nil {
+			return nil, fmt.Errorf("reading admin CA: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", *flagAdminCA)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// serveAdmin serves the admin API handler h on the -admin address. Client
+// certificates are verified during the TLS handshake, while the bearer token
+// is checked by h itself.
+func serveAdmin(h http.Handler) {
+	if !adminAuthConfigured() {
+		log.Fatal("admin: refusing to serve without -admin-token or -admin-ca")
+	}
+	tlsConfig, err := adminTLSConfig()
+	if err != nil {
+		log.Fatal("admin: ", err)
+	}
+
+	ln := listen("admin", *flagAdmin)
+	server := &http.Server{
+		Handler:   h,
+		TLSConfig: tlsConfig,
+	}
+	log.Println("admin: listening at", *flagAdmin)
+	if tlsConfig != nil {
+		log.Fatal(server.ServeTLS(ln, "", ""))
+	}
+	log.Fatal(server.Serve(ln))
+}
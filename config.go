@@ -0,0 +1,498 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/slimsag/http-server-stabilizer/stabilizer"
+)
+
+var (
+	flagConfig  = flag.String("config", "", "file of flags, one per line as name=value (e.g. timeout=5s), which flags given on the command line take precedence over; it is read again upon SIGHUP, applying changes to timeouts, limits, balancing, -concurrency and -command without a restart (recycling workers for the latter two)")
+	flagCommand = flag.String("command", "", "worker command and its arguments (e.g. './app -port={{.Port}}'), as an alternative to giving them after the flags, e.g. so that -config can change it")
+)
+
+// newConfig returns the stabilizer configuration given by the flags fs, other
+// than the callbacks and writers (Record, OnOutcome and OnRestartLimit) which
+// main sets, so that reload can compare configurations.
+func newConfig(fs flagSet) (stabilizer.Config, error) {
+	var staticWorkers []string
+	if v := fs.getString("static-workers"); v != "" {
+		staticWorkers = strings.Split(v, ",")
+	}
+
+	workers, err := parseWorkers(fs.getString("workers"))
+	if err != nil {
+		return stabilizer.Config{}, fmt.Errorf("-workers: %v", err)
+	}
+	if len(staticWorkers) > 0 {
+		// One worker per address.
+		workers = len(staticWorkers)
+	}
+	weights, err := parseWeights(fs.getString("worker-weights"))
+	if err != nil {
+		return stabilizer.Config{}, fmt.Errorf("-worker-weights: %v", err)
+	}
+	timeoutSignal, err := parseSignal(fs.getString("timeout-signal"))
+	if err != nil {
+		return stabilizer.Config{}, fmt.Errorf("-timeout-signal: %v", err)
+	}
+	var compressTypes []string
+	if v := fs.getString("compress-types"); v != "" {
+		compressTypes = strings.Split(v, ",")
+	}
+	stripHeaders := parseHeaderNames(fs.getString("strip-request-headers"))
+	setHeaders, err := parseHeaders(fs.getString("set-request-headers"))
+	if err != nil {
+		return stabilizer.Config{}, fmt.Errorf("-set-request-headers: %v", err)
+	}
+	stripResponseHeaders := parseHeaderNames(fs.getString("strip-response-headers"))
+	setResponseHeaders, err := parseHeaders(fs.getString("set-response-headers"))
+	if err != nil {
+		return stabilizer.Config{}, fmt.Errorf("-set-response-headers: %v", err)
+	}
+	var workerTags []string
+	if v := fs.getString("worker-tags"); v != "" {
+		for _, tag := range strings.Split(v, ",") {
+			workerTags = append(workerTags, strings.TrimSpace(tag))
+		}
+	}
+	var denyPaths, allowPaths, priorityPaths []string
+	if v := fs.getString("deny-paths"); v != "" {
+		denyPaths = strings.Split(v, ",")
+	}
+	if v := fs.getString("priority-paths"); v != "" {
+		priorityPaths = strings.Split(v, ",")
+	}
+	if v := fs.getString("allow-paths"); v != "" {
+		allowPaths = strings.Split(v, ",")
+	}
+	breakerStatusCodes, err := stabilizer.ParseStatusCodes(fs.getString("breaker-status-codes"))
+	if err != nil {
+		return stabilizer.Config{}, fmt.Errorf("-breaker-status-codes: %v", err)
+	}
+	var debugHeaderCIDRs []string
+	if v := fs.getString("debug-header-cidrs"); v != "" {
+		for _, cidr := range strings.Split(v, ",") {
+			debugHeaderCIDRs = append(debugHeaderCIDRs, strings.TrimSpace(cidr))
+		}
+	}
+	var authTokens []string
+	if v := fs.getString("auth-token"); v != "" {
+		authTokens = append(authTokens, v)
+	}
+	if v := fs.getString("auth-token-file"); v != "" {
+		data, err := ioutil.ReadFile(v)
+		if err != nil {
+			return stabilizer.Config{}, fmt.Errorf("-auth-token-file: %v", err)
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				authTokens = append(authTokens, line)
+			}
+		}
+		if len(authTokens) == 0 {
+			return stabilizer.Config{}, errors.New("-auth-token-file: no tokens found")
+		}
+	}
+	var fallbackCommand string
+	var fallbackArgs []string
+	if v := fs.getString("fallback-command"); v != "" {
+		fields := strings.Fields(v)
+		if len(fields) == 0 {
+			return stabilizer.Config{}, errors.New("-fallback-command: empty command")
+		}
+		fallbackCommand, fallbackArgs = fields[0], fields[1:]
+	}
+	var readyCommand string
+	var readyArgs []string
+	if v := fs.getString("ready-command"); v != "" {
+		fields := strings.Fields(v)
+		if len(fields) == 0 {
+			return stabilizer.Config{}, errors.New("-ready-command: empty command")
+		}
+		readyCommand, readyArgs = fields[0], fields[1:]
+	}
+	var postStopCommand string
+	var postStopArgs []string
+	if v := fs.getString("post-stop"); v != "" {
+		fields := strings.Fields(v)
+		if len(fields) == 0 {
+			return stabilizer.Config{}, errors.New("-post-stop: empty command")
+		}
+		postStopCommand, postStopArgs = fields[0], fields[1:]
+	}
+	var shadowCommand string
+	var shadowArgs []string
+	if v := fs.getString("shadow-command"); v != "" {
+		fields := strings.Fields(v)
+		if len(fields) == 0 {
+			return stabilizer.Config{}, errors.New("-shadow-command: empty command")
+		}
+		shadowCommand, shadowArgs = fields[0], fields[1:]
+	}
+	command, args, err := workerCommand(fs)
+	if err != nil {
+		return stabilizer.Config{}, err
+	}
+	config := stabilizer.Config{
+		Command:                   command,
+		Args:                      args,
+		Workers:                   workers,
+		StaticWorkers:             staticWorkers,
+		Concurrency:               fs.getInt("concurrency"),
+		ColdStart:                 fs.getString("cold-start-behavior"),
+		ColdStartTimeout:          fs.getDuration("cold-start-timeout"),
+		QueueTimeout:              fs.getDuration("queue-timeout"),
+		RequestDeadline:           fs.getDuration("request-deadline"),
+		FairQueue:                 fs.getBool("fair-queue"),
+		ReservedWorkers:           fs.getInt("reserved-workers"),
+		PriorityHeader:            fs.getString("priority-header"),
+		PriorityPaths:             priorityPaths,
+		BalanceDebug:              fs.getBool("balance-debug"),
+		DebugHeaders:              fs.getBool("debug-headers"),
+		DebugHeadersRedact:        parseHeaderNames(fs.getString("debug-headers-redact")),
+		Balancer:                  fs.getString("balancer"),
+		WorkerWeights:             weights,
+		WorkerTags:                workerTags,
+		TagHeader:                 fs.getString("tag-header"),
+		Timeout:                   fs.getDuration("timeout"),
+		TimeoutHeader:             fs.getString("header"),
+		ExtendTimeoutDuringUpload: fs.getBool("extend-timeout-during-upload"),
+		TimeoutPerByte:            fs.getDuration("timeout-per-byte"),
+		TimeoutBase:               fs.getDuration("timeout-base"),
+		TimeoutMax:                fs.getDuration("timeout-max"),
+		TimeoutQuery:              fs.getString("timeout-query"),
+		StripRequestHeaders:       stripHeaders,
+		SetRequestHeaders:         setHeaders,
+		StripResponseHeaders:      stripResponseHeaders,
+		SetResponseHeaders:        setResponseHeaders,
+		Compress:                  fs.getBool("compress"),
+		CompressMinBytes:          fs.getInt64("compress-min-bytes"),
+		CompressTypes:             compressTypes,
+		DeadlineHeader:            fs.getString("deadline-header"),
+		TimeoutDrainGrace:         fs.getDuration("timeout-drain-grace"),
+		TimeoutSignal:             timeoutSignal,
+		TimeoutSignalGrace:        fs.getDuration("timeout-signal-grace"),
+		KeepWorkersOnTimeout:      !fs.getBool("kill-on-timeout"),
+		MinHealthyUptime:          fs.getDuration("min-healthy-uptime"),
+		BrokenWorkerTimeouts:      fs.getInt("broken-worker-timeouts"),
+		MaxTotalRestarts:          fs.getInt("max-total-restarts"),
+		MaxTotalRestartsWindow:    fs.getDuration("max-total-restarts-window"),
+		ReadyPath:                 fs.getString("ready-path"),
+		ReadyCommand:              readyCommand,
+		ReadyArgs:                 readyArgs,
+		ReadyTimeout:              fs.getDuration("ready-timeout"),
+		HealthCheckInterval:       fs.getDuration("health-check-interval"),
+		BreakerFailures:           fs.getInt("breaker-failures"),
+		BreakerCooldown:           fs.getDuration("breaker-cooldown"),
+		BreakerStatusCodes:        breakerStatusCodes,
+		HealthCheckFailures:       fs.getInt("health-check-failures"),
+		DrainWorkerTimeout:        fs.getDuration("drain-worker-timeout"),
+		RecycleParallelism:        fs.getInt("recycle-parallelism"),
+		WorkerDir:                 fs.getString("worker-dir"),
+		RedactCommandArgs:         !fs.getBool("log-command"),
+		NoSetpgid:                 fs.getBool("no-setpgid"),
+		WatchBinary:               fs.getBool("watch-binary"),
+		WatchBinaryDebounce:       fs.getDuration("watch-binary-debounce"),
+		WorkerHostHeader:          fs.getString("worker-host-header"),
+		MaxLoadAvg:                fs.getFloat64("max-load-avg"),
+		MaxWorkerIdle:             fs.getDuration("max-worker-idle"),
+		MaxOverflowWorkers:        fs.getInt("max-overflow-workers"),
+		OverflowAfter:             fs.getDuration("overflow-after"),
+		OverflowIdle:              fs.getDuration("overflow-idle"),
+		MemoryHighWatermark:       fs.getFloat64("memory-high-watermark"),
+		ErrorTemplates:            fs.getString("error-templates"),
+		MetricsPath:               fs.getString("metrics-path"),
+		HealthPath:                fs.getString("health-path"),
+		PostStopCommand:           postStopCommand,
+		PostStopArgs:              postStopArgs,
+		FallbackCommand:           fallbackCommand,
+		FallbackArgs:              fallbackArgs,
+		FallbackAfter:             fs.getInt("fallback-after"),
+		FallbackRecheck:           fs.getDuration("fallback-recheck"),
+		ShadowCommand:             shadowCommand,
+		ShadowArgs:                shadowArgs,
+		ShadowWorkers:             fs.getInt("shadow-workers"),
+		ShadowPercent:             fs.getFloat64("shadow-percent"),
+		ShadowMaxBody:             fs.getInt64("shadow-max-body"),
+		WorkerMaxConns:            fs.getInt("worker-max-conns"),
+		VerifyResponseMaxBody:     fs.getInt64("verify-response-max-body"),
+		MaxResponseBytes:          fs.getInt64("max-response-bytes"),
+		MaxBodyBytes:              fs.getInt64("max-body-bytes"),
+		WorkerKeepAlive:           fs.getDuration("worker-keepalive"),
+		WorkerDisableKeepAlives:   fs.getBool("worker-disable-keepalive"),
+		WorkerTCPNagle:            !fs.getBool("worker-tcp-nodelay"),
+		WorkerStartupOutput:       fs.getInt("worker-startup-output"),
+		WorkerOutputBuffer:        fs.getInt("worker-output-buffer"),
+		WorkerOutputRequestID:     fs.getString("worker-output-request-id"),
+		Retries:                   fs.getInt("retries"),
+		RetryMaxBody:              fs.getInt64("retry-max-body"),
+		Variant:                   fs.getString("variant"),
+		DenyPaths:                 denyPaths,
+		AllowPaths:                allowPaths,
+		DebugHeaderCIDRs:          debugHeaderCIDRs,
+		AuthTokens:                authTokens,
+		AuthHeader:                fs.getString("auth-header"),
+		PerClientConcurrency:      fs.getInt("per-client-concurrency"),
+		ClientHeader:              fs.getString("client-header"),
+		PauseRetryAfter:           fs.getDuration("pause-retry-after"),
+		AdminToken:                fs.getString("admin-token"),
+		PrometheusAppName:         fs.getString("prometheus-app-name"),
+	}
+	return config, nil
+}
+
+// workerCommand returns the worker command and its arguments, given either by
+// -command or after the flags.
+func workerCommand(fs flagSet) (string, []string, error) {
+	if fs.getString("command") == "" {
+		if fs.NArg() == 0 {
+			return "", nil, nil
+		}
+		return fs.Arg(0), fs.Args()[1:], nil
+	}
+	if fs.NArg() > 0 {
+		return "", nil, errors.New("-command: a worker command was also given after the flags")
+	}
+	fields := strings.Fields(fs.getString("command"))
+	if len(fields) == 0 {
+		return "", nil, errors.New("-command: empty command")
+	}
+	return fields[0], fields[1:], nil
+}
+
+// configFile is the file of flags given by -config.
+type configFile struct {
+	path     string
+	explicit map[string]bool // flags set on the command line, which take precedence
+	set      map[string]bool // flags set by the file at startup
+}
+
+// loadConfigFile reads the -config file at path and sets the flags it gives.
+func loadConfigFile(path string) (*configFile, error) {
+	cf := &configFile{path: path, explicit: make(map[string]bool)}
+	flag.Visit(func(f *flag.Flag) { cf.explicit[f.Name] = true })
+	values, err := readConfigFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := cf.apply(flag.CommandLine, values); err != nil {
+		return nil, err
+	}
+	cf.set = make(map[string]bool, len(values))
+	for name := range values {
+		cf.set[name] = true
+	}
+	return cf, nil
+}
+
+// readConfigFile parses a -config file: one flag per line, as name=value, or
+// just name for boolean flags, optionally with leading dashes as on the
+// command line. Blank lines and lines starting with # are ignored.
+func readConfigFile(path string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]string)
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(strings.TrimLeft(line, "-"), "=", 2)
+		name := strings.TrimSpace(parts[0])
+		f := flag.Lookup(name)
+		switch {
+		case f == nil:
+			return nil, fmt.Errorf("line %d: unknown flag -%s", i+1, name)
+		case name == "config" || name == "vhost":
+			return nil, fmt.Errorf("line %d: -%s may only be given on the command line", i+1, name)
+		}
+		if len(parts) == 2 {
+			values[name] = strings.TrimSpace(parts[1])
+		} else if b, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && b.IsBoolFlag() {
+			values[name] = "true"
+		} else {
+			return nil, fmt.Errorf("line %d: -%s requires a value", i+1, name)
+		}
+	}
+	return values, nil
+}
+
+// apply sets the flags of fs given by values, other than those set on the
+// command line, and resets those which the file set at startup but no longer
+// does to their defaults.
+func (cf *configFile) apply(fs *flag.FlagSet, values map[string]string) error {
+	for name := range cf.set {
+		if _, ok := values[name]; !ok && !cf.explicit[name] {
+			f := fs.Lookup(name)
+			if err := f.Value.Set(f.DefValue); err != nil {
+				return fmt.Errorf("-%s: %v", name, err)
+			}
+		}
+	}
+	for name, value := range values {
+		if cf.explicit[name] {
+			continue
+		}
+		if err := fs.Set(name, value); err != nil {
+			return fmt.Errorf("-%s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// flagSet reads the values of flags by name, so that newConfig can read
+// either the process's flags or a copy of them (see copyFlags).
+type flagSet struct{ *flag.FlagSet }
+
+func (fs flagSet) get(name string) interface{} {
+	return fs.Lookup(name).Value.(flag.Getter).Get()
+}
+
+func (fs flagSet) getString(name string) string          { return fs.get(name).(string) }
+func (fs flagSet) getBool(name string) bool              { return fs.get(name).(bool) }
+func (fs flagSet) getInt(name string) int                { return fs.get(name).(int) }
+func (fs flagSet) getInt64(name string) int64            { return fs.get(name).(int64) }
+func (fs flagSet) getFloat64(name string) float64        { return fs.get(name).(float64) }
+func (fs flagSet) getDuration(name string) time.Duration { return fs.get(name).(time.Duration) }
+
+// copyFlags returns a copy of the flags of fs, with the same values, defaults
+// and arguments, which can be set without affecting fs. Flags whose values
+// can't be read back (-vhost, which accumulates values rather than replacing
+// them when set) are not copied.
+func copyFlags(fs *flag.FlagSet) (*flag.FlagSet, error) {
+	c := flag.NewFlagSet(fs.Name(), flag.ContinueOnError)
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		t := reflect.TypeOf(f.Value)
+		if _, ok := f.Value.(flag.Getter); !ok || t.Kind() != reflect.Ptr || err != nil {
+			return
+		}
+		v := reflect.New(t.Elem()).Interface().(flag.Value)
+		if err = v.Set(f.DefValue); err != nil {
+			err = fmt.Errorf("-%s: %v", f.Name, err)
+			return
+		}
+		c.Var(v, f.Name, f.Usage)
+		if err = v.Set(f.Value.String()); err != nil {
+			err = fmt.Errorf("-%s: %v", f.Name, err)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Stop parsing at "--", so that the arguments are kept as they are even
+	// if they look like flags.
+	if err := c.Parse(append([]string{"--"}, fs.Args()...)); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// reloadOnSIGHUP reloads the -config file whenever the process receives
+// SIGHUP, see reload.
+func (cf *configFile) reloadOnSIGHUP(pools []*stabilizer.Stabilizer, vhosts []vhost) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	for range c {
+		log.Printf("-config: reloading %s", cf.path)
+		if err := cf.reload(pools, vhosts); err != nil {
+			log.Printf("-config: not reloading %s: %v", cf.path, err)
+		}
+	}
+}
+
+// reload reads the -config file again and applies the changes to the
+// configuration of the workers which can be applied at runtime to pools (the
+// default pool, followed by those of vhosts with their own command), see
+// stabilizer.Reload.
+func (cf *configFile) reload(pools []*stabilizer.Stabilizer, vhosts []vhost) error {
+	config, restart, err := cf.load()
+	if err != nil {
+		return err
+	}
+	if len(restart) > 0 {
+		log.Printf("-config: not applying changes to %s, which require a restart", strings.Join(restart, ", "))
+	}
+
+	configs := []stabilizer.Config{config}
+	for _, v := range vhosts {
+		if v.command != "" {
+			configs = append(configs, vhostConfig(config, v))
+		}
+	}
+	for i, s := range pools {
+		if _, _, err := s.Reload(configs[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// load reads the -config file again, returning the configuration it now
+// gives, along with the changed flags which don't affect that configuration.
+// Those configure the stabilizer process itself (e.g. -listen), so only take
+// effect after a restart.
+//
+// The flags are read from a copy of the process's flags, which are never set
+// after startup, as they are read concurrently (e.g. -shutdown-timeout upon
+// SIGTERM).
+func (cf *configFile) load() (stabilizer.Config, []string, error) {
+	next, err := copyFlags(flag.CommandLine)
+	if err != nil {
+		return stabilizer.Config{}, nil, err
+	}
+	values, err := readConfigFile(cf.path)
+	if err != nil {
+		return stabilizer.Config{}, nil, err
+	}
+	if err := cf.apply(next, values); err != nil {
+		return stabilizer.Config{}, nil, err
+	}
+	config, err := newConfig(flagSet{next})
+	if err != nil {
+		return stabilizer.Config{}, nil, err
+	}
+	restart, err := restartFlags(flag.CommandLine, next, config)
+	if err != nil {
+		return stabilizer.Config{}, nil, err
+	}
+	return config, restart, nil
+}
+
+// restartFlags returns the flags which differ between startup and next, but
+// which don't affect config, the configuration given by next, found by
+// changing each back in turn.
+func restartFlags(startup, next *flag.FlagSet, config stabilizer.Config) ([]string, error) {
+	var restart []string
+	var err error
+	next.VisitAll(func(f *flag.Flag) {
+		value := startup.Lookup(f.Name).Value.String()
+		if err != nil || f.Value.String() == value {
+			return
+		}
+		var without *flag.FlagSet
+		if without, err = copyFlags(next); err != nil {
+			return
+		}
+		if err = without.Set(f.Name, value); err != nil {
+			return
+		}
+		if c, cerr := newConfig(flagSet{without}); cerr == nil && reflect.DeepEqual(c, config) {
+			restart = append(restart, "-"+f.Name)
+		}
+	})
+	return restart, err
+}
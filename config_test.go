@@ -0,0 +1,160 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeConfigFile writes a temporary -config file with the given lines,
+// returning its path.
+func writeConfigFile(t *testing.T, lines ...string) string {
+	t.Helper()
+	f, err := ioutil.TempFile("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(strings.Join(lines, "\n")); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+// testFlags returns a copy of the process's flags, at their defaults.
+func testFlags(t *testing.T) *flag.FlagSet {
+	t.Helper()
+	fs, err := copyFlags(flag.CommandLine)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fs
+}
+
+func TestReadConfigFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		lines   []string
+		want    map[string]string
+		wantErr string
+	}{
+		{
+			name: "values",
+			lines: []string{
+				"# comment",
+				"",
+				"timeout=5s",
+				"  -retries = 2 ",
+				"--balancer=weighted-random",
+				"compress",
+			},
+			want: map[string]string{
+				"timeout":  "5s",
+				"retries":  "2",
+				"balancer": "weighted-random",
+				"compress": "true",
+			},
+		},
+		{name: "unknown", lines: []string{"timeout=5s", "bogus=1"}, wantErr: "line 2: unknown flag -bogus"},
+		{name: "missing value", lines: []string{"timeout"}, wantErr: "line 1: -timeout requires a value"},
+		{name: "config", lines: []string{"config=other"}, wantErr: "line 1: -config may only be given on the command line"},
+		{name: "vhost", lines: []string{"vhost=a=./app"}, wantErr: "line 1: -vhost may only be given on the command line"},
+	}
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			path := writeConfigFile(t, tst.lines...)
+			defer os.Remove(path)
+			got, err := readConfigFile(path)
+			if tst.wantErr != "" {
+				if err == nil || err.Error() != tst.wantErr {
+					t.Fatalf("got error %v, want %q", err, tst.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tst.want) {
+				t.Errorf("got %v, want %v", got, tst.want)
+			}
+		})
+	}
+}
+
+func TestConfigFileApply(t *testing.T) {
+	fs := testFlags(t)
+	// As if given on the command line, and by the file at startup.
+	fs.Set("timeout", "20s")
+	fs.Set("retries", "3")
+	fs.Set("max-body-bytes", "100")
+	cf := &configFile{
+		explicit: map[string]bool{"timeout": true},
+		set:      map[string]bool{"timeout": true, "retries": true, "max-body-bytes": true},
+	}
+
+	// The file no longer sets -max-body-bytes, and changes -retries.
+	if err := cf.apply(fs, map[string]string{"timeout": "5s", "retries": "1"}); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{
+		"timeout":        "20s", // the command line wins
+		"retries":        "1",
+		"max-body-bytes": "0", // reset to its default
+	} {
+		if got := fs.Lookup(name).Value.String(); got != want {
+			t.Errorf("-%s = %q, want %q", name, got, want)
+		}
+	}
+	if got := flag.Lookup("retries").Value.String(); got != "0" {
+		t.Errorf("process's -retries = %q, want it unchanged", got)
+	}
+}
+
+func TestRestartFlags(t *testing.T) {
+	startup := testFlags(t)
+	next := testFlags(t)
+	next.Set("listen", ":1234")
+	next.Set("shutdown-timeout", "1s")
+	next.Set("timeout", "5s")
+	config, err := newConfig(flagSet{next})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Timeout != 5*time.Second {
+		t.Errorf("got Timeout %v, want 5s", config.Timeout)
+	}
+	got, err := restartFlags(startup, next, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"-listen", "-shutdown-timeout"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestConfigFileLoad(t *testing.T) {
+	path := writeConfigFile(t, "timeout=5s", "listen=:1234")
+	defer os.Remove(path)
+	cf := &configFile{
+		path:     path,
+		explicit: map[string]bool{},
+		set:      map[string]bool{},
+	}
+	config, restart, err := cf.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Timeout != 5*time.Second {
+		t.Errorf("got Timeout %v, want 5s", config.Timeout)
+	}
+	if want := []string{"-listen"}; !reflect.DeepEqual(restart, want) {
+		t.Errorf("got restart %q, want %q", restart, want)
+	}
+	if got := *flagTimeout; got != 10*time.Second {
+		t.Errorf("-timeout = %v, want it unchanged", got)
+	}
+}
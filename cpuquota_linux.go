@@ -0,0 +1,47 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// cgroupCPUQuota returns the CPU quota of the cgroup we are running in, in
+// CPUs, supporting both cgroup v2 and v1. It returns false if there is no
+// quota or it cannot be read.
+func cgroupCPUQuota() (float64, bool) {
+	// cgroup v2: "$MAX $PERIOD", where $MAX may be "max".
+	if data, err := ioutil.ReadFile("/sys/fs/cgroup/cpu.max"); err == nil {
+		fields := strings.Fields(string(data))
+		if len(fields) != 2 || fields[0] == "max" {
+			return 0, false
+		}
+		return cpuQuota(fields[0], fields[1])
+	}
+
+	// cgroup v1: a quota of -1 means no quota.
+	quota, err := ioutil.ReadFile("/sys/fs/cgroup/cpu/cpu.cfs_quota_us")
+	if err != nil {
+		return 0, false
+	}
+	period, err := ioutil.ReadFile("/sys/fs/cgroup/cpu/cpu.cfs_period_us")
+	if err != nil {
+		return 0, false
+	}
+	return cpuQuota(strings.TrimSpace(string(quota)), strings.TrimSpace(string(period)))
+}
+
+func cpuQuota(quota, period string) (float64, bool) {
+	q, err := strconv.ParseFloat(quota, 64)
+	if err != nil || q <= 0 {
+		return 0, false
+	}
+	p, err := strconv.ParseFloat(period, 64)
+	if err != nil || p <= 0 {
+		return 0, false
+	}
+	return q / p, true
+}
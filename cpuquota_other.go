@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+// cgroupCPUQuota returns the CPU quota of the cgroup we are running in, which
+// is only supported on Linux.
+func cgroupCPUQuota() (float64, bool) {
+	return 0, false
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"strings"
+	"syscall"
+)
+
+// listen listens on the TCP address addr given by the named flag, exiting with
+// an actionable error message if it cannot, e.g. because the address is
+// already in use.
+func listen(flagName, addr string) net.Listener {
+	ln, err := net.Listen("tcp", addr)
+	if err == nil {
+		return ln
+	}
+	if errors.Is(err, syscall.EADDRINUSE) {
+		port := addr[strings.LastIndex(addr, ":")+1:]
+		log.Fatalf("-%s: address %s is already in use, perhaps by another copy of http-server-stabilizer.\n"+
+			"Find the process listening on it with e.g. `lsof -i :%s` or `ss -ltnp 'sport = :%s'` and stop it, "+
+			"or listen on a different address with -%s.", flagName, addr, port, port, flagName)
+	}
+	log.Fatalf("-%s: %v", flagName, err)
+	return nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// logFile is a log file which can be reopened, e.g. after it has been rotated,
+// without racing concurrent writes.
+type logFile struct {
+	path string
+
+	mu sync.Mutex
+	f  *os.File
+}
+
+func openLogFile(path string) (*logFile, error) {
+	l := &logFile{path: path}
+	if err := l.reopen(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Write implements io.Writer.
+func (l *logFile) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.f.Write(p)
+}
+
+// reopen opens the log file path again, closing the previously open file once
+// no writes to it are in progress.
+func (l *logFile) reopen() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	old := l.f
+	l.f = f
+	l.mu.Unlock()
+	if old != nil {
+		return old.Close()
+	}
+	return nil
+}
+
+// reopenOnSIGHUP reopens l whenever the process receives SIGHUP, as is
+// conventional after logrotate has moved the file aside.
+func (l *logFile) reopenOnSIGHUP() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	for range c {
+		if err := l.reopen(); err != nil {
+			log.Printf("-log-file: reopening: %v", err)
+			continue
+		}
+		log.Printf("-log-file: reopened %s", l.path)
+	}
+}
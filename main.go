@@ -1,257 +1,266 @@
 package main
 
 import (
-	"bufio"
 	"context"
-	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"math/rand"
-	"net"
 	"net/http"
-	"net/http/httputil"
-	"net/url"
 	"os"
-	"os/exec"
-	"path"
 	"strconv"
 	"strings"
-	"sync"
 	"syscall"
 	"time"
 
-	oldfreeport "github.com/phayes/freeport"
-	freeport "github.com/slimsag/freeport"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/slimsag/http-server-stabilizer/stabilizer"
 )
 
 var (
-	flagListen            = flag.String("listen", ":8080", "HTTP address to listen on")
-	flagWorkers           = flag.Int("workers", 8, "number of worker subprocesses to spawn")
-	flagTimeout           = flag.Duration("timeout", 10*time.Second, "if request to worker takes longer than this, it will be killed")
-	flagTimeoutHeader     = flag.String("header", "X-Stabilize-Timeout", "request header used to override default timeout value, if not an empty string")
-	flagConcurrency       = flag.Int("concurrency", 10, "number of concurrent requests to allow per worker")
-	flagPrometheus        = flag.String("prometheus", ":6060", "publish Prometheus metrics on specified address")
-	flagPrometheusAppName = flag.String("prometheus-app-name", "", "App name to specify in Prometheus")
+	flagListen                    = flag.String("listen", ":8080", "HTTP address to listen on")
+	flagWorkers                   = flag.String("workers", "8", "number of worker subprocesses to spawn, or auto for one per available CPU (respecting cgroup CPU quotas), or a multiple of that such as 2x")
+	flagTimeout                   = flag.Duration("timeout", 10*time.Second, "if request to worker takes longer than this, it will be killed")
+	flagTimeoutHeader             = flag.String("header", "X-Stabilize-Timeout", "request header used to override default timeout value, if not an empty string")
+	flagTimeoutPerByte            = flag.Duration("timeout-per-byte", 0, "if non-zero, scale the timeout of requests with a Content-Length to -timeout-base plus this much per byte of the body (e.g. 1us is 1s per MB)")
+	flagTimeoutBase               = flag.Duration("timeout-base", 0, "with -timeout-per-byte, the timeout of requests with an empty body (defaults to -timeout)")
+	flagTimeoutMax                = flag.Duration("timeout-max", 0, "with -timeout-per-byte, the maximum timeout regardless of the request size, which also caps timeouts given by the timeout header or -timeout-query (zero means no maximum)")
+	flagExtendTimeoutDuringUpload = flag.Bool("extend-timeout-during-upload", false, "restart the timeout of requests whenever more of their body is sent to the worker, so that slow uploads aren't mistaken for stuck workers")
+	flagTimeoutQuery              = flag.String("timeout-query", "", "query parameter used to override default timeout value, if not an empty string (the -header request header takes precedence)")
+	flagStripRequestHeaders       = flag.String("strip-request-headers", "", "comma-separated request headers to remove before requests are sent to workers, e.g. X-Internal-Auth")
+	flagSetRequestHeaders         = flag.String("set-request-headers", "", "comma-separated request headers to set on requests sent to workers, replacing any sent by the client, e.g. 'X-Via: hss, X-Env: prod'")
+	flagStripResponseHeaders      = flag.String("strip-response-headers", "", "comma-separated response headers to remove before responses are sent to clients, e.g. Server")
+	flagSetResponseHeaders        = flag.String("set-response-headers", "", "comma-separated response headers to set on responses sent to clients, including errors, replacing any set by workers, e.g. 'X-Frame-Options: DENY, Access-Control-Allow-Origin: *'")
+	flagDeadlineHeader            = flag.String("deadline-header", "X-Stabilize-Deadline", "request header used to tell workers when their request will time out (RFC 3339), if not an empty string")
+	flagConcurrency               = flag.Int("concurrency", 10, "number of concurrent requests to allow per worker")
+	flagColdStart                 = flag.String("cold-start-behavior", "block", "how to handle requests while no workers are ready: block (queue as usual), fast-503 (fail immediately) or wait-with-timeout (wait up to -cold-start-timeout)")
+	flagColdStartTimeout          = flag.Duration("cold-start-timeout", 10*time.Second, "with -cold-start-behavior=wait-with-timeout, how long a request may wait for a worker to become ready")
+	flagRequestDeadline           = flag.Duration("request-deadline", 0, "overall time limit of requests, including waiting for a worker and retries, after which they fail with a 504 without the worker being killed (zero means no limit)")
+	flagFairQueue                 = flag.Bool("fair-queue", false, "hand out workers to queued requests strictly in the order they arrived, so that no request waits longer than those queued after it")
+	flagBalanceDebug              = flag.Bool("balance-debug", false, "log which worker was selected for each request and its in-flight requests at the time, as key=value pairs (high volume)")
+	flagWorkerTags                = flag.String("worker-tags", "", "comma-separated tags of each worker by index (e.g. ,,,canary for the 4th worker), sent in the X-Worker-Tag response header and used for routing by -tag-header")
+	flagTagHeader                 = flag.String("tag-header", "", "request header which, if set to a tag (see -worker-tags), only sends the request to workers with that tag, or to those without it if prefixed with !")
+	flagQueueTimeout              = flag.Duration("queue-timeout", 0, "how long a request may wait for a worker to become available before failing with a 503 (zero means wait forever)")
+	flagBalancer                  = flag.String("balancer", stabilizer.BalancerRoundRobin, "how requests are divided among workers: round-robin or weighted-random")
+	flagWorkerWeights             = flag.String("worker-weights", "", "comma-separated weights of each worker by index for the weighted-random balancer (default 1)")
+	flagMinHealthyUptime          = flag.Duration("min-healthy-uptime", 10*time.Second, "how long a worker must stay alive to count as started successfully; workers which crash sooner are restarted with exponential backoff")
+	flagReadyPath                 = flag.String("ready-path", "", "if not an empty string, workers only receive requests once a GET request for this path responds with 200 OK")
+	flagReadyCommand              = flag.String("ready-command", "", "if not an empty string, workers only receive requests once this command exits successfully, as an alternative to -ready-path; it is retried until -ready-timeout, and {{.PID}}, {{.Port}} and {{.Index}} in its arguments are replaced with the worker's details")
+	flagReadyTimeout              = flag.Duration("ready-timeout", 30*time.Second, "how long to wait for a worker to become ready before restarting it")
+	flagMinReady                  = flag.Int("min-ready-before-listen", 0, "number of workers which must be ready before accepting requests")
+	flagStartupTimeout            = flag.Duration("startup-timeout", 0, "if -min-ready-before-listen workers are not ready within this duration, exit (zero means wait forever)")
+	flagBreakerFailures           = flag.Int("breaker-failures", 0, "if non-zero, take a worker out of rotation for -breaker-cooldown after this many consecutive failed requests (timeouts, errors or -breaker-status-codes)")
+	flagBreakerCooldown           = flag.Duration("breaker-cooldown", 10*time.Second, "how long a worker is taken out of rotation once -breaker-failures is reached")
+	flagBreakerStatusCodes        = flag.String("breaker-status-codes", "5xx", "comma-separated response status codes (or classes, e.g. 5xx) which count as failures for -breaker-failures")
+	flagDrainWorkerTimeout        = flag.Duration("drain-worker-timeout", 30*time.Second, "how long a drained worker may finish in-flight requests before it is killed anyway (zero means wait forever)")
+	flagStaticWorkers             = flag.String("static-workers", "", "comma-separated host:port addresses of externally-managed workers to proxy to instead of spawning a command (requires -ready-path)")
+	flagLogCommand                = flag.Bool("log-command", true, "log the full worker command at startup, with the values of arguments which look like secrets redacted (if false, only the command name is logged)")
+	flagWorkerDir                 = flag.String("worker-dir", "", "working directory of workers, which may contain {{.Index}} or {{.Port}} for per-worker directories (created if missing)")
+	flagShutdownTimeout           = flag.Duration("shutdown-timeout", 30*time.Second, "upon SIGTERM or SIGINT, how long to wait for in-flight requests to finish before killing workers (zero means wait forever)")
+	flagReadyWebhook              = flag.String("ready-webhook", "", "URL to POST to once -min-ready-before-listen (or else all) workers are ready, if not an empty string")
+	flagDrainFile                 = flag.String("drain-file", "", "shut down gracefully, as upon SIGTERM, once this file exists; removing it before in-flight requests have finished resumes accepting requests")
+	flagDrainWebhook              = flag.String("drain-webhook", "", "URL to POST to upon beginning a graceful shutdown, if not an empty string")
+	flagNoSetpgid                 = flag.Bool("no-setpgid", false, "spawn workers in our own process group, rather than a new one (subprocesses of workers may not be killed)")
+	flagWatchBinary               = flag.Bool("watch-binary", false, "watch the worker command for changes on disk, and recycle all workers when it changes")
+	flagRecycleParallelism        = flag.Int("recycle-parallelism", 1, "how many workers to recycle at a time when recycling all workers, e.g. with -watch-binary")
+	flagWatchBinaryDebounce       = flag.Duration("watch-binary-debounce", 5*time.Second, "how long the worker command must stop changing before workers are recycled with -watch-binary")
+	flagWorkerHostHeader          = flag.String("worker-host-header", "preserve", "Host header sent to workers: preserve (the client's), rewrite (to the worker's address), or a literal value")
+	flagMaxLoadAvg                = flag.Float64("max-load-avg", 0, "reject new requests while the 1-minute system load average exceeds this (Linux only, zero means never)")
+	flagMaxOverflowWorkers        = flag.Int("max-overflow-workers", 0, "maximum number of temporary workers to start beyond -workers when requests wait -overflow-after for a free worker")
+	flagOverflowAfter             = flag.Duration("overflow-after", 1*time.Second, "how long a request may wait for a free worker before an overflow worker is started, see -max-overflow-workers")
+	flagOverflowIdle              = flag.Duration("overflow-idle", 30*time.Second, "how long an overflow worker may be idle before it is stopped, see -max-overflow-workers")
+	flagMaxWorkerIdle             = flag.Duration("max-worker-idle", 0, "gracefully recycle workers which have not served a request for this long, one at a time (zero means never)")
+	flagMemoryHighWatermark       = flag.Float64("memory-high-watermark", 0, "recycle the worker using the most memory while cgroup memory usage exceeds this fraction of the limit, e.g. 0.9 (Linux only, zero means never)")
+	flagErrorTemplates            = flag.String("error-templates", "", "directory of custom error response templates named by error code, e.g. hss_worker_timeout.html or default.json")
+	flagTimeoutDrainGrace         = flag.Duration("timeout-drain-grace", 0, "when a request times out, stop sending the worker new requests and give its other in-flight requests up to this long to finish before killing it, rather than killing it immediately")
+	flagKillOnTimeout             = flag.Bool("kill-on-timeout", true, "kill workers when a request to them times out (if false, only the request fails and stuck workers must be caught by -health-check-interval)")
+	flagTimeoutSignal             = flag.String("timeout-signal", "", "send this signal (e.g. SIGQUIT, which makes Go workers dump their goroutine stacks) to workers before killing them due to a timeout, so that their output shows why they were stuck")
+	flagTimeoutSignalGrace        = flag.Duration("timeout-signal-grace", 1*time.Second, "with -timeout-signal, how long to give workers to exit on their own after being sent the signal before killing them")
+	flagCompress                  = flag.Bool("compress", false, "gzip responses for clients which accept it, unless the worker already encoded them, if they are at least -compress-min-bytes and of one of -compress-types")
+	flagCompressMinBytes          = flag.Int64("compress-min-bytes", 1024, "with -compress, the minimum Content-Length of responses to compress (responses of unknown length are always compressed)")
+	flagCompressTypes             = flag.String("compress-types", "", "with -compress, comma-separated content types to compress, e.g. text/*,application/json (defaults to text, JSON, JavaScript, XML and SVG)")
+	flagHealthCheckInterval       = flag.Duration("health-check-interval", 0, "how often to check that workers respond to -ready-path, restarting them after -health-check-failures consecutive failures (zero disables)")
+	flagHealthCheckFailures       = flag.Int("health-check-failures", 3, "number of consecutive failed health checks after which a worker is restarted")
+	flagHealthPath                = flag.String("health-path", "", "serve the health state (healthy, degraded or unhealthy) on the -listen address under this path (e.g. /healthz), responding with 503 if unhealthy, or also if degraded under <path>/strict; it is then not proxied to workers")
+	flagMetricsPath               = flag.String("metrics-path", "", "also publish Prometheus metrics on the -listen address under this path, which is then not proxied to workers (e.g. /metrics)")
+	flagPostStop                  = flag.String("post-stop", "", "command to run whenever a worker dies, e.g. to clean up after it; {{.PID}}, {{.Port}}, {{.Index}} and {{.Reason}} in its arguments are replaced with the worker's details")
+	flagFallbackCommand           = flag.String("fallback-command", "", "if not an empty string, a known-good worker command (e.g. 'worker-v1 -listen :{{.Port}}') to switch to for a worker after -fallback-after consecutive failed starts")
+	flagMaxTotalRestarts          = flag.Int("max-total-restarts", 0, "exit with a non-zero status, after shutting down gracefully, if workers restart more than this many times in total within -max-total-restarts-window, indicating a persistently broken deploy (zero disables)")
+	flagMaxTotalRestartsWindow    = flag.Duration("max-total-restarts-window", 10*time.Minute, "the window within which -max-total-restarts are counted")
+	flagBrokenWorkerTimeouts      = flag.Int("broken-worker-timeouts", 0, "consider a worker broken, and restart it with backoff (see -min-healthy-uptime) rather than immediately, after this many consecutive workers time out shortly after starting without responding to any request (zero disables)")
+	flagFallbackAfter             = flag.Int("fallback-after", 5, "number of consecutive workers which must fail to start (see -min-healthy-uptime) before switching to -fallback-command")
+	flagFallbackRecheck           = flag.Duration("fallback-recheck", 5*time.Minute, "how long to use -fallback-command before retrying the primary command")
+	flagShadowCommand             = flag.String("shadow-command", "", "if not an empty string, spawn a separate pool of shadow workers with this command (e.g. 'worker-v2 -listen :{{.Port}}') and mirror requests to them, discarding their responses")
+	flagShadowWorkers             = flag.Int("shadow-workers", 1, "number of shadow worker subprocesses to spawn")
+	flagShadowPercent             = flag.Float64("shadow-percent", 100, "percentage of requests to mirror to shadow workers")
+	flagShadowMaxBody             = flag.Int64("shadow-max-body", 1<<20, "requests with bodies larger than this many bytes (or of unknown size) are not mirrored to shadow workers")
+	flagWorkerStartupOutput       = flag.Int("worker-startup-output", 0, "number of initial lines of each worker's output to keep and show in /debug/workers on the admin listener")
+	flagWorkerMaxConns            = flag.Int("worker-max-conns", 0, "maximum number of TCP connections to each worker, independent of -concurrency (zero means unlimited)")
+	flagMaxBodyBytes              = flag.Int64("max-body-bytes", 0, "cap request bodies at this many bytes: larger requests are rejected with a 413 (zero disables)")
+	flagMaxResponseBytes          = flag.Int64("max-response-bytes", 0, "cap worker response bodies at this many bytes: larger responses fail with a 502, or are truncated and the client connection reset if they have no Content-Length (zero disables)")
+	flagVerifyResponseMaxBody     = flag.Int64("verify-response-max-body", 0, "buffer worker responses with a Content-Length of at most this many bytes, failing with a 502 (or retrying) if the worker closes the connection before sending all of it (zero disables)")
+	flagWorkerKeepAlive           = flag.Duration("worker-keepalive", 30*time.Second, "TCP keep-alive period of connections to workers (negative disables keep-alives)")
+	flagWorkerDisableKeepAlive    = flag.Bool("worker-disable-keepalive", false, "open a new connection to the worker for every request, rather than reusing idle connections")
+	flagWorkerTCPNoDelay          = flag.Bool("worker-tcp-nodelay", true, "set TCP_NODELAY on connections to workers, disabling Nagle's algorithm so small requests and responses are sent without delay")
+	flagWorkerOutputRequestID     = flag.String("worker-output-request-id", "", "regular expression extracting a request ID echoed by workers from each line of their output (its first submatch, or the whole match), with which the line is tagged as request_id=<ID> in the logs")
+	flagWorkerOutputBuffer        = flag.Int("worker-output-buffer", 1000, "number of lines of worker output to buffer before dropping the oldest, so that workers never block writing output")
+	flagDebugHeaderCIDRs          = flag.String("debug-header-cidrs", "", "comma-separated CIDR ranges (e.g. 10.0.0.0/8) of clients which are sent the X-Worker debugging response headers, removing them for all others (by default all clients are sent them)")
+	flagVariant                   = flag.String("variant", "", "short label identifying these workers (e.g. canary), sent in the X-Worker-Variant response header if not an empty string")
+	flagRetries                   = flag.Int("retries", 0, "number of times to retry a failed request on another worker (requests which time out are never retried)")
+	flagRetryMaxBody              = flag.Int64("retry-max-body", 1<<20, "requests with bodies larger than this many bytes (or of unknown size) are not buffered for -retries, and fail with hss_not_retryable instead of being retried")
+	flagLogFile                   = flag.String("log-file", "", "write logs (including worker output) to this file rather than stderr, reopening it on SIGHUP for log rotation")
+	flagReservedWorkers           = flag.Int("reserved-workers", 0, "number of workers to reserve for high-priority requests (see -priority-header and -priority-paths), which other requests are never sent to")
+	flagPriorityHeader            = flag.String("priority-header", "", "request header which, if set to any value, makes a request high-priority (see -reserved-workers); it should be set by a trusted proxy, not clients")
+	flagPriorityPaths             = flag.String("priority-paths", "", "comma-separated path prefixes (or regular expressions, if beginning with ^) of high-priority requests (see -reserved-workers)")
+	flagDebugHeaders              = flag.Bool("debug-headers", false, "log the full headers of each request sent to a worker and of its response (high volume, and may contain sensitive data: see -debug-headers-redact)")
+	flagDebugHeadersRedact        = flag.String("debug-headers-redact", "", "with -debug-headers, comma-separated headers whose values are redacted, in addition to -auth-header (default Authorization, Cookie, Proxy-Authorization and Set-Cookie)")
+	flagDenyPaths                 = flag.String("deny-paths", "", "comma-separated path prefixes (or regular expressions, if beginning with ^) to reject with a 403 before they reach workers")
+	flagAllowPaths                = flag.String("allow-paths", "", "comma-separated path prefixes (or regular expressions, if beginning with ^) to proxy to workers, rejecting all others with a 404 (-deny-paths takes precedence)")
+	flagPerClientConcurrency      = flag.Int("per-client-concurrency", 0, "maximum number of requests each client (identified by -client-header) may have in flight at a time, further requests are rejected with a 429 (0 means unlimited)")
+	flagClientHeader              = flag.String("client-header", "", "request header identifying the client for -per-client-concurrency (default -auth-header)")
+	flagAuthHeader                = flag.String("auth-header", "X-Auth-Token", "request header which must contain -auth-token (or a token from -auth-token-file) for requests to be proxied")
+	flagAuthToken                 = flag.String("auth-token", "", "if not an empty string, reject requests with a 401 unless they present this shared secret in -auth-header")
+	flagAuthTokenFile             = flag.String("auth-token-file", "", "file of shared secrets, one per line, which requests may present in -auth-header (in addition to -auth-token)")
+	flagRecord                    = flag.String("record", "", "append each request sent to a worker and its response to this file as JSON lines, for replaying with -replay (records bodies in full; for testing only)")
+	flagOutcomeCommand            = flag.String("outcome-command", "", "command to run (restarted if it exits), which is sent a line of JSON on stdin describing the outcome of each request sent to a worker")
+	flagProbe                     = flag.Bool("probe", false, "spawn a single worker, wait for it to become ready, send it one request (see -probe-method and -probe-path), print the response and exit, to check the worker command and readiness configuration")
+	flagProbeMethod               = flag.String("probe-method", "GET", "method of the -probe request")
+	flagProbePath                 = flag.String("probe-path", "/", "path of the -probe request")
+	flagPrometheus                = flag.String("prometheus", "127.0.0.1:6060", "publish Prometheus metrics on specified address (only reachable locally by default; use e.g. :6060 to expose them on all interfaces)")
+	flagPrometheusAppName         = flag.String("prometheus-app-name", "", "Prometheus namespace of all metrics, e.g. myapp for myapp_hss_worker_restarts")
+
+	flagAdmin           = flag.String("admin", "", "serve the admin API on specified address, if not an empty string (requires -admin-token or -admin-ca)")
+	flagPauseRetryAfter = flag.Duration("pause-retry-after", 10*time.Second, "Retry-After sent with 503 responses while paused via the admin API")
+	flagAdminToken      = flag.String("admin-token", "", "bearer token required by the admin API, if not an empty string")
+	flagAdminCA         = flag.String("admin-ca", "", "PEM file of CAs used to verify admin API client certificates (mTLS)")
+	flagAdminCert       = flag.String("admin-cert", "", "PEM certificate file to serve the admin API over TLS")
+	flagAdminKey        = flag.String("admin-key", "", "PEM key file to serve the admin API over TLS")
+
+	flagReplay       = flag.String("replay", "", "serve the responses recorded by -record from this file on -replay-listen, acting as a fake worker, instead of running the stabilizer")
+	flagReplayListen = flag.String("replay-listen", ":9700", "specify HTTP address for -replay to listen on")
 
 	flagDemo       = flag.Bool("demo", false, "start an HTTP demo server that does nothing")
 	flagDemoListen = flag.String("demo-listen", ":9700", "specify HTTP address for demo server to listen on")
+	flagDemoStuck  = flag.Float64("demo-stuck-probability", 0.5, "probability that a request to the demo server gets stuck")
+	flagDemoStall  = flag.Duration("demo-stall", 0, "if non-zero, stuck demo requests sleep for this long (or until the client goes away) rather than consuming 100% CPU forever")
 )
 
-type worker struct {
-	ctx    context.Context
-	port   int
-	cancel func()
-	pid    int
-	cmd    *exec.Cmd
-	output *io.PipeReader
-	done   chan struct{}
-}
-
-// watch monitors the worker until it dies.
-func (w *worker) watch() {
-	go func() {
-		<-w.ctx.Done()
-
-		// Kill the process.
-		if err := w.cmd.Process.Kill(); err != nil {
-			if err != nil {
-				log.Printf("worker %v: killing process: %v", w.pid, err)
-			}
-		}
-
-		// Also kill subprocesses (OS X, Linux) -- not supported on Windows.
-		pgid, err := syscall.Getpgid(w.pid)
-		if err == nil {
-			syscall.Kill(-pgid, 15)
-		}
-
-		w.cmd.ProcessState, _ = w.cmd.Process.Wait()
-		close(w.done)
-		w.output.Close()
-	}()
-
-	output := bufio.NewReader(w.output)
-	for {
-		line, err := output.ReadString('\n')
-		log.Printf("worker %v: %s", w.pid, line)
-		if err != nil {
-			log.Printf("worker %v: %s", w.pid, w.cmd.ProcessState)
-			return
+// parseWeights parses a comma-separated list of worker weights, indexed by
+// worker.
+func parseWeights(s string) ([]float64, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var weights []float64
+	for _, field := range strings.Split(s, ",") {
+		weight, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil || math.IsNaN(weight) || math.IsInf(weight, 0) || weight < 0 {
+			return nil, fmt.Errorf("invalid weight %q", field)
 		}
+		weights = append(weights, weight)
 	}
+	return weights, nil
 }
 
-// spawnWorker spawns a new worker process. stderr and stdout will be logged,
-// the done channel signals when the worker has died, and w.cancel() can be
-// used to kill the worker.
-func spawnWorker(ctx context.Context, port int, command string, args ...string) *worker {
-	ctx, cancel := context.WithCancel(ctx)
-	cmd := exec.CommandContext(ctx, command, args...)
-	cmd.SysProcAttr = &syscall.SysProcAttr{
-		// Create a new process group so any subprocesses the worker spawns can
-		// be killed.
-		Setpgid: true,
-	}
-	pr, pw := io.Pipe()
-	cmd.Stderr = pw
-	cmd.Stdout = pw
-	w := &worker{
-		ctx:    ctx,
-		port:   port,
-		cancel: cancel,
-		cmd:    cmd,
-		output: pr,
-		done:   make(chan struct{}),
+// parseHeaders parses a comma-separated list of headers such as
+// "X-Foo: bar, X-Baz: qux".
+func parseHeaders(s string) (http.Header, error) {
+	if s == "" {
+		return nil, nil
 	}
-	if err := cmd.Start(); err != nil {
-		log.Printf("worker spawn: error: %v", err)
-		close(w.done)
-		return w
+	h := make(http.Header)
+	for _, field := range strings.Split(s, ",") {
+		i := strings.Index(field, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid header %q, expected Name: value", field)
+		}
+		h.Add(strings.TrimSpace(field[:i]), strings.TrimSpace(field[i+1:]))
 	}
-	w.pid = w.cmd.Process.Pid
-	go w.watch()
-	return w
+	return h, nil
 }
 
-type stabilizer struct {
-	command string
-	args    []string
-
-	workerPool     chan *worker
-	workerByPortMu sync.RWMutex
-	workerByPort   map[int]*worker
+// signals are the signal names accepted by parseSignal.
+var signals = map[string]syscall.Signal{
+	"SIGABRT": syscall.SIGABRT,
+	"SIGHUP":  syscall.SIGHUP,
+	"SIGINT":  syscall.SIGINT,
+	"SIGQUIT": syscall.SIGQUIT,
+	"SIGTERM": syscall.SIGTERM,
+	"SIGUSR1": syscall.SIGUSR1,
+	"SIGUSR2": syscall.SIGUSR2,
 }
 
-func templateArgs(args []string, port string) []string {
-	var v []string
-	for _, arg := range args {
-		v = append(v, strings.Replace(arg, "{{.Port}}", port, -1))
+// parseSignal parses a signal name such as "SIGQUIT" or "QUIT", or number.
+func parseSignal(s string) (syscall.Signal, error) {
+	if s == "" {
+		return 0, nil
 	}
-	return v
-}
-
-func (s *stabilizer) acquire() *worker {
-	for {
-		w := <-s.workerPool
-		if w.ctx.Err() == nil {
-			return w
-		}
-		time.Sleep(50 * time.Millisecond)
+	if n, err := strconv.Atoi(s); err == nil && n > 0 {
+		return syscall.Signal(n), nil
 	}
-}
-
-func (s *stabilizer) release(w *worker) {
-	go func() {
-		s.workerPool <- w
-	}()
-}
-
-func getFreePort() (port int, err error) {
-	if v, _ := strconv.ParseBool(os.Getenv("USE_OLD_FREEPORT")); v == true {
-		return oldfreeport.GetFreePort()
+	name := strings.ToUpper(s)
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+	sig, ok := signals[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown signal %q", s)
 	}
-	return freeport.GetFreePort()
+	return sig, nil
 }
 
-// ensureWorkers ensures that n workers are always alive. If they die, they
-// will be started again.
-func (s *stabilizer) ensureWorkers(n int) {
-	log.Printf("worker command: %s", strings.Join(append([]string{s.command}, s.args...), " "))
-	for i := 0; i < n; i++ {
-		go func(i int) {
-			for {
-				workerPort, err := getFreePort()
-				if err != nil {
-					log.Println("failed to find free port")
-					time.Sleep(1 * time.Second)
-					continue
-				}
-
-				args := templateArgs(s.args, fmt.Sprint(workerPort))
-				w := spawnWorker(context.Background(), workerPort, s.command, args...)
-				s.workerByPortMu.Lock()
-				s.workerByPort[workerPort] = w
-				s.workerByPortMu.Unlock()
-				log.Printf("worker %v: started on port %v", w.pid, workerPort)
-				var (
-					done        bool
-					poolEntries int
-				)
-				for {
-					if done {
-						break
-					}
-					if poolEntries < *flagConcurrency {
-						select {
-						case s.workerPool <- w:
-							poolEntries++
-						case <-w.done:
-							done = true
-						}
-						continue
-					}
-					<-w.done
-					break
-				}
-			}
-		}(i)
+// parseHeaderNames parses a comma-separated list of header names.
+func parseHeaderNames(s string) []string {
+	var names []string
+	if s != "" {
+		for _, name := range strings.Split(s, ",") {
+			names = append(names, strings.TrimSpace(name))
+		}
 	}
+	return names
 }
 
-func (s *stabilizer) director(req *http.Request) {
-	timeout := *flagTimeout
-	if *flagTimeoutHeader != "" {
+func main() {
+	flag.Parse()
+
+	var configFile *configFile
+	if *flagConfig != "" {
 		var err error
-		timeout, err = time.ParseDuration(req.Header.Get(*flagTimeoutHeader))
+		configFile, err = loadConfigFile(*flagConfig)
 		if err != nil {
-			timeout = *flagTimeout
+			log.Fatal("-config: ", err)
 		}
 	}
 
-	ctx, _ := context.WithTimeout(req.Context(), timeout)
-	*req = *req.WithContext(ctx)
-
-	// Pull a worker from the pool and set it as our target.
-	worker := s.acquire()
-	target, _ := url.Parse(fmt.Sprintf("http://127.0.0.1:%v", worker.port))
-	log.Println("request", req.URL, target)
-
-	// Copy what httputil.NewSingleHostReverseProxy would do.
-	req.URL.Scheme = target.Scheme
-	req.URL.Host = target.Host
-	req.URL.Path = path.Join(target.Path, req.URL.Path)
-	if target.RawQuery == "" || req.URL.RawQuery == "" {
-		req.URL.RawQuery = target.RawQuery + req.URL.RawQuery
-	} else {
-		req.URL.RawQuery = target.RawQuery + "&" + req.URL.RawQuery
-	}
-	if _, ok := req.Header["User-Agent"]; !ok {
-		// explicitly disable User-Agent so it's not set to default value
-		req.Header.Set("User-Agent", "")
+	if *flagLogFile != "" {
+		logFile, err := openLogFile(*flagLogFile)
+		if err != nil {
+			log.Fatal("-log-file: ", err)
+		}
+		log.SetOutput(logFile)
+		go logFile.reopenOnSIGHUP()
 	}
-}
-
-var workerRestartsCounter prometheus.Counter
-
-func main() {
-	flag.Parse()
 
-	workerRestartsCounter = promauto.NewCounter(prometheus.CounterOpts{
-		Name: *flagPrometheusAppName + "_hss_worker_restarts",
-		Help: "The total number of worker process restarts",
-	})
+	rand.Seed(time.Now().UnixNano())
 
 	if *flagDemo {
 		log.Println("demo: listening at", *flagDemoListen)
-		rand.Seed(time.Now().UnixNano())
 		http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-			if rand.Int()%2 == 0 {
+			if rand.Float64() < *flagDemoStuck {
 				fmt.Println("stuck!")
+				if *flagDemoStall > 0 {
+					// Pretend to be stuck without wasting CPU, e.g. in CI.
+					select {
+					case <-time.After(*flagDemoStall):
+					case <-r.Context().Done():
+						return
+					}
+					fmt.Fprintf(w, "Hello from worker %s, eventually\n", *flagDemoListen)
+					return
+				}
 				i := 0
 				for {
 					// Pretend the server OS thread has gotten completely stuck in a loop.
@@ -263,86 +272,132 @@ func main() {
 			}
 			fmt.Fprintf(w, "Hello from worker %s\n", *flagDemoListen)
 		})
-		log.Fatal(http.ListenAndServe(*flagDemoListen, nil))
+		log.Fatal(http.Serve(listen("demo-listen", *flagDemoListen), nil))
 	}
 
-	if flag.NArg() < 2 {
+	if *flagReplay != "" {
+		f, err := os.Open(*flagReplay)
+		if err != nil {
+			log.Fatal("-replay: ", err)
+		}
+		handler, err := stabilizer.NewReplayHandler(f)
+		f.Close()
+		if err != nil {
+			log.Fatal("-replay: ", err)
+		}
+		log.Println("replay: listening at", *flagReplayListen)
+		log.Fatal(http.Serve(listen("replay-listen", *flagReplayListen), handler))
+	}
+
+	if *flagStaticWorkers == "" && *flagCommand == "" && flag.NArg() < 2 {
 		flag.Usage()
 		os.Exit(2)
 	}
 
-	if *flagPrometheus != "" {
+	if *flagPrometheus != "" && !*flagProbe {
+		ln := listen("prometheus", *flagPrometheus)
 		go func() {
 			mux := http.NewServeMux()
 			mux.Handle("/metrics", promhttp.Handler())
-			http.ListenAndServe(*flagPrometheus, mux)
+			log.Fatal(http.Serve(ln, mux))
 		}()
 	}
 
-	s := &stabilizer{
-		command:      flag.Arg(0),
-		args:         flag.Args()[1:],
-		workerPool:   make(chan *worker, *flagWorkers**flagConcurrency),
-		workerByPort: make(map[int]*worker),
+	config, err := newConfig(flagSet{flag.CommandLine})
+	if err != nil {
+		log.Fatal(err)
+	}
+	workers := config.Workers
+	if _, err := strconv.Atoi(*flagWorkers); err != nil && *flagStaticWorkers == "" {
+		log.Printf("-workers=%s: using %v workers", *flagWorkers, workers)
+	}
+	var onOutcome func(stabilizer.Outcome)
+	if *flagOutcomeCommand != "" {
+		fields := strings.Fields(*flagOutcomeCommand)
+		if len(fields) == 0 {
+			log.Fatal("-outcome-command: empty command")
+		}
+		onOutcome = (&outcomeCommand{command: fields[0], args: fields[1:]}).report
+	}
+	var record io.Writer
+	if *flagRecord != "" {
+		f, err := os.OpenFile(*flagRecord, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			log.Fatal("-record: ", err)
+		}
+		record = f
+	}
+	config.OnOutcome = onOutcome
+	config.Record = record
+	config.OnRestartLimit = onRestartLimit
+
+	if *flagProbe {
+		timeout := *flagStartupTimeout
+		if timeout == 0 {
+			timeout = time.Minute
+		}
+		os.Exit(probe(config, *flagProbeMethod, *flagProbePath, timeout))
+	}
+	var vhosts []vhost
+	for _, f := range flagVhosts {
+		v, err := parseVhost(f)
+		if err != nil {
+			log.Fatal(err)
+		}
+		vhosts = append(vhosts, v)
+	}
+	if len(vhosts) > 0 {
+		// Metrics of every pool must have the same labels.
+		config.Registerer = prometheus.WrapRegistererWith(prometheus.Labels{"vhost": ""}, prometheus.DefaultRegisterer)
+	}
+	s, err := stabilizer.New(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := s.Start(context.Background()); err != nil {
+		log.Fatal(err)
+	}
+	pools := []*stabilizer.Stabilizer{s}
+	var handler http.Handler = s
+	if len(vhosts) > 0 {
+		router, vhostPools := startVhosts(config, s, vhosts)
+		pools = append(pools, vhostPools...)
+		handler = router
+	}
+	if *flagAdmin != "" {
+		go serveAdmin(s.AdminHandler())
+	}
+	if *flagMinReady > 0 {
+		ctx := context.Background()
+		if *flagStartupTimeout > 0 {
+			var cancel func()
+			ctx, cancel = context.WithTimeout(ctx, *flagStartupTimeout)
+			defer cancel()
+		}
+		if err := s.WaitReady(ctx, *flagMinReady); err != nil {
+			log.Fatalf("-startup-timeout=%v: %v", *flagStartupTimeout, err)
+		}
 	}
-	go s.ensureWorkers(*flagWorkers)
-
-	handler := &httputil.ReverseProxy{
-		Director: s.director,
-		Transport: &http.Transport{
-			DialContext: (&net.Dialer{
-				Timeout:   2000 * time.Millisecond,
-				KeepAlive: 30 * time.Second,
-			}).DialContext,
-			TLSHandshakeTimeout: 10 * time.Second,
-		},
-		ModifyResponse: func(r *http.Response) error {
-			// Set the X-Worker response header for debugging purposes.
-			workerPort, _ := strconv.ParseInt(r.Request.URL.Port(), 10, 64)
-			s.workerByPortMu.RLock()
-			w := s.workerByPort[int(workerPort)]
-			s.workerByPortMu.RUnlock()
-			s.release(w)
-			r.Header.Set("X-Worker", fmt.Sprint(w.pid))
-			return nil
-		},
-		ErrorHandler: func(rw http.ResponseWriter, r *http.Request, err error) {
-			// Set the X-Worker response header for debugging purposes.
-			workerPort, _ := strconv.ParseInt(r.URL.Port(), 10, 64)
-			s.workerByPortMu.RLock()
-			w := s.workerByPort[int(workerPort)]
-			s.workerByPortMu.RUnlock()
-			s.release(w)
-			rw.Header().Set("X-Worker", fmt.Sprint(w.pid))
 
-			rw.WriteHeader(http.StatusServiceUnavailable)
-			// If the request timed out, kill the worker since it may be stuck.
-			// It will automatically restart.
-			if r.Context().Err() != nil {
-				log.Printf("worker %v: restarting due to timeout", w.pid)
-				workerRestartsCounter.Inc()
-				w.cancel()
-				_ = json.NewEncoder(rw).Encode(&map[string]interface{}{
-					"error": fmt.Sprintf("worker %v: restarted due to timeout", w.pid),
-					"code":  "hss_worker_timeout",
-				})
-				return
+	if *flagReadyWebhook != "" {
+		go func() {
+			// Wait for all workers, unless we were told how many is enough.
+			n := *flagMinReady
+			if n == 0 {
+				n = workers
 			}
+			if err := s.WaitReady(context.Background(), n); err == nil {
+				postWebhook(*flagReadyWebhook, "ready", s, workers)
+			}
+		}()
+	}
 
-			// Technically we could hit other errors here if e.g. communication
-			// between our reverse proxy and the worker was failing for some
-			// other reason like the network being flooded, but in practice
-			// this is unlikely to happen and instead the most likely case is
-			// that the worker was killed due to another request on the same
-			// worker timing out. In this case, having a different error code
-			// to handle is not that useful so we also return
-			// hss_worker_timeout.
-			log.Printf("worker %v: %v", w.pid, err)
-			_ = json.NewEncoder(rw).Encode(&map[string]interface{}{
-				"error": fmt.Sprintf("worker %v: %v", w.pid, err),
-				"code":  "hss_worker_timeout",
-			})
-		},
+	server := &http.Server{Handler: handler, ConnState: s.ConnState}
+	if configFile != nil {
+		go configFile.reloadOnSIGHUP(pools, vhosts)
+	}
+	go shutdownOnSignal(server, s, pools, workers)
+	if err := server.Serve(listen("listen", *flagListen)); err != http.ErrServerClosed {
+		log.Fatal(err)
 	}
-	log.Fatal(http.ListenAndServe(*flagListen, handler))
 }
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/slimsag/http-server-stabilizer/stabilizer"
+)
+
+// outcomePayload is written to -outcome-command as a line of JSON for each
+// request sent to a worker.
+type outcomePayload struct {
+	Method          string  `json:"method"`
+	Path            string  `json:"path"`
+	Status          int     `json:"status"`
+	DurationSeconds float64 `json:"duration_seconds"`
+	WorkerPID       int     `json:"worker_pid"`
+	Outcome         string  `json:"outcome"` // "ok", "timeout", "canceled", "dial-error" or "error"
+}
+
+// outcomeCommand runs -outcome-command, restarting it if it exits.
+type outcomeCommand struct {
+	command string
+	args    []string
+
+	stdin   io.WriteCloser // nil if the command is not running
+	started time.Time
+}
+
+// report writes o to the command's stdin, starting the command if needed.
+// Outcomes are dropped while the command is not running, and it is restarted
+// at most once per second.
+func (c *outcomeCommand) report(o stabilizer.Outcome) {
+	if c.stdin == nil {
+		if time.Since(c.started) < time.Second {
+			return
+		}
+		c.started = time.Now()
+		cmd := exec.Command(c.command, c.args...)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		stdin, err := cmd.StdinPipe()
+		if err == nil {
+			err = cmd.Start()
+		}
+		if err != nil {
+			log.Printf("-outcome-command: %v", err)
+			return
+		}
+		go func() {
+			log.Printf("-outcome-command: exited: %v", cmd.Wait())
+		}()
+		c.stdin = stdin
+	}
+	line, _ := json.Marshal(&outcomePayload{
+		Method:          o.Method,
+		Path:            o.Path,
+		Status:          o.Status,
+		DurationSeconds: o.Duration.Seconds(),
+		WorkerPID:       o.WorkerPID,
+		Outcome:         o.Outcome,
+	})
+	if _, err := c.stdin.Write(append(line, '\n')); err != nil {
+		log.Printf("-outcome-command: %v", err)
+		c.stdin.Close()
+		c.stdin = nil
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"time"
+
+	"github.com/slimsag/http-server-stabilizer/stabilizer"
+)
+
+// probe spawns a single worker with the given configuration, waits for it to
+// become ready and sends it one request, printing the response and timings.
+// It returns the exit code: non-zero if the worker did not become ready
+// within timeout or the response was a server error.
+func probe(config stabilizer.Config, method, path string, timeout time.Duration) int {
+	config.Workers = 1
+	config.ShadowCommand = ""
+	config.WatchBinary = false
+	config.AuthTokens = nil
+	config.OnOutcome = nil
+	s, err := stabilizer.New(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	start := time.Now()
+	if err := s.Start(context.Background()); err != nil {
+		log.Fatal(err)
+	}
+	defer s.Shutdown(context.Background())
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := s.WaitReady(ctx, 1); err != nil {
+		fmt.Printf("probe: worker not ready: %v\n", err)
+		return 1
+	}
+	fmt.Printf("probe: worker ready after %v\n", time.Since(start))
+
+	req := httptest.NewRequest(method, path, nil)
+	rec := httptest.NewRecorder()
+	start = time.Now()
+	s.ServeHTTP(rec, req)
+	resp := rec.Result()
+	fmt.Printf("probe: %s %s: %s in %v\n\n", method, path, resp.Status, time.Since(start))
+	resp.Header.Write(os.Stdout)
+	fmt.Println()
+	os.Stdout.Write(rec.Body.Bytes())
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return 1
+	}
+	return 0
+}
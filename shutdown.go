@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/slimsag/http-server-stabilizer/stabilizer"
+)
+
+// restartLimitExceeded receives once -max-total-restarts is exceeded.
+var restartLimitExceeded = make(chan int, 1)
+
+// onRestartLimit is called by the stabilizer once -max-total-restarts is
+// exceeded.
+func onRestartLimit(restarts int) {
+	select {
+	case restartLimitExceeded <- restarts:
+	default:
+	}
+}
+
+// shutdownOnSignal gracefully shuts down upon SIGTERM or SIGINT, or when
+// -drain-file appears: new requests are rejected, in-flight requests are given
+// up to -shutdown-timeout to finish, and then workers are killed and server is
+// closed. A second signal exits immediately, while removing -drain-file before
+// in-flight requests have finished resumes accepting requests. Exceeding
+// -max-total-restarts also shuts down gracefully, but then exits non-zero.
+//
+// s is the default pool, and pools all pools including it (see -vhost).
+func shutdownOnSignal(server *http.Server, s *stabilizer.Stabilizer, pools []*stabilizer.Stabilizer, workers int) {
+	c := make(chan os.Signal, 2)
+	signal.Notify(c, syscall.SIGTERM, os.Interrupt)
+	var drainFile <-chan bool
+	if *flagDrainFile != "" {
+		drainFile = watchDrainFile(*flagDrainFile)
+	}
+
+	var (
+		signaled bool
+		failed   bool       // -max-total-restarts was exceeded
+		done     chan error // of the in-progress shutdown, if any
+	)
+	for {
+		select {
+		case sig := <-c:
+			if signaled {
+				log.Fatal("exiting immediately")
+			}
+			signaled = true
+			log.Printf("received %v, shutting down gracefully (send again to exit immediately)", sig)
+			if done == nil {
+				done = shutdown(s, pools, workers)
+			}
+		case restarts := <-restartLimitExceeded:
+			log.Printf("-max-total-restarts: %d worker restarts within %v, shutting down gracefully and exiting", restarts, *flagMaxTotalRestartsWindow)
+			failed = true
+			signaled = true // don't let -drain-file resume
+			if done == nil {
+				done = shutdown(s, pools, workers)
+			}
+		case exists := <-drainFile:
+			if exists && done == nil {
+				log.Printf("-drain-file: %s exists, shutting down gracefully (remove it to resume)", *flagDrainFile)
+				done = shutdown(s, pools, workers)
+			} else if !exists && done != nil && !signaled {
+				if cancelShutdown(pools) {
+					log.Printf("-drain-file: %s removed, resuming", *flagDrainFile)
+				} else {
+					log.Printf("-drain-file: %s removed, but too late to resume", *flagDrainFile)
+				}
+			}
+		case err := <-done:
+			if err == stabilizer.ErrShutdownCanceled {
+				done = nil
+				continue
+			}
+			if err != nil {
+				log.Printf("shutdown: %v", err)
+			}
+			if failed {
+				log.Fatalf("exiting: -max-total-restarts=%d exceeded", *flagMaxTotalRestarts)
+			}
+			server.Close()
+			return
+		}
+	}
+}
+
+// shutdown starts shutting down pools, of which s is the default, returning a
+// channel which receives the result. It is only stabilizer.ErrShutdownCanceled
+// if the shutdown of every pool was canceled: pools which weren't are already
+// gone, so the others are shut down after all.
+func shutdown(s *stabilizer.Stabilizer, pools []*stabilizer.Stabilizer, workers int) chan error {
+	if *flagDrainWebhook != "" {
+		postWebhook(*flagDrainWebhook, "draining", s, workers)
+	}
+	done := make(chan error, 1)
+	go func() {
+		ctx := context.Background()
+		if *flagShutdownTimeout > 0 {
+			var cancel func()
+			ctx, cancel = context.WithTimeout(ctx, *flagShutdownTimeout)
+			defer cancel()
+		}
+		var err error
+		for remaining, stopped := pools, false; len(remaining) > 0; {
+			errs := make([]error, len(remaining))
+			var wg sync.WaitGroup
+			for i, p := range remaining {
+				wg.Add(1)
+				go func(i int, p *stabilizer.Stabilizer) {
+					defer wg.Done()
+					errs[i] = p.Shutdown(ctx)
+				}(i, p)
+			}
+			wg.Wait()
+			var canceled []*stabilizer.Stabilizer
+			for i, e := range errs {
+				switch {
+				case e == stabilizer.ErrShutdownCanceled:
+					canceled = append(canceled, remaining[i])
+				case e != nil:
+					err = e
+					stopped = true
+				default:
+					stopped = true
+				}
+			}
+			if len(canceled) > 0 && !stopped {
+				done <- stabilizer.ErrShutdownCanceled
+				return
+			}
+			remaining = canceled
+		}
+		done <- err
+	}()
+	return done
+}
+
+// cancelShutdown cancels the shutdown of pools, reporting whether that
+// succeeded for all of them.
+func cancelShutdown(pools []*stabilizer.Stabilizer) bool {
+	ok := true
+	for _, p := range pools {
+		if !p.CancelShutdown() {
+			ok = false
+		}
+	}
+	return ok
+}
+
+// watchDrainFile polls for path to be created or removed, sending true or
+// false respectively whenever that changes.
+func watchDrainFile(path string) <-chan bool {
+	c := make(chan bool)
+	go func() {
+		var exists bool
+		for {
+			_, err := os.Stat(path)
+			if now := err == nil; now != exists {
+				exists = now
+				c <- exists
+			}
+			time.Sleep(1 * time.Second)
+		}
+	}()
+	return c
+}
@@ -0,0 +1,234 @@
+package stabilizer
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AdminHandler returns a handler serving the admin API, which lets operators
+// inspect and control workers. If AdminToken is set, callers must present it
+// as a bearer token.
+func (s *Stabilizer) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/workers", s.handleDebugWorkers)
+	mux.HandleFunc("/debug/recycle", s.handleDebugRecycle)
+	mux.HandleFunc("/config", s.handleConfig)
+	mux.HandleFunc("/workers/weight", s.handleWorkerWeight)
+	mux.HandleFunc("/workers/drain", s.handleWorkerDrain)
+	mux.HandleFunc("/workers/freeze", s.handleWorkerFreeze)
+	mux.HandleFunc("/pause", s.handlePause)
+	mux.HandleFunc("/resume", s.handlePause)
+	return s.requireAdminAuth(mux)
+}
+
+// requireAdminAuth wraps h such that callers must present the admin bearer
+// token, if one is configured.
+func (s *Stabilizer) requireAdminAuth(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if s.config.AdminToken != "" {
+			token, ok := bearerToken(r.Header.Get("Authorization"))
+			if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.config.AdminToken)) != 1 {
+				rw.Header().Set("WWW-Authenticate", "Bearer")
+				rw.WriteHeader(http.StatusUnauthorized)
+				_ = json.NewEncoder(rw).Encode(&map[string]interface{}{
+					"error": "admin: unauthorized",
+					"code":  "hss_unauthorized",
+				})
+				return
+			}
+		}
+		h.ServeHTTP(rw, r)
+	})
+}
+
+// bearerToken extracts the token from an Authorization header value of the
+// form "Bearer <token>". The scheme is matched case-insensitively (RFC 7235);
+// any other scheme, or a bare token, is rejected.
+func bearerToken(header string) (string, bool) {
+	parts := strings.SplitN(header, " ", 2)
+	if len(parts) != 2 || !strings.EqualFold(parts[0], "Bearer") {
+		return "", false
+	}
+	token := strings.TrimSpace(parts[1])
+	return token, token != ""
+}
+
+// handleDebugWorkers lists the currently alive workers.
+func (s *Stabilizer) handleDebugWorkers(rw http.ResponseWriter, r *http.Request) {
+	workers := s.pool.status()
+	sort.Slice(workers, func(i, j int) bool { return workers[i].Index < workers[j].Index })
+
+	rw.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(rw).Encode(workers)
+}
+
+// handleDebugRecycle reports the progress of the current (or last) rolling
+// recycle of workers.
+func (s *Stabilizer) handleDebugRecycle(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(rw).Encode(s.recycleProgress())
+}
+
+// handleWorkerWeight changes the weight of a worker, e.g.:
+//
+//	POST /workers/weight?index=3&weight=0.5
+func (s *Stabilizer) handleWorkerWeight(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		rw.Header().Set("Allow", http.MethodPost)
+		adminError(rw, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	index, err := strconv.Atoi(r.FormValue("index"))
+	if err != nil {
+		adminError(rw, http.StatusBadRequest, "invalid index")
+		return
+	}
+	weight, err := strconv.ParseFloat(r.FormValue("weight"), 64)
+	if err != nil {
+		adminError(rw, http.StatusBadRequest, "invalid weight")
+		return
+	}
+	if err := s.pool.setWeight(index, weight); err != nil {
+		adminError(rw, http.StatusBadRequest, err.Error())
+		return
+	}
+	log.Printf("admin: worker index %v: weight set to %v", index, weight)
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// handleWorkerDrain gracefully restarts a worker once its in-flight requests
+// have finished, e.g.:
+//
+//	POST /workers/drain?index=3
+func (s *Stabilizer) handleWorkerDrain(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		rw.Header().Set("Allow", http.MethodPost)
+		adminError(rw, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	index, err := strconv.Atoi(r.FormValue("index"))
+	if err != nil {
+		adminError(rw, http.StatusBadRequest, "invalid index")
+		return
+	}
+	w, err := s.pool.drain(index)
+	if err != nil {
+		adminError(rw, http.StatusBadRequest, err.Error())
+		return
+	}
+	go s.drainWorker(w, reasonManual, s.current().DrainWorkerTimeout)
+	rw.WriteHeader(http.StatusAccepted)
+}
+
+// handleWorkerFreeze suspends a worker with SIGSTOP so that it hangs on every
+// request, deterministically simulating a stuck worker for testing that it is
+// timed out and restarted, e.g.:
+//
+//	POST /workers/freeze?index=3
+func (s *Stabilizer) handleWorkerFreeze(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		rw.Header().Set("Allow", http.MethodPost)
+		adminError(rw, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	index, err := strconv.Atoi(r.FormValue("index"))
+	if err != nil {
+		adminError(rw, http.StatusBadRequest, "invalid index")
+		return
+	}
+	w, err := s.pool.lookup(index)
+	if err != nil {
+		adminError(rw, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := w.freeze(); err != nil {
+		adminError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+	log.Printf("admin: worker %v: frozen", w.pid)
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// handlePause pauses or resumes proxying requests, e.g.:
+//
+//	POST /pause
+//	POST /resume
+func (s *Stabilizer) handlePause(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		rw.Header().Set("Allow", http.MethodPost)
+		adminError(rw, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if r.URL.Path == "/pause" {
+		s.Pause()
+	} else {
+		s.Resume()
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// adminError responds with an admin API error in the same JSON schema used
+// for proxy errors.
+func adminError(rw http.ResponseWriter, status int, msg string) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	_ = json.NewEncoder(rw).Encode(&map[string]interface{}{
+		"error": "admin: " + msg,
+		"code":  "hss_admin_error",
+	})
+}
+
+// redacted replaces secrets in the configuration served at /config.
+const redacted = "REDACTED"
+
+// redactedConfig returns the effective configuration (after defaults are
+// applied, and including changes applied by Reload) keyed by Config field
+// name, with secrets redacted: tokens, worker arguments (which may contain
+// secrets, e.g. passed as flags) and the values of SetRequestHeaders.
+// Durations are formatted like "10s", and fields which are functions or
+// interfaces are reported only as whether they are set.
+func (s *Stabilizer) redactedConfig() map[string]interface{} {
+	v := reflect.ValueOf(*s.current())
+	t := v.Type()
+	config := make(map[string]interface{}, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		name, field := t.Field(i).Name, v.Field(i)
+		switch {
+		case field.Kind() == reflect.Func || field.Kind() == reflect.Interface:
+			config[name] = !field.IsNil()
+		case field.Type() == reflect.TypeOf(time.Duration(0)):
+			config[name] = time.Duration(field.Int()).String()
+		case strings.Contains(name, "Token") || strings.Contains(name, "Password") || strings.Contains(name, "Secret") || strings.HasSuffix(name, "Args"):
+			if !field.IsZero() {
+				config[name] = redacted
+			} else {
+				config[name] = field.Interface()
+			}
+		default:
+			config[name] = field.Interface()
+		}
+	}
+	if len(s.config.SetRequestHeaders) > 0 {
+		headers := make(map[string]string, len(s.config.SetRequestHeaders))
+		for name := range s.config.SetRequestHeaders {
+			headers[name] = redacted
+		}
+		config["SetRequestHeaders"] = headers
+	}
+	return config
+}
+
+// handleConfig reports the effective configuration, with secrets redacted.
+func (s *Stabilizer) handleConfig(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(rw)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(s.redactedConfig())
+}
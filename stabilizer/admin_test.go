@@ -0,0 +1,88 @@
+package stabilizer
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestBearerToken(t *testing.T) {
+	tests := []struct {
+		header string
+		token  string
+		ok     bool
+	}{
+		{"Bearer secret", "secret", true},
+		{"bearer secret", "secret", true},
+		{"BEARER secret", "secret", true},
+		{"secret", "", false},
+		{"Basic c2VjcmV0", "", false},
+		{"Bearer ", "", false},
+		{"Bearer", "", false},
+		{"", "", false},
+	}
+	for _, tst := range tests {
+		token, ok := bearerToken(tst.header)
+		if token != tst.token || ok != tst.ok {
+			t.Errorf("bearerToken(%q) = %q, %v; want %q, %v", tst.header, token, ok, tst.token, tst.ok)
+		}
+	}
+}
+
+func TestWorkerWeight(t *testing.T) {
+	ts := newTestStabilizer(t, Config{Workers: 2, Balancer: BalancerWeightedRandom}, http.NotFoundHandler())
+	defer ts.close()
+	admin := ts.AdminHandler()
+
+	for _, tst := range []struct {
+		weight string
+		status int
+		want   float64 // the weight of worker 0 afterwards
+	}{
+		{"0.5", http.StatusNoContent, 0.5},
+		{"-1", http.StatusBadRequest, 0.5},
+		{"NaN", http.StatusBadRequest, 0.5},
+		{"Inf", http.StatusBadRequest, 0.5},
+		{"-Inf", http.StatusBadRequest, 0.5},
+		{"bogus", http.StatusBadRequest, 0.5},
+		{"0", http.StatusNoContent, 0},
+	} {
+		rec := httptest.NewRecorder()
+		admin.ServeHTTP(rec, httptest.NewRequest("POST", "/workers/weight?index=0&weight="+tst.weight, nil))
+		if rec.Code != tst.status {
+			t.Errorf("weight=%s: got status %v, want %v", tst.weight, rec.Code, tst.status)
+		}
+		ts.pool.mu.Lock()
+		got := ts.pool.weights[0]
+		ts.pool.mu.Unlock()
+		if got != tst.want {
+			t.Errorf("weight=%s: got weight %v, want %v", tst.weight, got, tst.want)
+		}
+	}
+
+	// The workers can still be listed, which fails if a weight can't be
+	// encoded as JSON.
+	rec := httptest.NewRecorder()
+	admin.ServeHTTP(rec, httptest.NewRequest("GET", "/debug/workers", nil))
+	if rec.Code != http.StatusOK || rec.Body.Len() == 0 {
+		t.Errorf("/debug/workers: got %v %q", rec.Code, rec.Body)
+	}
+}
+
+func TestNewInvalidWeight(t *testing.T) {
+	for _, weight := range []float64{-1, math.NaN(), math.Inf(1), math.Inf(-1)} {
+		_, err := New(Config{
+			Command:       "true",
+			Workers:       1,
+			Balancer:      BalancerWeightedRandom,
+			WorkerWeights: []float64{weight},
+			Registerer:    prometheus.NewRegistry(),
+		})
+		if err == nil {
+			t.Errorf("weight %v: got no error", weight)
+		}
+	}
+}
@@ -0,0 +1,26 @@
+package stabilizer
+
+import (
+	"crypto/subtle"
+	"net/http"
+)
+
+// authenticated reports whether r presents one of AuthTokens in AuthHeader, or
+// if no tokens are configured. The header is then removed, so that workers
+// never see it.
+func (s *Stabilizer) authenticated(r *http.Request) bool {
+	if len(s.config.AuthTokens) == 0 {
+		return true
+	}
+	token := []byte(r.Header.Get(s.config.AuthHeader))
+	r.Header.Del(s.config.AuthHeader)
+	ok := false
+	for _, valid := range s.config.AuthTokens {
+		// Compare against every token, so that timing does not reveal which
+		// one matched.
+		if subtle.ConstantTimeCompare(token, []byte(valid)) == 1 {
+			ok = true
+		}
+	}
+	return ok
+}
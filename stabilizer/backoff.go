@@ -0,0 +1,64 @@
+package stabilizer
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// The range of delays before restarting a worker which is crash-looping.
+const (
+	minRestartBackoff = 100 * time.Millisecond
+	maxRestartBackoff = 30 * time.Second
+)
+
+// restartBackoff returns how long to wait before replacing w, which has died.
+// flaps is the number of consecutive workers with the same index which died on
+// their own before MinHealthyUptime, and is updated: such workers are
+// flapping, and are restarted with exponential backoff. Workers which were
+// killed by the stabilizer (e.g. due to a timeout) or stayed alive long enough
+// reset the backoff.
+//
+// The exception is broken workers, which accept connections but never respond:
+// timeouts is the number of consecutive workers with the same index which were
+// killed due to a timeout before MinHealthyUptime without having responded to
+// any request, and is updated. Once it reaches BrokenWorkerTimeouts, such
+// workers count as flapping too.
+func (s *Stabilizer) restartBackoff(w *worker, flaps, timeouts *int) time.Duration {
+	if s.ctx.Err() != nil {
+		// The worker was killed because we are shutting down.
+		return 0
+	}
+	if w.reason == reasonTimeout && s.config.BrokenWorkerTimeouts > 0 && atomic.LoadInt32(&w.responded) == 0 && time.Since(w.started) < s.config.MinHealthyUptime {
+		*timeouts++
+	} else {
+		*timeouts = 0
+	}
+	switch w.reason {
+	case reasonTimeout:
+		if s.config.BrokenWorkerTimeouts == 0 || *timeouts < s.config.BrokenWorkerTimeouts {
+			*flaps = 0
+			return 0
+		}
+		log.Printf("worker %v: WARNING: broken, %v consecutive workers timed out within %v of starting without responding to any request", w.pid, *timeouts, s.config.MinHealthyUptime)
+		s.metrics.workerBroken.Inc()
+	case reasonManual, reasonRecycle, reasonMemory, reasonIdle:
+		*flaps = 0
+		return 0
+	}
+	if !w.started.IsZero() && time.Since(w.started) >= s.config.MinHealthyUptime {
+		*flaps = 0
+		return 0
+	}
+	*flaps++
+	s.metrics.workerFlaps.Inc()
+	backoff := maxRestartBackoff
+	if *flaps < 16 {
+		backoff = minRestartBackoff << uint(*flaps-1)
+		if backoff > maxRestartBackoff {
+			backoff = maxRestartBackoff
+		}
+	}
+	log.Printf("worker %v: flapping, died within %v of starting (%v times in a row), restarting in %v", w.pid, s.config.MinHealthyUptime, *flaps, backoff)
+	return backoff
+}
@@ -0,0 +1,247 @@
+package stabilizer
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// checkExecutable returns an error if path is not an executable regular file.
+func checkExecutable(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s: not a regular file", path)
+	}
+	if info.Mode().Perm()&0111 == 0 {
+		return fmt.Errorf("%s: not executable", path)
+	}
+	return nil
+}
+
+// absCommand returns command, which must be executable, as run by workers.
+// Relative paths such as "./worker" are made absolute using our working
+// directory, since they would otherwise be resolved relative to the worker's
+// (see WorkerDir). Commands without a path separator are looked up in $PATH
+// when each worker is spawned, as usual.
+func absCommand(command string) (string, error) {
+	if !strings.Contains(command, string(filepath.Separator)) {
+		if _, err := exec.LookPath(command); err != nil {
+			return "", err
+		}
+		return command, nil
+	}
+	path, err := filepath.Abs(command)
+	if err != nil {
+		return "", err
+	}
+	if err := checkExecutable(path); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// resolveCommand resolves command, via $PATH and any symlinks, to the binary
+// a worker spawned now runs, logging it whenever it changes. Workers exec
+// command itself, which the OS resolves anew each time rather than once at
+// startup, so atomically replacing a symlink to the binary (e.g. during a
+// deploy) takes effect for workers spawned afterwards, while existing workers
+// keep running the old binary until they are recycled.
+func (s *Stabilizer) resolveCommand(command string) {
+	path, err := exec.LookPath(command)
+	if err == nil {
+		path, err = filepath.EvalSymlinks(path)
+	}
+	if err != nil {
+		// Spawning the worker will fail, and log why.
+		return
+	}
+	s.commandTargetsMu.Lock()
+	defer s.commandTargetsMu.Unlock()
+	if s.commandTargets == nil {
+		s.commandTargets = make(map[string]string)
+	}
+	if prev, ok := s.commandTargets[command]; !ok || prev != path {
+		if ok || path != command {
+			log.Printf("worker command: %s resolves to %s", command, path)
+		}
+		s.commandTargets[command] = path
+	}
+}
+
+// binaryVersion identifies a particular version of a file on disk.
+type binaryVersion struct {
+	modTime time.Time
+	inode   uint64
+	size    int64
+}
+
+func statBinary(path string) (binaryVersion, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return binaryVersion{}, err
+	}
+	v := binaryVersion{modTime: info.ModTime(), size: info.Size()}
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		v.inode = uint64(st.Ino)
+	}
+	return v, nil
+}
+
+// watchBinary polls the worker command for changes and, once it has stopped
+// changing for the debounce period and is executable, performs a rolling
+// recycle of all workers so that they pick up the new binary. If Reload
+// changes the command, the new one is watched instead.
+func (s *Stabilizer) watchBinary(debounce time.Duration) {
+	var (
+		command, path string // path is empty if command can't be found
+		current       binaryVersion
+		pending       binaryVersion
+		changedAt     time.Time
+	)
+	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
+	for {
+		if c := s.current().Command; c != command {
+			// Reload already recycles workers when the command changes.
+			command, path, changedAt = c, "", time.Time{}
+			p, err := exec.LookPath(command)
+			if err == nil {
+				current, err = statBinary(p)
+			}
+			if err != nil {
+				log.Printf("watch-binary: %v", err)
+			} else {
+				path = p
+				log.Printf("watch-binary: watching %s", path)
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-s.ctx.Done():
+			return
+		}
+		if path == "" {
+			continue
+		}
+		v, err := statBinary(path)
+		if err != nil {
+			// The binary is likely mid-replacement.
+			continue
+		}
+		if v == current {
+			changedAt = time.Time{}
+			continue
+		}
+		if v != pending || changedAt.IsZero() {
+			pending, changedAt = v, time.Now()
+			continue
+		}
+		if time.Since(changedAt) < debounce {
+			continue
+		}
+		if err := checkExecutable(path); err != nil {
+			log.Printf("watch-binary: not recycling workers: %v", err)
+			continue
+		}
+		log.Printf("watch-binary: %s changed, recycling workers", path)
+		current, changedAt = v, time.Time{}
+		if err := s.recycleWorkers(); err != nil {
+			log.Printf("watch-binary: %v", err)
+		}
+	}
+}
+
+// recycleStatus describes the progress of the current (or last) rolling
+// recycle of workers, for /debug/recycle.
+type recycleStatus struct {
+	Active     bool       `json:"active"`
+	Started    *time.Time `json:"started,omitempty"`
+	Total      int        `json:"total"`
+	Recycled   int        `json:"recycled"`
+	InProgress int        `json:"in_progress"`
+	Error      string     `json:"error,omitempty"`
+}
+
+// recycleProgress returns the progress of the current (or last) recycle.
+func (s *Stabilizer) recycleProgress() recycleStatus {
+	s.recycleMu.Lock()
+	defer s.recycleMu.Unlock()
+	return s.recycle
+}
+
+// recycleWorkers gracefully restarts all alive workers, RecycleParallelism at
+// a time, waiting for each replacement to become ready before moving on to
+// the next so that the capacity of the pool is never reduced by more than
+// RecycleParallelism workers.
+func (s *Stabilizer) recycleWorkers() error {
+	workers := s.pool.alive()
+	started := time.Now()
+	s.recycleMu.Lock()
+	s.recycle = recycleStatus{Active: true, Started: &started, Total: len(workers)}
+	s.recycleMu.Unlock()
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, s.config.RecycleParallelism)
+	for _, w := range workers {
+		sem <- struct{}{}
+		if s.recycleProgress().Error != "" {
+			// Don't start recycling more workers after a failure.
+			<-sem
+			break
+		}
+		wg.Add(1)
+		go func(w *worker) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			s.recycleWorker(w)
+		}(w)
+	}
+	wg.Wait()
+
+	s.recycleMu.Lock()
+	defer s.recycleMu.Unlock()
+	s.recycle.Active = false
+	if s.recycle.Error != "" {
+		return errors.New(s.recycle.Error)
+	}
+	log.Println("recycle: all workers recycled")
+	return nil
+}
+
+// recycleWorker drains w and waits for its replacement to become ready,
+// recording the progress of the recycle.
+func (s *Stabilizer) recycleWorker(w *worker) {
+	if err := s.pool.markDraining(w); err != nil {
+		log.Printf("recycle: %v", err)
+		return
+	}
+	s.recycleMu.Lock()
+	s.recycle.InProgress++
+	s.recycleMu.Unlock()
+
+	s.drainWorker(w, reasonRecycle, s.current().DrainWorkerTimeout)
+	<-w.done
+	replaced := s.pool.waitReplaced(w, s.config.ReadyTimeout)
+
+	s.recycleMu.Lock()
+	defer s.recycleMu.Unlock()
+	s.recycle.InProgress--
+	if !replaced {
+		if s.recycle.Error == "" {
+			s.recycle.Error = fmt.Sprintf("recycle: aborting, replacement worker not ready after %v", s.config.ReadyTimeout)
+		}
+		return
+	}
+	s.recycle.Recycled++
+}
@@ -0,0 +1,81 @@
+package stabilizer
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ParseStatusCodes parses a comma-separated list of HTTP status codes, in
+// which classes such as 5xx stand for all status codes in that class, for
+// Config.BreakerStatusCodes.
+func ParseStatusCodes(s string) ([]int, error) {
+	var codes []int
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if len(field) == 3 && strings.HasSuffix(field, "xx") && field[0] >= '1' && field[0] <= '5' {
+			class := int(field[0]-'0') * 100
+			for code := class; code < class+100; code++ {
+				codes = append(codes, code)
+			}
+			continue
+		}
+		code, err := strconv.Atoi(field)
+		if err != nil || code < 100 || code > 599 {
+			return nil, fmt.Errorf("invalid status code %q", field)
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
+
+// breakerFailure reports whether a response with the given status code counts
+// as a failure for the circuit breaker.
+func (s *Stabilizer) breakerFailure(status int) bool {
+	if s.breakerStatus == nil {
+		return status >= 500
+	}
+	return s.breakerStatus[status]
+}
+
+// recordBreakerResult records whether a request to w failed, opening its
+// circuit breaker after BreakerFailures consecutive failures.
+func (s *Stabilizer) recordBreakerResult(w *worker, failed bool) {
+	config := s.current()
+	if config.BreakerFailures == 0 {
+		return
+	}
+	if s.pool.recordResult(w, failed, config.BreakerFailures, config.BreakerCooldown) {
+		log.Printf("worker %v: circuit breaker open for %v after %v consecutive failures", w.pid, config.BreakerCooldown, config.BreakerFailures)
+		s.metrics.breakerOpens.Inc()
+	}
+}
+
+// recordResult records whether a request to w failed, taking w out of rotation
+// for cooldown once failures consecutive requests have failed, and returns
+// whether it did so. Once the cooldown has passed, a single further failure
+// takes w out of rotation again.
+func (p *pool) recordResult(w *worker, failed bool, failures int, cooldown time.Duration) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !failed {
+		w.breakerFailures = 0
+		return false
+	}
+	w.breakerFailures++
+	if w.breakerFailures < failures || time.Now().Before(w.breakerOpenUntil) {
+		return false
+	}
+	w.breakerFailures = failures - 1
+	w.breakerOpenUntil = time.Now().Add(cooldown)
+	time.AfterFunc(cooldown, func() {
+		// Wake up requests waiting for the worker to become available.
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.broadcastLocked()
+		p.wakeWorkerLocked(w)
+	})
+	return true
+}
@@ -0,0 +1,65 @@
+package stabilizer
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// clientLimiter limits the number of concurrent requests of each client, see
+// Config.PerClientConcurrency.
+type clientLimiter struct {
+	mu       sync.Mutex
+	inflight map[string]int // by client identity, only while non-zero
+}
+
+// clientIdentity returns the identity of the client which sent r for
+// PerClientConcurrency, or "" if it has none.
+func (s *Stabilizer) clientIdentity(r *http.Request) string {
+	if s.config.PerClientConcurrency == 0 {
+		return ""
+	}
+	return r.Header.Get(s.config.ClientHeader)
+}
+
+// acquireClient reserves one of the PerClientConcurrency slots of client,
+// which sent r, returning a function releasing it, or writes an error and
+// returns nil if the client already has that many requests in flight.
+func (s *Stabilizer) acquireClient(rw http.ResponseWriter, r *http.Request, id string) func() {
+	if id == "" {
+		return func() {}
+	}
+	l := &s.clients
+	l.mu.Lock()
+	if l.inflight == nil {
+		l.inflight = make(map[string]int)
+	}
+	if l.inflight[id] >= s.config.PerClientConcurrency {
+		l.mu.Unlock()
+		s.metrics.clientRejections.Inc()
+		s.writeError(rw, r, http.StatusTooManyRequests, "hss_client_concurrency", fmt.Sprintf("too many concurrent requests from this client (limit %v)", s.config.PerClientConcurrency))
+		return nil
+	}
+	l.inflight[id]++
+	l.mu.Unlock()
+	return func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if l.inflight[id]--; l.inflight[id] == 0 {
+			delete(l.inflight, id)
+		}
+	}
+}
+
+// stats returns the number of clients with requests in flight, and the
+// most requests any one of them has in flight.
+func (l *clientLimiter) stats() (clients, max int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, n := range l.inflight {
+		if n > max {
+			max = n
+		}
+	}
+	return len(l.inflight), max
+}
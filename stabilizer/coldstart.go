@@ -0,0 +1,52 @@
+package stabilizer
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Behaviors for requests which arrive while no workers are ready, see
+// Config.ColdStart.
+const (
+	ColdStartBlock           = "block"             // queue as usual
+	ColdStartFast503         = "fast-503"          // fail immediately
+	ColdStartWaitWithTimeout = "wait-with-timeout" // wait up to ColdStartTimeout
+)
+
+// checkColdStart handles a request which arrives while no workers are ready
+// according to ColdStart, writing an error response and returning false if
+// the request should not be proxied.
+func (s *Stabilizer) checkColdStart(rw http.ResponseWriter, r *http.Request) bool {
+	if s.config.ColdStart == ColdStartBlock {
+		return true
+	}
+	ready, changed := s.pool.ready()
+	if ready > 0 {
+		return true
+	}
+	if s.config.ColdStart == ColdStartWaitWithTimeout {
+		timeout := s.current().ColdStartTimeout
+		deadline := time.NewTimer(timeout)
+		defer deadline.Stop()
+		for ready == 0 {
+			select {
+			case <-changed:
+			case <-deadline.C:
+				s.writeError(rw, r, http.StatusServiceUnavailable, "hss_no_workers_ready", fmt.Sprintf("no workers ready after %v", timeout))
+				return false
+			case <-r.Context().Done():
+				// The client has gone away, unless RequestDeadline was
+				// exceeded.
+				if s.requestDeadlineExceeded(r) {
+					s.writeRequestDeadlineExceeded(rw, r)
+				}
+				return false
+			}
+			ready, changed = s.pool.ready()
+		}
+		return true
+	}
+	s.writeError(rw, r, http.StatusServiceUnavailable, "hss_no_workers_ready", "no workers ready")
+	return false
+}
@@ -0,0 +1,54 @@
+package stabilizer
+
+import (
+	"fmt"
+	"strings"
+)
+
+// secretArgNames are substrings of the names of arguments whose values are
+// redacted when logging the worker command, since they likely contain secrets.
+var secretArgNames = []string{"token", "secret", "password", "passwd", "key", "credential", "auth"}
+
+// looksSecret reports whether the argument (or environment variable) name
+// looks like it is given a secret.
+func looksSecret(name string) bool {
+	name = strings.ToLower(name)
+	for _, s := range secretArgNames {
+		if strings.Contains(name, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactArgs returns a copy of args with the values of those which look like
+// secrets (see looksSecret) redacted, whether given as "-name=value",
+// "-name value" or "NAME=value" (e.g. to env).
+func redactArgs(args []string) []string {
+	redactedArgs := make([]string, len(args))
+	copy(redactedArgs, args)
+	for i := 0; i < len(redactedArgs); i++ {
+		arg := redactedArgs[i]
+		if j := strings.Index(arg, "="); j > 0 {
+			if looksSecret(arg[:j]) {
+				redactedArgs[i] = arg[:j+1] + redacted
+			}
+			continue
+		}
+		if strings.HasPrefix(arg, "-") && looksSecret(arg) && i+1 < len(redactedArgs) && !strings.HasPrefix(redactedArgs[i+1], "-") {
+			i++
+			redactedArgs[i] = redacted
+		}
+	}
+	return redactedArgs
+}
+
+// commandString formats the worker command for logging, see
+// RedactCommandArgs.
+func (s *Stabilizer) commandString() string {
+	config := s.current()
+	if config.RedactCommandArgs {
+		return fmt.Sprintf("%s (%d arguments redacted)", config.Command, len(config.Args))
+	}
+	return strings.Join(append([]string{config.Command}, redactArgs(config.Args)...), " ")
+}
@@ -0,0 +1,137 @@
+package stabilizer
+
+import (
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// defaultCompressTypes are the content types compressed by default, see
+// Config.CompressTypes.
+var defaultCompressTypes = []string{
+	"application/javascript",
+	"application/json",
+	"application/xml",
+	"image/svg+xml",
+	"text/*",
+}
+
+// acceptsGzip reports whether the client accepts gzip-encoded responses,
+// according to its Accept-Encoding header.
+func acceptsGzip(r *http.Request) bool {
+	var gzipQ, anyQ float64 = -1, -1
+	for _, field := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		parts := strings.Split(field, ";")
+		coding := strings.ToLower(strings.TrimSpace(parts[0]))
+		q := 1.0
+		for _, param := range parts[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[len("q="):], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		switch coding {
+		case "gzip", "x-gzip":
+			gzipQ = q
+		case "*":
+			anyQ = q
+		}
+	}
+	if gzipQ >= 0 {
+		return gzipQ > 0
+	}
+	return anyQ > 0
+}
+
+// shouldCompress reports whether resp should be compressed for the client,
+// see Config.Compress.
+func (s *Stabilizer) shouldCompress(resp *http.Response) bool {
+	if !s.config.Compress || resp.Request.Method == http.MethodHead || !acceptsGzip(resp.Request) {
+		return false
+	}
+	switch resp.StatusCode {
+	case http.StatusNoContent, http.StatusPartialContent, http.StatusNotModified:
+		return false
+	}
+	if resp.Header.Get("Content-Encoding") != "" || resp.Header.Get("Content-Range") != "" {
+		// Already compressed (or otherwise encoded) by the worker.
+		return false
+	}
+	if resp.ContentLength >= 0 && resp.ContentLength < s.config.CompressMinBytes {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || mediaType == "text/event-stream" {
+		// Event streams are never compressed, even if they match "text/*",
+		// as clients must receive each event as soon as it is sent.
+		return false
+	}
+	for _, t := range s.config.CompressTypes {
+		if t == mediaType || strings.HasSuffix(t, "/*") && strings.HasPrefix(mediaType, t[:len(t)-1]) {
+			return true
+		}
+	}
+	return false
+}
+
+// compressResponse gzips the body of resp as it is sent to the client, if it
+// should be compressed.
+func (s *Stabilizer) compressResponse(resp *http.Response) {
+	if !s.config.Compress {
+		return
+	}
+	// Caches must key responses by whether the client accepts gzip, even if
+	// this particular one wasn't compressed.
+	resp.Header.Add("Vary", "Accept-Encoding")
+	if !s.shouldCompress(resp) {
+		return
+	}
+	resp.Header.Set("Content-Encoding", "gzip")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		// The compressed body is no longer byte-for-byte identical.
+		resp.Header.Set("ETag", "W/"+etag)
+	}
+	s.metrics.compressedResponses.Inc()
+	resp.Body = newGzipBody(resp.Body)
+}
+
+// newGzipBody returns a reader of body, gzipped. Whatever is read from body
+// is flushed through the gzip writer straight away, so that streamed (e.g.
+// chunked) responses still reach the client as they are written, rather than
+// once the gzip writer's buffer fills.
+//
+// Closing it stops reading body, which is then closed by the goroutine
+// reading it rather than concurrently with a read. That read is interrupted
+// in any case when the request is done, as it is canceled.
+func newGzipBody(body io.ReadCloser) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		defer body.Close()
+		zw := gzip.NewWriter(pw)
+		buf := make([]byte, 32*1024)
+		var err error
+		for err == nil {
+			var n int
+			n, err = body.Read(buf)
+			if n > 0 {
+				if _, werr := zw.Write(buf[:n]); werr != nil {
+					err = werr
+				} else if ferr := zw.Flush(); ferr != nil {
+					err = ferr
+				}
+			}
+		}
+		if err == io.EOF {
+			err = zw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
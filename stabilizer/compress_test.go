@@ -0,0 +1,149 @@
+package stabilizer
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAcceptsGzip(t *testing.T) {
+	tests := []struct {
+		acceptEncoding string
+		want           bool
+	}{
+		{"", false},
+		{"gzip", true},
+		{"GZIP", true},
+		{"x-gzip", true},
+		{"deflate, br", false},
+		{"deflate, gzip;q=0.5", true},
+		{"gzip;q=0", false},
+		{"gzip; q=0.0", false},
+		{"*", true},
+		{"*;q=0", false},
+		// An explicit gzip q-value takes precedence over the wildcard.
+		{"gzip;q=0, *", false},
+		{"*;q=0, gzip", true},
+	}
+	for _, tst := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Accept-Encoding", tst.acceptEncoding)
+		if got := acceptsGzip(r); got != tst.want {
+			t.Errorf("acceptsGzip(%q) = %v, want %v", tst.acceptEncoding, got, tst.want)
+		}
+	}
+}
+
+func TestShouldCompress(t *testing.T) {
+	s := &Stabilizer{config: Config{
+		Compress:         true,
+		CompressMinBytes: 1024,
+		CompressTypes:    defaultCompressTypes,
+	}}
+	tests := []struct {
+		name   string
+		method string
+		status int
+		header http.Header
+		length int64
+		want   bool
+	}{
+		{"json", "GET", 200, http.Header{"Content-Type": {"application/json"}}, 2048, true},
+		{"text wildcard", "GET", 200, http.Header{"Content-Type": {"text/html; charset=utf-8"}}, 2048, true},
+		{"unknown length", "GET", 200, http.Header{"Content-Type": {"text/plain"}}, -1, true},
+		{"small", "GET", 200, http.Header{"Content-Type": {"text/plain"}}, 100, false},
+		{"other type", "GET", 200, http.Header{"Content-Type": {"image/png"}}, 2048, false},
+		{"no type", "GET", 200, http.Header{}, 2048, false},
+		{"event stream", "GET", 200, http.Header{"Content-Type": {"text/event-stream"}}, -1, false},
+		{"already encoded", "GET", 200, http.Header{"Content-Type": {"text/plain"}, "Content-Encoding": {"br"}}, 2048, false},
+		{"range", "GET", 200, http.Header{"Content-Type": {"text/plain"}, "Content-Range": {"bytes 0-2047/4096"}}, 2048, false},
+		{"head", "HEAD", 200, http.Header{"Content-Type": {"text/plain"}}, 2048, false},
+		{"no content", "GET", 204, http.Header{"Content-Type": {"text/plain"}}, -1, false},
+		{"partial content", "GET", 206, http.Header{"Content-Type": {"text/plain"}}, 2048, false},
+		{"not modified", "GET", 304, http.Header{"Content-Type": {"text/plain"}}, -1, false},
+	}
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			r := httptest.NewRequest(tst.method, "/", nil)
+			r.Header.Set("Accept-Encoding", "gzip")
+			resp := &http.Response{
+				StatusCode:    tst.status,
+				Header:        tst.header,
+				ContentLength: tst.length,
+				Request:       r,
+			}
+			if got := s.shouldCompress(resp); got != tst.want {
+				t.Errorf("got %v, want %v", got, tst.want)
+			}
+		})
+	}
+}
+
+func TestCompressStreamed(t *testing.T) {
+	release := make(chan struct{})
+	ts := newTestStabilizer(t, Config{Workers: 1, Compress: true}, http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", "text/plain")
+		rw.Write([]byte("first"))
+		rw.(http.Flusher).Flush()
+		<-release
+		rw.Write([]byte(" second"))
+	}))
+	defer ts.close()
+	defer close(release)
+
+	req, err := http.NewRequest("GET", ts.srv.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Setting Accept-Encoding ourselves stops the client from transparently
+	// decompressing the response.
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if got := resp.Header.Get("Content-Encoding"); got != "gzip" {
+		t.Fatalf("got Content-Encoding %q, want gzip", got)
+	}
+
+	// The first write must reach the client while the worker is still
+	// blocked, rather than being held in the gzip writer's buffer.
+	first := make(chan string, 1)
+	var zr *gzip.Reader
+	go func() {
+		var err error
+		zr, err = gzip.NewReader(resp.Body)
+		if err != nil {
+			first <- err.Error()
+			return
+		}
+		buf := make([]byte, len("first"))
+		if _, err := io.ReadFull(zr, buf); err != nil {
+			first <- err.Error()
+			return
+		}
+		first <- string(buf)
+	}()
+	select {
+	case got := <-first:
+		if got != "first" {
+			t.Fatalf("got %q, want %q", got, "first")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the first write of a streamed response")
+	}
+
+	release <- struct{}{}
+	rest, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(rest); got != " second" {
+		t.Errorf("got %q, want %q", got, " second")
+	}
+}
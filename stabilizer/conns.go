@@ -0,0 +1,70 @@
+package stabilizer
+
+import (
+	"net"
+	"sync"
+)
+
+// workerConns tracks the open connections to each worker, so that they can be
+// closed as soon as the worker dies. They are tracked by worker rather than by
+// address, since a replacement worker may listen on the same address (e.g. the
+// same port, or a static worker) and its connections must not be closed.
+//
+// Otherwise, an idle keep-alive connection to a dead worker may be reused by
+// a request before the transport notices that it was closed (or, if the
+// worker's process was killed without closing it, at all), failing the
+// request. The transport only retries such failures for idempotent requests,
+// so e.g. a POST would fail spuriously.
+type workerConns struct {
+	mu    sync.Mutex
+	conns map[*worker]map[*workerConn]struct{}
+}
+
+// workerConn is a connection to a worker, which stops being tracked once it
+// is closed.
+type workerConn struct {
+	net.Conn
+	conns  *workerConns
+	worker *worker
+	once   sync.Once
+}
+
+func (c *workerConn) Close() error {
+	c.once.Do(func() {
+		c.conns.mu.Lock()
+		delete(c.conns.conns[c.worker], c)
+		if len(c.conns.conns[c.worker]) == 0 {
+			delete(c.conns.conns, c.worker)
+		}
+		c.conns.mu.Unlock()
+	})
+	return c.Conn.Close()
+}
+
+// track tracks conn, a new connection to w.
+func (wc *workerConns) track(w *worker, conn net.Conn) net.Conn {
+	c := &workerConn{Conn: conn, conns: wc, worker: w}
+	wc.mu.Lock()
+	defer wc.mu.Unlock()
+	if wc.conns == nil {
+		wc.conns = make(map[*worker]map[*workerConn]struct{})
+	}
+	if wc.conns[w] == nil {
+		wc.conns[w] = make(map[*workerConn]struct{})
+	}
+	wc.conns[w][c] = struct{}{}
+	return c
+}
+
+// closeAll closes all connections to w, e.g. because it has died.
+func (wc *workerConns) closeAll(w *worker) {
+	wc.mu.Lock()
+	var conns []*workerConn
+	for c := range wc.conns[w] {
+		conns = append(conns, c)
+	}
+	wc.mu.Unlock()
+	for _, c := range conns {
+		c.Close()
+	}
+}
@@ -0,0 +1,85 @@
+package stabilizer
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// TestWorkerConnsSameAddress checks that closing the connections to a dead
+// worker leaves those to its replacement at the same address alone.
+func TestWorkerConnsSameAddress(t *testing.T) {
+	var wc workerConns
+	old, replacement := newTestWorker(0, 1), newTestWorker(0, 1)
+	old.port, replacement.port = 1234, 1234
+
+	oldConn, oldPeer := net.Pipe()
+	defer oldPeer.Close()
+	newConn, newPeer := net.Pipe()
+	defer newPeer.Close()
+	wc.track(old, oldConn)
+	tracked := wc.track(replacement, newConn)
+
+	wc.closeAll(old)
+	if _, err := oldConn.Write([]byte("x")); err == nil {
+		t.Error("connection to the dead worker is still open")
+	}
+	go newPeer.Read(make([]byte, 1))
+	if _, err := tracked.Write([]byte("x")); err != nil {
+		t.Errorf("connection to the replacement worker was closed: %v", err)
+	}
+
+	wc.mu.Lock()
+	defer wc.mu.Unlock()
+	if _, ok := wc.conns[old]; ok {
+		t.Error("dead worker still tracked")
+	}
+	if len(wc.conns[replacement]) != 1 {
+		t.Errorf("replacement worker has %d tracked connections, want 1", len(wc.conns[replacement]))
+	}
+}
+
+// TestStaleWorkerConns checks that once a worker dies, no connection to it is
+// reused for requests to its replacement.
+func TestStaleWorkerConns(t *testing.T) {
+	ts := newTestStabilizer(t, Config{Workers: 1}, http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Write([]byte("ok"))
+	}))
+	defer ts.close()
+	post := func() {
+		t.Helper()
+		resp, err := http.Post(ts.srv.URL, "text/plain", strings.NewReader("body"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("got status %v, want 200", resp.StatusCode)
+		}
+	}
+
+	post()
+	old := ts.pool.alive()[0]
+	ts.conns.mu.Lock()
+	n := len(ts.conns.conns[old])
+	ts.conns.mu.Unlock()
+	if n != 1 {
+		t.Fatalf("%d connections to the worker tracked, want 1", n)
+	}
+
+	old.kill(reasonManual)
+	waitFor(t, func() bool {
+		alive := ts.pool.alive()
+		return len(alive) == 1 && alive[0] != old
+	})
+	ts.conns.mu.Lock()
+	_, ok := ts.conns.conns[old]
+	ts.conns.mu.Unlock()
+	if ok {
+		t.Error("connections to the dead worker are still tracked")
+	}
+	// A POST is not retried by the transport, so would fail if sent over a
+	// stale connection.
+	post()
+}
@@ -0,0 +1,37 @@
+package stabilizer
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+)
+
+// requestDeadlineKey is the context key of the context enforcing
+// RequestDeadline for a request.
+type requestDeadlineKey struct{}
+
+// withRequestDeadline returns r with RequestDeadline applied to its context,
+// and a function releasing it.
+func (s *Stabilizer) withRequestDeadline(r *http.Request) (*http.Request, func()) {
+	deadline := s.current().RequestDeadline
+	if deadline == 0 {
+		return r, func() {}
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), deadline)
+	return r.WithContext(context.WithValue(ctx, requestDeadlineKey{}, ctx)), cancel
+}
+
+// requestDeadlineExceeded reports whether r failed because RequestDeadline
+// was exceeded, rather than e.g. the client going away or the worker timing
+// out.
+func (s *Stabilizer) requestDeadlineExceeded(r *http.Request) bool {
+	ctx, ok := r.Context().Value(requestDeadlineKey{}).(context.Context)
+	return ok && ctx.Err() == context.DeadlineExceeded
+}
+
+// writeRequestDeadlineExceeded responds to a request which exceeded
+// RequestDeadline.
+func (s *Stabilizer) writeRequestDeadlineExceeded(rw http.ResponseWriter, r *http.Request) {
+	s.metrics.requestDeadlines.Inc()
+	s.writeError(rw, r, http.StatusGatewayTimeout, "hss_request_deadline", fmt.Sprintf("request deadline of %v exceeded", s.current().RequestDeadline))
+}
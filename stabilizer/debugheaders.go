@@ -0,0 +1,74 @@
+package stabilizer
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// defaultDebugHeadersRedact are the headers redacted by DebugHeaders by
+// default, along with AuthHeader.
+var defaultDebugHeadersRedact = []string{
+	"Authorization",
+	"Cookie",
+	"Proxy-Authorization",
+	"Set-Cookie",
+}
+
+// headerLogger is a transport which logs the headers of requests sent to
+// workers and their responses, see Config.DebugHeaders.
+type headerLogger struct {
+	s    *Stabilizer
+	next http.RoundTripper
+}
+
+func (t *headerLogger) RoundTrip(req *http.Request) (*http.Response, error) {
+	w := t.s.workerForRequest(req)
+	h := req.Header.Clone()
+	h.Set("Host", req.Host)
+	log.Printf("worker %v: request headers: %s %s %s", w.pid, req.Method, req.URL.RequestURI(), t.s.formatHeaders(h))
+	resp, err := t.next.RoundTrip(req)
+	if err == nil {
+		log.Printf("worker %v: response headers: %s %s %d %s", w.pid, req.Method, req.URL.RequestURI(), resp.StatusCode, t.s.formatHeaders(resp.Header))
+	}
+	return resp, err
+}
+
+// formatHeaders formats h as Name="value" pairs sorted by name, with the
+// values of DebugHeadersRedact (and AuthHeader) redacted.
+func (s *Stabilizer) formatHeaders(h http.Header) string {
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, name := range names {
+		for _, value := range h[name] {
+			if s.redactHeader(name) {
+				value = redacted
+			}
+			if b.Len() > 0 {
+				b.WriteByte(' ')
+			}
+			fmt.Fprintf(&b, "%s=%q", name, value)
+		}
+	}
+	return b.String()
+}
+
+// redactHeader reports whether the value of the header name must not be
+// logged by DebugHeaders.
+func (s *Stabilizer) redactHeader(name string) bool {
+	if strings.EqualFold(name, s.config.AuthHeader) {
+		return true
+	}
+	for _, r := range s.config.DebugHeadersRedact {
+		if strings.EqualFold(name, r) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,197 @@
+package stabilizer
+
+import (
+	"bytes"
+	"encoding/json"
+	htmltemplate "html/template"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	texttemplate "text/template"
+)
+
+// errorData is passed to error templates.
+type errorData struct {
+	Status     int
+	StatusText string
+	Code       string
+	Error      string
+	Fields     map[string]interface{} // specific to the error code, if any
+}
+
+// errorTemplates holds the custom error response templates loaded from
+// Config.ErrorTemplates, by error code ("default" applies to all error codes
+// without a template of their own).
+type errorTemplates struct {
+	html map[string]*htmltemplate.Template
+	json map[string]*texttemplate.Template
+}
+
+// defaultHTMLError is used for HTML error responses when there is no custom
+// template.
+var defaultHTMLError = htmltemplate.Must(htmltemplate.New("default").Parse(`<!DOCTYPE html>
+<html>
+<head><title>{{.Status}} {{.StatusText}}</title></head>
+<body>
+<h1>{{.Status}} {{.StatusText}}</h1>
+<p>{{.Error}}</p>
+<p><code>{{.Code}}</code></p>
+</body>
+</html>
+`))
+
+var jsonTemplateFuncs = texttemplate.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+}
+
+// loadErrorTemplates loads error templates from the files in dir named after
+// the error code they apply to, with a .html or .json extension, e.g.
+// hss_worker_timeout.html. HTML templates are escaped contextually, while JSON
+// templates should encode values themselves using the json function, e.g.
+// {"message": {{json .Error}}}.
+func loadErrorTemplates(dir string) (*errorTemplates, error) {
+	t := &errorTemplates{
+		html: make(map[string]*htmltemplate.Template),
+		json: make(map[string]*texttemplate.Template),
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		ext := filepath.Ext(file.Name())
+		code := strings.TrimSuffix(file.Name(), ext)
+		data, err := ioutil.ReadFile(filepath.Join(dir, file.Name()))
+		if err != nil {
+			return nil, err
+		}
+		switch ext {
+		case ".html":
+			t.html[code], err = htmltemplate.New(file.Name()).Parse(string(data))
+		case ".json":
+			t.json[code], err = texttemplate.New(file.Name()).Funcs(jsonTemplateFuncs).Parse(string(data))
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("error templates: loaded %s", file.Name())
+	}
+	return t, nil
+}
+
+// wantsHTML reports whether the client prefers an HTML response over JSON,
+// according to its Accept header. JSON is preferred when they are equal.
+func wantsHTML(r *http.Request) bool {
+	var htmlQ, jsonQ float64
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, err := strconv.ParseFloat(params["q"], 64); err == nil {
+			q = v
+		}
+		switch mediaType {
+		case "text/html":
+			if q > htmlQ {
+				htmlQ = q
+			}
+		case "application/json":
+			if q > jsonQ {
+				jsonQ = q
+			}
+		}
+	}
+	return htmlQ > jsonQ
+}
+
+// writeError responds with an error generated by the stabilizer itself. By
+// default errors are JSON objects with "error" and "code" fields, or a simple
+// HTML page if the client prefers HTML. Either may be customized per error
+// code via ErrorTemplates.
+func (s *Stabilizer) writeError(rw http.ResponseWriter, r *http.Request, status int, code, msg string) {
+	s.writeErrorFields(rw, r, status, code, msg, nil)
+}
+
+// writeErrorFields is like writeError, but adds fields to JSON errors (and
+// makes them available to templates as .Fields), for details specific to the
+// error code.
+func (s *Stabilizer) writeErrorFields(rw http.ResponseWriter, r *http.Request, status int, code, msg string, fields map[string]interface{}) {
+	data := errorData{
+		Status:     status,
+		StatusText: http.StatusText(status),
+		Code:       code,
+		Error:      msg,
+		Fields:     fields,
+	}
+	defaultJSON := map[string]interface{}{
+		"error": msg,
+		"code":  code,
+	}
+	for k, v := range fields {
+		defaultJSON[k] = v
+	}
+	var (
+		buf         bytes.Buffer
+		contentType string
+		err         error
+	)
+	if wantsHTML(r) {
+		contentType = "text/html; charset=utf-8"
+		tmpl := defaultHTMLError
+		if t := s.errorPages.lookupHTML(code); t != nil {
+			tmpl = t
+		}
+		err = tmpl.Execute(&buf, data)
+	} else {
+		contentType = "application/json"
+		if t := s.errorPages.lookupJSON(code); t != nil {
+			err = t.Execute(&buf, data)
+		} else {
+			err = json.NewEncoder(&buf).Encode(defaultJSON)
+		}
+	}
+	if err != nil {
+		log.Printf("error templates: %s: %v", code, err)
+		buf.Reset()
+		contentType = "application/json"
+		_ = json.NewEncoder(&buf).Encode(defaultJSON)
+	}
+	rw.Header().Set("Content-Type", contentType)
+	s.rewriteResponseHeaders(rw.Header())
+	rw.WriteHeader(status)
+	_, _ = buf.WriteTo(rw)
+}
+
+func (t *errorTemplates) lookupHTML(code string) *htmltemplate.Template {
+	if t == nil {
+		return nil
+	}
+	if tmpl, ok := t.html[code]; ok {
+		return tmpl
+	}
+	return t.html["default"]
+}
+
+func (t *errorTemplates) lookupJSON(code string) *texttemplate.Template {
+	if t == nil {
+		return nil
+	}
+	if tmpl, ok := t.json[code]; ok {
+		return tmpl
+	}
+	return t.json["default"]
+}
@@ -0,0 +1,59 @@
+package stabilizer
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// fallbackState tracks whether a worker slot (index) has fallen back to
+// FallbackCommand because its workers kept failing to start.
+type fallbackState struct {
+	active  bool      // workers are spawned with FallbackCommand
+	since   time.Time // when active last became true
+	probing bool      // the primary command is being retried
+}
+
+// update is called after each worker in slot index dies, where flaps is the
+// number of consecutive workers which have flapped (see restartBackoff) and
+// flapped is whether this worker did.
+//
+// After FallbackAfter consecutive flaps, the slot falls back. Once it has been
+// using the fallback command for FallbackRecheck, the primary command is
+// retried, falling back again immediately if it flaps.
+func (s *Stabilizer) updateFallback(f *fallbackState, index, flaps int, flapped bool) {
+	switch {
+	case f.probing && flapped:
+		log.Printf("worker index %v: WARNING: primary command still failing, falling back to %s again", index, s.config.FallbackCommand)
+		f.active, f.probing, f.since = true, false, time.Now()
+		atomic.AddInt32(&s.fallbackSlots, 1)
+		s.metrics.fallbackActivations.Inc()
+	case f.probing:
+		log.Printf("worker index %v: primary command recovered", index)
+		f.probing = false
+	case f.active && time.Since(f.since) >= s.config.FallbackRecheck:
+		log.Printf("worker index %v: retrying primary command after %v using fallback", index, s.config.FallbackRecheck)
+		f.active, f.probing = false, true
+		atomic.AddInt32(&s.fallbackSlots, -1)
+	case !f.active && flaps >= s.config.FallbackAfter:
+		log.Printf("worker index %v: WARNING: %v consecutive workers failed to start, falling back to %s", index, flaps, s.config.FallbackCommand)
+		f.active, f.since = true, time.Now()
+		atomic.AddInt32(&s.fallbackSlots, 1)
+		s.metrics.fallbackActivations.Inc()
+	}
+}
+
+// recheckFallback drains w, a healthy worker running FallbackCommand since the
+// given time, once FallbackRecheck has elapsed, so that the primary command is
+// retried in its place.
+func (s *Stabilizer) recheckFallback(w *worker, since time.Time) {
+	select {
+	case <-time.After(time.Until(since.Add(s.config.FallbackRecheck))):
+	case <-w.done:
+		return
+	}
+	if err := s.pool.markDraining(w); err != nil {
+		return
+	}
+	s.drainWorker(w, reasonRecycle, s.current().DrainWorkerTimeout)
+}
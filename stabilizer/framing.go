@@ -0,0 +1,78 @@
+package stabilizer
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// clientBody is a request body which wraps errors reading it, e.g. due to
+// malformed chunked encoding, in a clientBodyError, so that errorHandler can
+// tell them apart from errors caused by the worker. If limit is non-zero,
+// reading more than limit bytes fails with a bodyTooLargeError.
+type clientBody struct {
+	io.ReadCloser
+	limit, n int64
+}
+
+func (b *clientBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	if b.limit > 0 && b.n > b.limit {
+		return n, &clientBodyError{err: &bodyTooLargeError{limit: b.limit}}
+	}
+	if err != nil && err != io.EOF {
+		err = &clientBodyError{err: err}
+	}
+	return n, err
+}
+
+// clientBodyError is an error reading the body of a request from the client.
+type clientBodyError struct {
+	err error
+}
+
+func (e *clientBodyError) Error() string { return "reading request body: " + e.err.Error() }
+func (e *clientBodyError) Unwrap() error { return e.err }
+
+// bodyTooLargeError is returned when a request body exceeds MaxBodyBytes.
+type bodyTooLargeError struct {
+	limit int64
+}
+
+func (e *bodyTooLargeError) Error() string {
+	return fmt.Sprintf("request body exceeds the limit of %d bytes", e.limit)
+}
+
+// wrapClientBody makes errors reading the body of r recognizable, and
+// enforces MaxBodyBytes on bodies of unknown length, see clientBody. Go's HTTP
+// server has already rejected requests with ambiguous framing (e.g.
+// conflicting Content-Length headers) by now, but chunked bodies are only
+// validated as they are streamed to the worker.
+func (s *Stabilizer) wrapClientBody(r *http.Request) {
+	if r.Body != nil && r.Body != http.NoBody {
+		r.Body = &clientBody{ReadCloser: r.Body, limit: s.current().MaxBodyBytes}
+	}
+}
+
+// checkBodySize rejects r, returning false, if it declares a Content-Length
+// larger than MaxBodyBytes.
+func (s *Stabilizer) checkBodySize(rw http.ResponseWriter, r *http.Request) bool {
+	limit := s.current().MaxBodyBytes
+	if limit == 0 || r.ContentLength <= limit {
+		return true
+	}
+	s.writeBodyTooLarge(rw, r, &bodyTooLargeError{limit: limit})
+	return false
+}
+
+// writeBodyTooLarge writes the error response for a request whose body
+// exceeds MaxBodyBytes, including the limit in a max_body_bytes field. The
+// connection is closed rather than reading the rest of the body.
+func (s *Stabilizer) writeBodyTooLarge(rw http.ResponseWriter, r *http.Request, err *bodyTooLargeError) {
+	s.metrics.requestsTooLarge.Inc()
+	rw.Header().Set("Connection", "close")
+	s.writeErrorFields(rw, r, http.StatusRequestEntityTooLarge, "hss_body_too_large", err.Error(), map[string]interface{}{
+		"max_body_bytes": err.limit,
+	})
+}
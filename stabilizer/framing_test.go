@@ -0,0 +1,184 @@
+package stabilizer
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// framingWorker records the requests it receives.
+type framingWorker struct {
+	mu       sync.Mutex
+	requests []string // method, path, Content-Length header and body
+}
+
+func (f *framingWorker) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return
+	}
+	f.mu.Lock()
+	f.requests = append(f.requests, fmt.Sprintf("%s %s cl=%q body=%q", r.Method, r.URL.Path, r.Header.Get("Content-Length"), body))
+	f.mu.Unlock()
+	rw.Write([]byte("ok"))
+}
+
+func (f *framingWorker) received() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.requests...)
+}
+
+// sendRaw sends raw to the Stabilizer, returning the status codes of the
+// responses read until the connection is closed.
+func (ts *testStabilizer) sendRaw(t *testing.T, raw string) []int {
+	t.Helper()
+	conn, err := net.Dial("tcp", ts.srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := conn.Write([]byte(raw)); err != nil {
+		t.Fatal(err)
+	}
+	var codes []int
+	br := bufio.NewReader(conn)
+	for {
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			return codes
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		codes = append(codes, resp.StatusCode)
+		if resp.Close {
+			return codes
+		}
+	}
+}
+
+// smuggled is a request which a vulnerable proxy could be tricked into
+// sending to the worker as part of the previous request's body, or vice versa.
+const smuggled = "GET /smuggled HTTP/1.1\r\nHost: test\r\nConnection: close\r\n\r\n"
+
+func TestRequestSmuggling(t *testing.T) {
+	tests := []struct {
+		name  string
+		raw   string
+		codes []int    // the statuses of the responses
+		want  []string // the requests the worker receives
+	}{
+		{
+			name: "content-length and chunked",
+			// The Content-Length is ignored, rather than the chunked body
+			// ending after 6 bytes and the rest being a second request.
+			raw:   "POST / HTTP/1.1\r\nHost: test\r\nContent-Length: 6\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\n\r\n" + smuggled,
+			codes: []int{200, 200},
+			want:  []string{`POST / cl="" body="hello"`, `GET /smuggled cl="" body=""`},
+		},
+		{
+			name:  "conflicting content-lengths",
+			raw:   "POST / HTTP/1.1\r\nHost: test\r\nContent-Length: 0\r\nContent-Length: 60\r\n\r\n" + smuggled,
+			codes: []int{400},
+		},
+		{
+			name:  "invalid content-length",
+			raw:   "POST / HTTP/1.1\r\nHost: test\r\nContent-Length: +0\r\n\r\n" + smuggled,
+			codes: []int{400},
+		},
+		{
+			name: "obs-fold transfer-encoding",
+			// The folded header is unfolded, so it is chunked like the first
+			// case, and the worker is only ever sent the unambiguous
+			// re-framed request.
+			raw:   "POST / HTTP/1.1\r\nHost: test\r\nContent-Length: 0\r\nTransfer-Encoding:\r\n chunked\r\n\r\n5\r\nhello\r\n0\r\n\r\n" + smuggled,
+			codes: []int{200, 200},
+			want:  []string{`POST / cl="" body="hello"`, `GET /smuggled cl="" body=""`},
+		},
+		{
+			name:  "unsupported transfer-encoding",
+			raw:   "POST / HTTP/1.1\r\nHost: test\r\nContent-Length: 0\r\nTransfer-Encoding: xchunked\r\n\r\n0\r\n\r\n" + smuggled,
+			codes: []int{501},
+		},
+		{
+			name:  "multiple transfer-encodings",
+			raw:   "POST / HTTP/1.1\r\nHost: test\r\nTransfer-Encoding: gzip, chunked\r\n\r\n0\r\n\r\n" + smuggled,
+			codes: []int{501},
+		},
+		{
+			name:  "malformed chunk",
+			raw:   "POST / HTTP/1.1\r\nHost: test\r\nTransfer-Encoding: chunked\r\n\r\nzz\r\nhello\r\n0\r\n\r\n" + smuggled,
+			codes: []int{400},
+		},
+	}
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			worker := &framingWorker{}
+			ts := newTestStabilizer(t, Config{Workers: 1}, worker)
+			defer ts.close()
+
+			codes := ts.sendRaw(t, tst.raw)
+			if fmt.Sprint(codes) != fmt.Sprint(tst.codes) {
+				t.Errorf("got responses %v, want %v", codes, tst.codes)
+			}
+			if got := worker.received(); fmt.Sprint(got) != fmt.Sprint(tst.want) {
+				t.Errorf("worker received %q, want %q", got, tst.want)
+			}
+		})
+	}
+}
+
+func TestBodyTooLarge(t *testing.T) {
+	for _, tst := range []struct {
+		name string
+		body io.Reader
+	}{
+		// Rejected up front, by its Content-Length.
+		{"content-length", strings.NewReader(strings.Repeat("x", 100))},
+		// Rejected once the limit is exceeded while sending it to a worker.
+		{"chunked", ioutil.NopCloser(strings.NewReader(strings.Repeat("x", 100)))},
+	} {
+		t.Run(tst.name, func(t *testing.T) {
+			worker := &framingWorker{}
+			ts := newTestStabilizer(t, Config{Workers: 1, MaxBodyBytes: 10}, worker)
+			defer ts.close()
+
+			resp, err := http.Post(ts.srv.URL, "text/plain", tst.body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusRequestEntityTooLarge || !resp.Close {
+				t.Errorf("got status %v (close %v), want 413 and the connection closed", resp.StatusCode, resp.Close)
+			}
+			if got := resp.Header.Get("Content-Type"); got != "application/json" {
+				t.Errorf("got Content-Type %q, want application/json", got)
+			}
+			var got map[string]interface{}
+			if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+				t.Fatal(err)
+			}
+			want := map[string]interface{}{
+				"code":           "hss_body_too_large",
+				"error":          "request body exceeds the limit of 10 bytes",
+				"max_body_bytes": float64(10),
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got %v, want %v", got, want)
+			}
+			if got := worker.received(); len(got) != 0 {
+				t.Errorf("worker received %q", got)
+			}
+		})
+	}
+}
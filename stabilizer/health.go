@@ -0,0 +1,53 @@
+package stabilizer
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+)
+
+// Health states, as reported at HealthPath.
+const (
+	HealthHealthy   = "healthy"   // all workers are ready
+	HealthDegraded  = "degraded"  // some workers are not ready, but requests are still served
+	HealthUnhealthy = "unhealthy" // no workers are ready, or we are shutting down
+)
+
+// healthStates lists the health states, for metrics.
+var healthStates = []string{HealthHealthy, HealthDegraded, HealthUnhealthy}
+
+// Health returns the current health state of the stabilizer, along with the
+// number of workers which are ready.
+func (s *Stabilizer) Health() (state string, ready int) {
+	ready = s.Ready()
+	switch {
+	case atomic.LoadInt32(&s.shuttingDown) != 0 || ready == 0:
+		return HealthUnhealthy, ready
+	case ready < s.config.Workers:
+		return HealthDegraded, ready
+	}
+	return HealthHealthy, ready
+}
+
+// serveHealth serves the health state at HealthPath, responding with 503
+// Service Unavailable if unhealthy (or, for the strict variant, degraded).
+func (s *Stabilizer) serveHealth(rw http.ResponseWriter, r *http.Request) {
+	state, ready := s.Health()
+	status := http.StatusOK
+	strict := r.URL.Path == s.config.HealthPath+"/strict"
+	if state == HealthUnhealthy || strict && state == HealthDegraded {
+		status = http.StatusServiceUnavailable
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	_ = json.NewEncoder(rw).Encode(&map[string]interface{}{
+		"state":   state,
+		"ready":   ready,
+		"workers": s.config.Workers,
+	})
+}
+
+// isHealthPath reports whether path is served by serveHealth.
+func (s *Stabilizer) isHealthPath(path string) bool {
+	return s.config.HealthPath != "" && (path == s.config.HealthPath || path == s.config.HealthPath+"/strict")
+}
@@ -0,0 +1,65 @@
+package stabilizer
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// HostRouter routes requests to handlers (typically Stabilizers) by their
+// Host header, so that several apps, each with its own workers, can be served
+// from one listener.
+type HostRouter struct {
+	// Hosts maps lower-case host names, without a port, to the handler for
+	// requests to that host.
+	Hosts map[string]http.Handler
+
+	// Default, if not nil, handles requests to hosts not in Hosts. Otherwise
+	// they fail with UnmatchedStatus (default 404 Not Found) and the error
+	// code hss_unknown_host, or with UnmatchedBody if it is not nil.
+	Default         http.Handler
+	UnmatchedStatus int
+
+	// UnmatchedBody, if not nil, is the body of responses to requests to
+	// hosts not in Hosts, with the UnmatchedContentType (by default detected
+	// from the body).
+	UnmatchedBody        []byte
+	UnmatchedContentType string
+}
+
+func (h *HostRouter) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if name, _, err := net.SplitHostPort(host); err == nil {
+		host = name
+	}
+	if handler, ok := h.Hosts[strings.ToLower(host)]; ok {
+		handler.ServeHTTP(rw, r)
+		return
+	}
+	if h.Default != nil {
+		h.Default.ServeHTTP(rw, r)
+		return
+	}
+	status := h.UnmatchedStatus
+	if status == 0 {
+		status = http.StatusNotFound
+	}
+	if h.UnmatchedBody != nil {
+		contentType := h.UnmatchedContentType
+		if contentType == "" {
+			contentType = http.DetectContentType(h.UnmatchedBody)
+		}
+		rw.Header().Set("Content-Type", contentType)
+		rw.WriteHeader(status)
+		_, _ = rw.Write(h.UnmatchedBody)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	_ = json.NewEncoder(rw).Encode(&map[string]interface{}{
+		"error": fmt.Sprintf("unknown host %q", host),
+		"code":  "hss_unknown_host",
+	})
+}
@@ -0,0 +1,35 @@
+package stabilizer
+
+import (
+	"log"
+	"time"
+)
+
+// recycleIdleWorkers gracefully restarts workers which have not served a
+// request for MaxWorkerIdle, until the stabilizer is shut down. Only one worker
+// is recycled at a time, waiting for its replacement to become ready before
+// moving on, so that idle workers are never all recycled at once.
+func (s *Stabilizer) recycleIdleWorkers() {
+	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.ctx.Done():
+			return
+		}
+		w := s.pool.longestIdle(s.config.MaxWorkerIdle)
+		if w == nil {
+			continue
+		}
+		if err := s.pool.markDraining(w); err != nil {
+			continue
+		}
+		log.Printf("worker %v: recycling after being idle for %v", w.pid, s.config.MaxWorkerIdle)
+		s.drainWorker(w, reasonIdle, s.current().DrainWorkerTimeout)
+		<-w.done
+		if !s.pool.waitReplaced(w, s.config.ReadyTimeout) {
+			log.Printf("max-worker-idle: replacement worker not ready after %v", s.config.ReadyTimeout)
+		}
+	}
+}
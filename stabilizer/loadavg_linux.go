@@ -0,0 +1,24 @@
+//go:build linux
+// +build linux
+
+package stabilizer
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// readLoadAverage returns the 1-minute system load average.
+func readLoadAverage() (float64, error) {
+	data, err := ioutil.ReadFile("/proc/loadavg")
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("/proc/loadavg: unexpected format %q", data)
+	}
+	return strconv.ParseFloat(fields[0], 64)
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package stabilizer
+
+import "errors"
+
+// readLoadAverage returns the 1-minute system load average.
+func readLoadAverage() (float64, error) {
+	return 0, errors.New("reading the load average is only supported on Linux")
+}
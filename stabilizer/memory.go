@@ -0,0 +1,71 @@
+package stabilizer
+
+import (
+	"errors"
+	"log"
+	"time"
+)
+
+// checkCgroupMemory returns an error if the cgroup memory usage cannot be read
+// or has no limit, in which case MemoryHighWatermark cannot be used.
+func checkCgroupMemory() error {
+	_, limit, err := readCgroupMemory()
+	if err != nil {
+		return err
+	}
+	if limit == 0 {
+		return errors.New("cgroup has no memory limit")
+	}
+	return nil
+}
+
+// watchMemory checks the cgroup memory usage every second and, while it
+// exceeds MemoryHighWatermark of the limit, recycles the worker using the most
+// memory, until the stabilizer is shut down. It waits for each replacement to
+// become ready before checking again, so that at most one worker is recycled
+// at a time.
+func (s *Stabilizer) watchMemory() {
+	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.ctx.Done():
+			return
+		}
+		usage, limit, err := readCgroupMemory()
+		if err != nil {
+			log.Println("memory:", err)
+			continue
+		}
+		if limit == 0 || float64(usage)/float64(limit) < s.config.MemoryHighWatermark {
+			continue
+		}
+
+		var (
+			largest    *worker
+			largestRSS uint64
+		)
+		for _, w := range s.pool.alive() {
+			rss, err := readRSS(w.pid)
+			if err != nil {
+				continue
+			}
+			if rss > largestRSS {
+				largest, largestRSS = w, rss
+			}
+		}
+		if largest == nil {
+			continue
+		}
+		if err := s.pool.markDraining(largest); err != nil {
+			continue
+		}
+		log.Printf("worker %v: recycling due to memory usage (cgroup %v of %v bytes, worker RSS %v bytes)", largest.pid, usage, limit, largestRSS)
+		s.drainWorker(largest, reasonMemory, s.current().DrainWorkerTimeout)
+		<-largest.done
+		if !s.pool.waitReplaced(largest, s.config.ReadyTimeout) {
+			log.Printf("memory: replacement worker not ready after %v", s.config.ReadyTimeout)
+		}
+	}
+}
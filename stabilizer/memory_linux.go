@@ -0,0 +1,67 @@
+//go:build linux
+// +build linux
+
+package stabilizer
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// readCgroupMemory returns the memory usage and limit in bytes of the cgroup
+// we are running in, supporting both cgroup v2 and v1.
+func readCgroupMemory() (usage, limit uint64, err error) {
+	usagePath, limitPath := "/sys/fs/cgroup/memory.current", "/sys/fs/cgroup/memory.max"
+	if _, err := os.Stat(usagePath); err != nil {
+		usagePath, limitPath = "/sys/fs/cgroup/memory/memory.usage_in_bytes", "/sys/fs/cgroup/memory/memory.limit_in_bytes"
+	}
+	usage, err = readUintFile(usagePath)
+	if err != nil {
+		return 0, 0, err
+	}
+	limit, err = readUintFile(limitPath)
+	if err != nil {
+		return 0, 0, err
+	}
+	return usage, limit, nil
+}
+
+// readUintFile reads a file containing a single integer, or "max" meaning no
+// limit (reported as zero).
+func readUintFile(path string) (uint64, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	s := strings.TrimSpace(string(data))
+	if s == "max" {
+		return 0, nil
+	}
+	v, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%s: unexpected format %q", path, data)
+	}
+	return v, nil
+}
+
+// readRSS returns the resident set size in bytes of the process with the given
+// PID.
+func readRSS(pid int) (uint64, error) {
+	path := fmt.Sprintf("/proc/%d/statm", pid)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) < 2 {
+		return 0, fmt.Errorf("%s: unexpected format %q", path, data)
+	}
+	pages, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%s: unexpected format %q", path, data)
+	}
+	return pages * uint64(os.Getpagesize()), nil
+}
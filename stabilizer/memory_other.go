@@ -0,0 +1,20 @@
+//go:build !linux
+// +build !linux
+
+package stabilizer
+
+import "errors"
+
+var errMemoryUnsupported = errors.New("reading cgroup memory usage is only supported on Linux")
+
+// readCgroupMemory returns the memory usage and limit in bytes of the cgroup
+// we are running in.
+func readCgroupMemory() (usage, limit uint64, err error) {
+	return 0, 0, errMemoryUnsupported
+}
+
+// readRSS returns the resident set size in bytes of the process with the given
+// PID.
+func readRSS(pid int) (uint64, error) {
+	return 0, errMemoryUnsupported
+}
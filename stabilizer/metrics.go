@@ -0,0 +1,371 @@
+package stabilizer
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// subsystem is the Prometheus subsystem of all metrics, which are named e.g.
+// myapp_hss_worker_restarts where myapp is PrometheusAppName.
+const subsystem = "hss"
+
+// metrics are the Prometheus metrics exported by a Stabilizer.
+type metrics struct {
+	workerRestarts      *prometheus.CounterVec
+	workersSpawned      *prometheus.CounterVec
+	spawnFailures       *prometheus.CounterVec
+	workerLifetime      *prometheus.HistogramVec
+	drainDuration       *prometheus.HistogramVec
+	workerDialErrors    prometheus.Counter
+	workerDrains        prometheus.Counter
+	workerDrainKills    prometheus.Counter
+	loadShed            prometheus.Counter
+	shadowRequests      *prometheus.CounterVec
+	workerOutputDropped prometheus.Counter
+	retries             prometheus.Counter
+	queueWait           prometheus.Histogram
+	queueTimeouts       prometheus.Counter
+	clientRejections    prometheus.Counter
+	requestDeadlines    prometheus.Counter
+	responses           *prometheus.CounterVec
+	taggedRequests      *prometheus.CounterVec
+	workerFlaps         prometheus.Counter
+	workerBroken        prometheus.Counter
+	fallbackActivations prometheus.Counter
+	workerSpawn         *prometheus.HistogramVec
+	workerReady         *prometheus.HistogramVec
+	outcomesDropped     prometheus.Counter
+	proxyErrors         *prometheus.CounterVec
+	breakerOpens        prometheus.Counter
+	responsesTooLarge   prometheus.Counter
+	requestsTooLarge    prometheus.Counter
+	frontendConns       prometheus.Gauge
+	compressedResponses prometheus.Counter
+}
+
+// newMetrics creates and registers the metrics of s.
+func newMetrics(s *Stabilizer) *metrics {
+	appName := s.config.PrometheusAppName
+	reg := s.config.Registerer
+	m := &metrics{
+		workerRestarts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: appName,
+			Subsystem: subsystem,
+			Name:      "worker_restarts",
+			Help:      "The total number of worker process restarts, by reason",
+		}, []string{"reason"}),
+		workersSpawned: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: appName,
+			Subsystem: subsystem,
+			Name:      "workers_spawned",
+			Help:      "The total number of worker processes started, by pool (primary or shadow)",
+		}, []string{"pool"}),
+		spawnFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: appName,
+			Subsystem: subsystem,
+			Name:      "worker_spawn_failures",
+			Help:      "The total number of worker processes which could not be started, by pool (primary or shadow)",
+		}, []string{"pool"}),
+		workerLifetime: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: appName,
+			Subsystem: subsystem,
+			Name:      "worker_lifetime_seconds",
+			Help:      "How long workers were alive for before they died, by reason",
+			Buckets:   prometheus.ExponentialBuckets(1, 4, 10),
+		}, []string{"reason"}),
+		drainDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: appName,
+			Subsystem: subsystem,
+			Name:      "drain_seconds",
+			Help:      "How long draining took, from no longer accepting new requests until in-flight ones finished (or were abandoned), by reason (shutdown, or why a worker was drained)",
+			Buckets:   prometheus.ExponentialBuckets(0.01, 4, 10),
+		}, []string{"reason"}),
+		workerDialErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: appName,
+			Subsystem: subsystem,
+			Name:      "worker_dial_errors",
+			Help:      "The total number of requests that failed because the worker could not be connected to",
+		}),
+		workerDrains: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: appName,
+			Subsystem: subsystem,
+			Name:      "worker_drains",
+			Help:      "The total number of drained workers which finished their in-flight requests and were restarted",
+		}),
+		workerDrainKills: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: appName,
+			Subsystem: subsystem,
+			Name:      "worker_drain_kills",
+			Help:      "The total number of drained workers which were killed after the drain timeout elapsed",
+		}),
+		loadShed: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: appName,
+			Subsystem: subsystem,
+			Name:      "load_shed",
+			Help:      "The total number of requests rejected because the load average exceeded the maximum",
+		}),
+		shadowRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: appName,
+			Subsystem: subsystem,
+			Name:      "shadow_requests",
+			Help:      "The total number of requests selected to be mirrored to the shadow pool, by result (ok, error, dropped, skipped)",
+		}, []string{"result"}),
+		workerOutputDropped: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: appName,
+			Subsystem: subsystem,
+			Name:      "worker_output_dropped_lines",
+			Help:      "The total number of lines of worker output dropped because logging fell behind",
+		}),
+		retries: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: appName,
+			Subsystem: subsystem,
+			Name:      "retries",
+			Help:      "The total number of failed requests which were retried on another worker",
+		}),
+		queueWait: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: appName,
+			Subsystem: subsystem,
+			Name:      "queue_wait_seconds",
+			Help:      "How long requests waited for a worker to become available",
+			Buckets:   prometheus.ExponentialBuckets(0.001, 4, 10),
+		}),
+		requestDeadlines: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: appName,
+			Subsystem: subsystem,
+			Name:      "request_deadlines_exceeded",
+			Help:      "The total number of requests which failed because they exceeded the overall request deadline",
+		}),
+		clientRejections: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: appName,
+			Subsystem: subsystem,
+			Name:      "client_concurrency_rejections",
+			Help:      "The total number of requests rejected because their client had too many requests in flight",
+		}),
+		queueTimeouts: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: appName,
+			Subsystem: subsystem,
+			Name:      "queue_timeouts",
+			Help:      "The total number of requests which failed because no worker became available within the queue timeout",
+		}),
+		taggedRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: appName,
+			Subsystem: subsystem,
+			Name:      "tagged_requests",
+			Help:      "The total number of requests sent to tagged workers, by tag",
+		}, []string{"tag"}),
+		responses: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: appName,
+			Subsystem: subsystem,
+			Name:      "responses",
+			Help:      "The total number of responses to requests sent to workers, by status class (e.g. 2xx, 5xx)",
+		}, []string{"class"}),
+		workerFlaps: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: appName,
+			Subsystem: subsystem,
+			Name:      "worker_flaps",
+			Help:      "The total number of workers which died on their own before the minimum healthy uptime, and were restarted with backoff",
+		}),
+		workerBroken: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: appName,
+			Subsystem: subsystem,
+			Name:      "worker_broken",
+			Help:      "The total number of workers which were considered broken after repeatedly timing out shortly after starting without responding, see -broken-worker-timeouts",
+		}),
+		fallbackActivations: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: appName,
+			Subsystem: subsystem,
+			Name:      "fallback_activations",
+			Help:      "The total number of times a worker slot switched to the fallback command",
+		}),
+		workerSpawn: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: appName,
+			Subsystem: subsystem,
+			Name:      "worker_spawn_seconds",
+			Help:      "How long it took to start worker processes, by pool (primary or shadow)",
+			Buckets:   prometheus.ExponentialBuckets(0.001, 4, 10),
+		}, []string{"pool"}),
+		workerReady: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: appName,
+			Subsystem: subsystem,
+			Name:      "worker_ready_seconds",
+			Help:      "How long it took workers to become ready after being spawned, by pool (primary or shadow)",
+			Buckets:   prometheus.ExponentialBuckets(0.01, 3, 10),
+		}, []string{"pool"}),
+		outcomesDropped: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: appName,
+			Subsystem: subsystem,
+			Name:      "outcomes_dropped",
+			Help:      "The total number of request outcomes which were not reported because the outcome hook fell behind",
+		}),
+		proxyErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: appName,
+			Subsystem: subsystem,
+			Name:      "proxy_errors",
+			Help:      "The total number of failed attempts to proxy a request to a worker, by class of error (e.g. timeout, connection_refused)",
+		}, []string{"class"}),
+		breakerOpens: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: appName,
+			Subsystem: subsystem,
+			Name:      "breaker_opens",
+			Help:      "The total number of times a worker's circuit breaker opened, taking it out of rotation",
+		}),
+		compressedResponses: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: appName,
+			Subsystem: subsystem,
+			Name:      "compressed_responses",
+			Help:      "The total number of worker responses which were gzipped by the stabilizer",
+		}),
+		frontendConns: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: appName,
+			Subsystem: subsystem,
+			Name:      "frontend_connections",
+			Help:      "The number of currently open client connections, if tracked via ConnState",
+		}),
+		requestsTooLarge: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: appName,
+			Subsystem: subsystem,
+			Name:      "requests_too_large",
+			Help:      "The total number of requests rejected because their body was larger than -max-body-bytes",
+		}),
+		responsesTooLarge: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: appName,
+			Subsystem: subsystem,
+			Name:      "responses_too_large",
+			Help:      "The total number of worker responses larger than -max-response-bytes, which were rejected or truncated",
+		}),
+	}
+	reg.MustRegister(
+		m.workerRestarts,
+		m.workersSpawned,
+		m.spawnFailures,
+		m.workerLifetime,
+		m.drainDuration,
+		m.workerDialErrors,
+		m.workerDrains,
+		m.workerDrainKills,
+		m.loadShed,
+		m.shadowRequests,
+		m.workerOutputDropped,
+		m.retries,
+		m.queueWait,
+		m.queueTimeouts,
+		m.clientRejections,
+		m.requestDeadlines,
+		m.responses,
+		m.taggedRequests,
+		m.workerFlaps,
+		m.workerBroken,
+		m.fallbackActivations,
+		m.workerSpawn,
+		m.workerReady,
+		m.outcomesDropped,
+		m.proxyErrors,
+		m.breakerOpens,
+		m.responsesTooLarge,
+		m.requestsTooLarge,
+		m.frontendConns,
+		m.compressedResponses,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: appName,
+			Subsystem: subsystem,
+			Name:      "fallback_workers",
+			Help:      "The number of worker slots currently using the fallback command",
+		}, func() float64 {
+			return float64(atomic.LoadInt32(&s.fallbackSlots))
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: appName,
+			Subsystem: subsystem,
+			Name:      "queue_depth",
+			Help:      "The number of requests waiting for a worker to become available",
+		}, func() float64 {
+			return float64(s.pool.queued())
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: appName,
+			Subsystem: subsystem,
+			Name:      "queue_wait_max_seconds",
+			Help:      "The longest time any request has waited for a worker to become available",
+		}, func() float64 {
+			return time.Duration(atomic.LoadInt64(&s.maxQueueWait)).Seconds()
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: appName,
+			Subsystem: subsystem,
+			Name:      "pool_saturation",
+			Help:      "The ratio of in-flight requests to total capacity (workers * concurrency)",
+		}, func() float64 {
+			return s.pool.saturation(s.config.Workers)
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: appName,
+			Subsystem: subsystem,
+			Name:      "reserved_saturation",
+			Help:      "The ratio of in-flight requests to the capacity of the workers reserved for high-priority requests (zero if none are reserved)",
+		}, func() float64 {
+			return s.pool.reservedSaturation()
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: appName,
+			Subsystem: subsystem,
+			Name:      "overflow_workers",
+			Help:      "The number of overflow workers running, including those starting, see -max-overflow-workers",
+		}, func() float64 {
+			return float64(s.overflow.running())
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: appName,
+			Subsystem: subsystem,
+			Name:      "clients_inflight",
+			Help:      "The number of clients with requests in flight, if PerClientConcurrency is set",
+		}, func() float64 {
+			clients, _ := s.clients.stats()
+			return float64(clients)
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: appName,
+			Subsystem: subsystem,
+			Name:      "client_inflight_max",
+			Help:      "The most requests any one client has in flight, if PerClientConcurrency is set",
+		}, func() float64 {
+			_, max := s.clients.stats()
+			return float64(max)
+		}),
+	)
+	for _, state := range healthStates {
+		state := state
+		reg.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace:   appName,
+			Subsystem:   subsystem,
+			Name:        "health_state",
+			Help:        "1 for the current health state of the stabilizer (healthy, degraded or unhealthy), 0 for the others",
+			ConstLabels: prometheus.Labels{"state": state},
+		}, func() float64 {
+			if current, _ := s.Health(); current == state {
+				return 1
+			}
+			return 0
+		}))
+	}
+	if s.config.MaxLoadAvg > 0 {
+		reg.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: appName,
+			Subsystem: subsystem,
+			Name:      "load_average",
+			Help:      "The most recently sampled 1-minute system load average",
+		}, s.currentLoadAverage))
+	}
+	return m
+}
+
+// workerExited records metrics about a worker which has died.
+func (m *metrics) workerExited(w *worker) {
+	if w.started.IsZero() {
+		// The process never started.
+		return
+	}
+	m.workerRestarts.WithLabelValues(w.reason).Inc()
+	m.workerLifetime.WithLabelValues(w.reason).Observe(time.Since(w.started).Seconds())
+}
@@ -0,0 +1,78 @@
+package stabilizer
+
+import (
+	"net/http"
+	"time"
+)
+
+// Outcomes of requests sent to workers, see Outcome.
+const (
+	OutcomeOK        = "ok"         // the worker responded
+	OutcomeTimeout   = "timeout"    // the request timed out
+	OutcomeCanceled  = "canceled"   // the client went away before the worker responded
+	OutcomeDialError = "dial-error" // the worker could not be connected to
+	OutcomeError     = "error"      // the request to the worker failed otherwise
+)
+
+// Outcome describes a request which was sent to a worker, as passed to
+// OnOutcome.
+type Outcome struct {
+	Method    string
+	Path      string
+	Status    int           // the status code sent to the client
+	Duration  time.Duration // including time spent queued and retrying
+	WorkerPID int           // of the last worker the request was sent to
+	Outcome   string        // one of OutcomeOK, OutcomeTimeout, etc.
+}
+
+// outcomeKey is the context key of a request's *Outcome.
+type outcomeKey struct{}
+
+// outcomeQueueSize is the number of outcomes which may be waiting for
+// OnOutcome before further outcomes are dropped.
+const outcomeQueueSize = 1000
+
+// newOutcome returns the Outcome to record for r, if OnOutcome is set.
+func (s *Stabilizer) newOutcome(r *http.Request) *Outcome {
+	if s.outcomes == nil {
+		return nil
+	}
+	return &Outcome{Method: r.Method, Path: r.URL.Path}
+}
+
+// setOutcome records the outcome of a request to a worker, if it is being
+// recorded.
+func (s *Stabilizer) setOutcome(r *http.Request, outcome string, status int) {
+	if o, _ := r.Context().Value(outcomeKey{}).(*Outcome); o != nil {
+		o.Outcome = outcome
+		o.Status = status
+	}
+}
+
+// finishOutcome queues o to be passed to OnOutcome, without blocking. If
+// OnOutcome has fallen too far behind, o is dropped.
+func (s *Stabilizer) finishOutcome(o *Outcome, w *worker, start time.Time) {
+	if o == nil {
+		return
+	}
+	o.Duration = time.Since(start)
+	o.WorkerPID = w.pid
+	select {
+	case s.outcomes <- *o:
+	default:
+		s.metrics.outcomesDropped.Inc()
+	}
+}
+
+// reportOutcomes passes queued outcomes to OnOutcome until the stabilizer is
+// stopped.
+func (s *Stabilizer) reportOutcomes() {
+	for {
+		select {
+		case o := <-s.outcomes:
+			s.config.OnOutcome(o)
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package stabilizer
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"sync"
+)
+
+// maxLineLength is the length after which output without a newline is split
+// into multiple lines, so that a worker which never writes a newline cannot
+// consume unbounded memory.
+const maxLineLength = 64 * 1024
+
+// outputBuffer buffers the lines of a worker's stdout and stderr until they
+// are logged. Writes never block: if the buffer is full the oldest line is
+// dropped, so that a chatty worker can never be blocked by slow logging.
+//
+// The first few lines are also kept for the lifetime of the worker, so that
+// startup diagnostics can be inspected later via the admin API.
+type outputBuffer struct {
+	max     int    // maximum number of buffered lines
+	dropped func() // called for each dropped line
+	keep    int    // number of initial lines to keep
+
+	mu      sync.Mutex
+	lines   []string
+	partial []byte // output after the last newline
+	closed  bool
+	kept    []string      // the first keep lines
+	ready   chan struct{} // receives when lines are added or the buffer is closed
+}
+
+func newOutputBuffer(max int, dropped func(), keep int) *outputBuffer {
+	return &outputBuffer{
+		max:     max,
+		dropped: dropped,
+		keep:    keep,
+		ready:   make(chan struct{}, 1),
+	}
+}
+
+// Write implements io.Writer.
+func (b *outputBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return 0, io.ErrClosedPipe
+	}
+	b.partial = append(b.partial, p...)
+	for {
+		i := bytes.IndexByte(b.partial, '\n')
+		if i < 0 {
+			if len(b.partial) < maxLineLength {
+				break
+			}
+			i = maxLineLength - 1
+		}
+		b.pushLocked(string(b.partial[:i+1]))
+		b.partial = b.partial[i+1:]
+	}
+	return len(p), nil
+}
+
+// pushLocked adds a line, dropping the oldest one if the buffer is full. b.mu
+// must be held.
+func (b *outputBuffer) pushLocked(line string) {
+	if len(b.kept) < b.keep {
+		b.kept = append(b.kept, strings.TrimSuffix(line, "\n"))
+	}
+	if len(b.lines) >= b.max {
+		b.lines = b.lines[1:]
+		b.dropped()
+	}
+	b.lines = append(b.lines, line)
+	select {
+	case b.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Close flushes any incomplete last line. Later writes fail, and next reports
+// the end of the output once the remaining lines have been read.
+func (b *outputBuffer) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil
+	}
+	if len(b.partial) > 0 {
+		b.pushLocked(string(b.partial))
+		b.partial = nil
+	}
+	b.closed = true
+	select {
+	case b.ready <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// startup returns the kept initial lines of output, without trailing newlines.
+func (b *outputBuffer) startup() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]string(nil), b.kept...)
+}
+
+// next blocks until a line is available and returns it, or returns false if
+// the buffer has been closed and all lines have been read.
+func (b *outputBuffer) next() (string, bool) {
+	for {
+		b.mu.Lock()
+		if len(b.lines) > 0 {
+			line := b.lines[0]
+			b.lines = b.lines[1:]
+			b.mu.Unlock()
+			return line, true
+		}
+		closed := b.closed
+		b.mu.Unlock()
+		if closed {
+			return "", false
+		}
+		<-b.ready
+	}
+}
@@ -0,0 +1,95 @@
+package stabilizer
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestOutputBufferDropsOldest(t *testing.T) {
+	var dropped int32
+	b := newOutputBuffer(10, func() { atomic.AddInt32(&dropped, 1) }, 2)
+	for i := 0; i < 100; i++ {
+		fmt.Fprintf(b, "line %d\n", i)
+	}
+	fmt.Fprint(b, "partial")
+	b.Close()
+
+	var got []string
+	for {
+		line, ok := b.next()
+		if !ok {
+			break
+		}
+		got = append(got, line)
+	}
+	if len(got) != 10 {
+		t.Fatalf("got %d lines, want 10: %q", len(got), got)
+	}
+	if got[0] != "line 91\n" || got[9] != "partial" {
+		t.Errorf("got lines %q..%q, want the newest", got[0], got[9])
+	}
+	if d := atomic.LoadInt32(&dropped); d != 91 {
+		t.Errorf("dropped %d lines, want 91", d)
+	}
+	if startup := b.startup(); strings.Join(startup, ",") != "line 0,line 1" {
+		t.Errorf("startup() = %q", startup)
+	}
+	if _, err := b.Write([]byte("late\n")); err == nil {
+		t.Error("write after close: expected error")
+	}
+}
+
+// TestOutputBufferSlowReader checks that a writer which is much faster than
+// the reader is never blocked, and that the reader sees lines in order.
+func TestOutputBufferSlowReader(t *testing.T) {
+	const lines = 10000
+	var dropped int32
+	b := newOutputBuffer(16, func() { atomic.AddInt32(&dropped, 1) }, 0)
+
+	var (
+		wg  sync.WaitGroup
+		got []string
+	)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			line, ok := b.next()
+			if !ok {
+				return
+			}
+			got = append(got, line)
+			time.Sleep(10 * time.Microsecond)
+		}
+	}()
+
+	start := time.Now()
+	for i := 0; i < lines; i++ {
+		fmt.Fprintf(b, "%d\n", i)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("writes took %v, expected them never to block on the reader", d)
+	}
+	b.Close()
+	wg.Wait()
+
+	if len(got)+int(atomic.LoadInt32(&dropped)) != lines {
+		t.Errorf("read %d + dropped %d lines, want %d in total", len(got), dropped, lines)
+	}
+	if got[len(got)-1] != fmt.Sprintf("%d\n", lines-1) {
+		t.Errorf("last line = %q, want the last line written", got[len(got)-1])
+	}
+	last := -1
+	for _, line := range got {
+		var n int
+		fmt.Sscanf(line, "%d", &n)
+		if n <= last {
+			t.Fatalf("line %d read after line %d", n, last)
+		}
+		last = n
+	}
+}
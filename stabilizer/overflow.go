@@ -0,0 +1,137 @@
+package stabilizer
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// overflowWorkers tracks the temporary workers started beyond Workers, see
+// MaxOverflowWorkers.
+type overflowWorkers struct {
+	mu       sync.Mutex
+	inUse    []bool // by worker index minus Workers
+	starting int    // spawned but not yet ready
+}
+
+// running returns the number of overflow workers, including those starting.
+func (o *overflowWorkers) running() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	var n int
+	for _, inUse := range o.inUse {
+		if inUse {
+			n++
+		}
+	}
+	return n
+}
+
+// spawnOverflow starts an overflow worker, if fewer than MaxOverflowWorkers
+// are running and those already starting can't absorb the queued requests. It
+// is called once a request has waited OverflowAfter for a worker.
+func (s *Stabilizer) spawnOverflow() {
+	if s.ctx.Err() != nil || atomic.LoadInt32(&s.shuttingDown) != 0 {
+		return
+	}
+	if ready, _ := s.pool.ready(); ready == 0 {
+		// The pool is down rather than busy, which more workers won't fix.
+		return
+	}
+	o := &s.overflow
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.starting*s.current().Concurrency >= s.pool.queued() {
+		return
+	}
+	if o.inUse == nil {
+		o.inUse = make([]bool, s.config.MaxOverflowWorkers)
+	}
+	for i, inUse := range o.inUse {
+		if !inUse {
+			o.inUse[i] = true
+			o.starting++
+			s.wg.Add(1)
+			go s.runOverflow(s.config.Workers + i)
+			return
+		}
+	}
+}
+
+// runOverflow runs an overflow worker with the given index until it has been
+// idle for OverflowIdle. Unlike other workers, it is not restarted if it dies.
+func (s *Stabilizer) runOverflow(index int) {
+	defer s.wg.Done()
+	o := &s.overflow
+	ready := false
+	defer func() {
+		o.mu.Lock()
+		defer o.mu.Unlock()
+		o.inUse[index-s.config.Workers] = false
+		if !ready {
+			o.starting--
+		}
+	}()
+
+	port, err := getFreePort()
+	if err != nil {
+		log.Println("failed to find free port")
+		return
+	}
+	spawned := time.Now()
+	w := s.spawn(s.ctx, index, port, false)
+	if !w.started.IsZero() {
+		s.metrics.workersSpawned.WithLabelValues(s.poolName).Inc()
+		s.metrics.workerSpawn.WithLabelValues(s.poolName).Observe(time.Since(spawned).Seconds())
+	} else {
+		s.metrics.spawnFailures.WithLabelValues(s.poolName).Inc()
+	}
+	w.index = index
+	w.concurrency = s.current().Concurrency
+	w.overflow = true
+	log.Printf("worker %v: overflow worker started on port %v", w.pid, w.port)
+	if err := s.waitReady(w); err != nil {
+		log.Printf("worker %v: %v", w.pid, err)
+		s.pool.recordError(index, err.Error())
+		w.kill(reasonUnready)
+		<-w.done
+	} else {
+		s.metrics.workerReady.WithLabelValues(s.poolName).Observe(time.Since(spawned).Seconds())
+		s.pool.add(w)
+		o.mu.Lock()
+		o.starting--
+		ready = true
+		o.mu.Unlock()
+		if s.config.HealthCheckInterval > 0 {
+			go s.healthCheck(w)
+		}
+		s.reapWhenIdle(w)
+		<-w.done
+		s.pool.remove(w)
+	}
+	s.workerExited(w)
+}
+
+// reapWhenIdle drains the overflow worker w once it has been idle for
+// OverflowIdle, returning once it is draining or has died.
+func (s *Stabilizer) reapWhenIdle(w *worker) {
+	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-w.done:
+			return
+		}
+		if s.pool.idleFor(w) < s.config.OverflowIdle {
+			continue
+		}
+		if err := s.pool.markDraining(w); err != nil {
+			continue
+		}
+		log.Printf("worker %v: stopping overflow worker after being idle for %v", w.pid, s.config.OverflowIdle)
+		s.drainWorker(w, reasonOverflow, s.current().DrainWorkerTimeout)
+		return
+	}
+}
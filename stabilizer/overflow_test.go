@@ -0,0 +1,63 @@
+package stabilizer
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestOverflowWorker checks that an overflow worker is started for queued
+// requests, and that once idle it is stopped like any other worker, running
+// PostStopCommand.
+func TestOverflowWorker(t *testing.T) {
+	dir, err := ioutil.TempDir("", "overflow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	stopped := filepath.Join(dir, "stopped")
+
+	release := make(chan struct{})
+	ts := newTestStabilizer(t, Config{
+		Workers:            1,
+		Concurrency:        1,
+		MaxOverflowWorkers: 1,
+		OverflowAfter:      50 * time.Millisecond,
+		OverflowIdle:       100 * time.Millisecond,
+		PostStopCommand:    "sh",
+		PostStopArgs:       []string{"-c", "echo {{.Index}} {{.Reason}} >> " + stopped},
+	}, http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			<-release
+		}
+		rw.Write([]byte("ok"))
+	}))
+	defer ts.close()
+	defer close(release)
+
+	go getBody(ts.srv.URL + "/slow")
+	waitFor(t, func() bool { n, _ := ts.pool.inflight(); return n == 1 })
+
+	// The only regular worker is busy, so this is served by an overflow
+	// worker.
+	if resp, body := ts.get(t, "/"); resp.StatusCode != http.StatusOK || body != "ok" {
+		t.Fatalf("got %v %q, want 200 ok", resp.StatusCode, body)
+	}
+	if n := ts.overflow.running(); n != 1 {
+		t.Fatalf("%d overflow workers running, want 1", n)
+	}
+
+	// Once idle, it is stopped.
+	waitFor(t, func() bool { return ts.overflow.running() == 0 })
+	waitFor(t, func() bool {
+		out, _ := ioutil.ReadFile(stopped)
+		return strings.TrimSpace(string(out)) == "1 "+reasonOverflow
+	})
+	if n := len(ts.pool.alive()); n != 1 {
+		t.Errorf("%d workers alive, want 1", n)
+	}
+}
@@ -0,0 +1,67 @@
+package stabilizer
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// pathMatcher matches request paths against a list of path prefixes and
+// regular expressions.
+type pathMatcher struct {
+	prefixes []string
+	patterns []*regexp.Regexp
+}
+
+// newPathMatcher returns a pathMatcher for the given paths. Paths beginning
+// with ^ are regular expressions, and all others are prefixes. It returns nil
+// if paths is empty.
+func newPathMatcher(paths []string) (*pathMatcher, error) {
+	if len(paths) == 0 {
+		return nil, nil
+	}
+	m := &pathMatcher{}
+	for _, path := range paths {
+		if !strings.HasPrefix(path, "^") {
+			m.prefixes = append(m.prefixes, path)
+			continue
+		}
+		re, err := regexp.Compile(path)
+		if err != nil {
+			return nil, err
+		}
+		m.patterns = append(m.patterns, re)
+	}
+	return m, nil
+}
+
+func (m *pathMatcher) match(path string) bool {
+	for _, prefix := range m.prefixes {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	for _, re := range m.patterns {
+		if re.MatchString(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPath writes an error response and returns false if r's path is denied
+// by DenyPaths (403) or not allowed by AllowPaths (404). DenyPaths takes
+// precedence, so a path matching both is denied.
+func (s *Stabilizer) checkPath(rw http.ResponseWriter, r *http.Request) bool {
+	path := r.URL.Path
+	if s.denyPaths != nil && s.denyPaths.match(path) {
+		s.writeError(rw, r, http.StatusForbidden, "hss_path_denied", fmt.Sprintf("path %q is denied", path))
+		return false
+	}
+	if s.allowPaths != nil && !s.allowPaths.match(path) {
+		s.writeError(rw, r, http.StatusNotFound, "hss_path_not_allowed", fmt.Sprintf("path %q is not allowed", path))
+		return false
+	}
+	return true
+}
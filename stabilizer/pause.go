@@ -0,0 +1,36 @@
+package stabilizer
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sync/atomic"
+)
+
+// Pause stops proxying new requests, which instead fail with a 503 (error code
+// hss_paused) and a Retry-After header of PauseRetryAfter, while keeping the
+// workers running. In-flight and already queued requests are unaffected.
+func (s *Stabilizer) Pause() {
+	if atomic.SwapInt32(&s.paused, 1) == 0 {
+		log.Println("paused: rejecting new requests")
+	}
+}
+
+// Resume resumes proxying requests after Pause.
+func (s *Stabilizer) Resume() {
+	if atomic.SwapInt32(&s.paused, 0) == 1 {
+		log.Println("resumed")
+	}
+}
+
+// Paused reports whether the stabilizer is paused.
+func (s *Stabilizer) Paused() bool {
+	return atomic.LoadInt32(&s.paused) != 0
+}
+
+// writePaused responds to a request received while paused.
+func (s *Stabilizer) writePaused(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("Retry-After", fmt.Sprint(int(math.Ceil(s.current().PauseRetryAfter.Seconds()))))
+	s.writeError(rw, r, http.StatusServiceUnavailable, "hss_paused", "paused for maintenance")
+}
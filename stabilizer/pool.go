@@ -0,0 +1,764 @@
+package stabilizer
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// pool tracks the alive workers and how many requests each one is currently
+// serving, and hands out workers to requests according to the balancer.
+type pool struct {
+	balancer    string
+	concurrency int
+
+	mu      sync.Mutex
+	workers []*worker
+	weights []float64 // by worker index
+	next    int       // round-robin cursor
+
+	candidates []*worker // scratch space for pickLocked
+
+	// spare is the number of unused concurrency slots of workers in the
+	// pool. Since it doesn't account for workers being unavailable for other
+	// reasons, it is only an upper bound on how many requests could acquire
+	// a worker right now, but saves looking through all workers when none
+	// is available.
+	spare int
+
+	// Requests waiting in acquire, in the order they arrived. If fifo is
+	// set, those which don't skip the queue (see acquire) are instead
+	// queued in queue, and only the one at the front may acquire a worker.
+	waiters *list.List
+	fifo    bool
+	queue   *list.List
+
+	// Workers with an index below reserved are only handed out to
+	// high-priority requests, see Config.ReservedWorkers.
+	reserved int
+
+	tags []string // by worker index, see Config.WorkerTags
+
+	// lastErrors records the last error of each worker index, which unlike
+	// the worker itself outlives restarts, see recordError.
+	lastErrors map[int]workerError
+
+	// changed is closed (and replaced) whenever a worker's state changes,
+	// if observed is set, i.e. anyone may be waiting for it to be closed
+	// (see ready, inflight, idle and waitReplaced). Requests waiting in
+	// acquire are instead woken up individually, see wakeLocked.
+	changed  chan struct{}
+	observed bool
+}
+
+// waiter is a request waiting in acquire.
+type waiter struct {
+	d         demand
+	skipQueue bool
+	elem      *list.Element // in p.waiters or p.queue
+
+	// ready receives a value when the waiter is woken up, for wokenFor if
+	// not nil, at which point woken is set.
+	ready    chan struct{}
+	woken    bool
+	wokenFor *worker
+}
+
+func newPool(balancer string, concurrency int, weights []float64, fifo bool, reserved int, tags []string) (*pool, error) {
+	switch balancer {
+	case BalancerRoundRobin, BalancerWeightedRandom:
+	default:
+		return nil, fmt.Errorf("unknown balancer %q", balancer)
+	}
+	return &pool{
+		balancer:    balancer,
+		concurrency: concurrency,
+		weights:     weights,
+		waiters:     list.New(),
+		fifo:        fifo,
+		queue:       list.New(),
+		reserved:    reserved,
+		tags:        tags,
+		changed:     make(chan struct{}),
+	}, nil
+}
+
+// broadcastLocked closes p.changed, if anyone may be waiting for it. p.mu
+// must be held.
+func (p *pool) broadcastLocked() {
+	if p.observed {
+		close(p.changed)
+		p.changed = make(chan struct{})
+		p.observed = false
+	}
+}
+
+// changedLocked returns p.changed, marking it as observed. p.mu must be held.
+func (p *pool) changedLocked() <-chan struct{} {
+	p.observed = true
+	return p.changed
+}
+
+// wakeLocked wakes up to n requests waiting in acquire which w could be
+// handed out to, in the order they arrived, rather than waking all of them to
+// race for one worker. It is called whenever slots of w may have become
+// available. A woken request which ends up not acquiring w passes the wakeup
+// on, see leaveLocked. p.mu must be held.
+func (p *pool) wakeLocked(w *worker, n int) {
+	if n <= 0 || p.waiters.Len() == 0 && p.queue.Len() == 0 {
+		return
+	}
+	if p.balancer == BalancerWeightedRandom && p.weights[w.index] == 0 {
+		return
+	}
+	now := time.Now()
+	for e := p.waiters.Front(); e != nil && n > 0; e = e.Next() {
+		if wt := e.Value.(*waiter); !wt.woken && p.eligible(w, wt.d, wt.d.priority, now) {
+			wt.wake(w)
+			n--
+		}
+	}
+	if e := p.queue.Front(); e != nil && n > 0 {
+		if wt := e.Value.(*waiter); !wt.woken && p.eligible(w, wt.d, false, now) {
+			wt.wake(w)
+		}
+	}
+}
+
+// wake wakes up wt, which must not already be woken, for w. p.mu must be held.
+func (wt *waiter) wake(w *worker) {
+	wt.woken, wt.wokenFor = true, w
+	wt.ready <- struct{}{}
+}
+
+// wakeWorkerLocked wakes up requests waiting in acquire for each available
+// slot of w. p.mu must be held.
+func (p *pool) wakeWorkerLocked(w *worker) {
+	if p.available(w, time.Now()) {
+		p.wakeLocked(w, w.concurrency-w.inflight)
+	}
+}
+
+// add adds a newly started worker to the pool.
+func (p *pool) add(w *worker) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	w.lastUsed = time.Now()
+	w.pooled = true
+	p.workers = append(p.workers, w)
+	p.spare += w.concurrency - w.inflight
+	p.broadcastLocked()
+	p.wakeWorkerLocked(w)
+}
+
+// remove removes a dead worker from the pool. It is called as soon as the
+// worker exits, and available already skips it once its context is canceled,
+// so requests never wait on dead workers: there are no per-slot entries for
+// acquire to discard, only one entry per alive worker.
+func (p *pool) remove(w *worker) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, other := range p.workers {
+		if other == w {
+			p.workers = append(p.workers[:i], p.workers[i+1:]...)
+			w.pooled = false
+			p.spare -= w.concurrency - w.inflight
+			break
+		}
+	}
+}
+
+// available reports whether w can accept another request at time now. p.mu
+// must be held.
+func (p *pool) available(w *worker, now time.Time) bool {
+	return !w.draining && w.inflight < w.concurrency && !now.Before(w.breakerOpenUntil) && w.ctx.Err() == nil
+}
+
+// demand describes which workers may be handed out to a request.
+type demand struct {
+	priority bool    // reserved workers may be handed out, see Config.ReservedWorkers
+	tag      string  // if not empty, only workers with this tag, see Config.WorkerTags
+	avoidTag bool    // the tag is instead one which workers must not have
+	avoid    *worker // if not nil, handed out only if no other worker is available
+}
+
+// tag returns the tag of w, if any.
+func (p *pool) tag(w *worker) string {
+	if w.index < len(p.tags) {
+		return p.tags[w.index]
+	}
+	return ""
+}
+
+// eligible reports whether w is available at time now and may be handed out
+// for d, which for reserved workers is only if allowReserved is set. p.mu must
+// be held.
+func (p *pool) eligible(w *worker, d demand, allowReserved bool, now time.Time) bool {
+	if d.tag != "" && (p.tag(w) == d.tag) == d.avoidTag {
+		return false
+	}
+	return (allowReserved || w.index >= p.reserved) && p.available(w, now)
+}
+
+// pickLockedFor selects an available worker for a request, preferring
+// unreserved workers so that reserved ones are kept free for other
+// high-priority requests, and any other worker over d.avoid. p.mu must be
+// held.
+func (p *pool) pickLockedFor(d demand) *worker {
+	w := p.pickLocked(d, false)
+	if w == nil && d.priority {
+		w = p.pickLocked(d, true)
+	}
+	if w == nil && d.avoid != nil {
+		d.avoid = nil
+		return p.pickLockedFor(d)
+	}
+	return w
+}
+
+// pickLocked selects a worker eligible for d according to the balancer, other
+// than d.avoid, or returns nil if none is available. Reserved workers are only
+// considered if allowReserved is set. p.mu must be held.
+func (p *pool) pickLocked(d demand, allowReserved bool) *worker {
+	if p.spare == 0 {
+		return nil
+	}
+	// Read the clock once, rather than for each worker, which adds up with
+	// hundreds of workers.
+	now := time.Now()
+	switch p.balancer {
+	case BalancerWeightedRandom:
+		// Check each worker's eligibility only once, collecting the
+		// eligible ones to pick from in p.candidates.
+		candidates := p.candidates[:0]
+		var total float64
+		for _, w := range p.workers {
+			if weight := p.weights[w.index]; weight > 0 && w != d.avoid && p.eligible(w, d, allowReserved, now) {
+				candidates = append(candidates, w)
+				total += weight
+			}
+		}
+		defer func() {
+			// Don't keep dead workers reachable.
+			for i := range candidates {
+				candidates[i] = nil
+			}
+			p.candidates = candidates[:0]
+		}()
+		if total == 0 {
+			return nil
+		}
+		r := rand.Float64() * total
+		for _, w := range candidates {
+			r -= p.weights[w.index]
+			if r < 0 {
+				return w
+			}
+		}
+		return candidates[len(candidates)-1] // floating point rounding
+	default:
+		n := len(p.workers)
+		for i := 0; i < n; i++ {
+			j := (p.next + i) % n
+			if w := p.workers[j]; w != d.avoid && p.eligible(w, d, allowReserved, now) {
+				p.next = j + 1
+				return w
+			}
+		}
+		return nil
+	}
+}
+
+// acquire blocks until a worker is available and reserves one of its
+// concurrency slots for the caller, or returns ctx's error if it is canceled
+// first. If p.fifo is set, callers acquire workers strictly in the order they
+// started waiting, except for high-priority or tagged ones (see demand), which
+// skip the queue since they may not be handed out the same workers. It also
+// returns the worker's number of in-flight requests when it was selected, not
+// counting the caller's.
+func (p *pool) acquire(ctx context.Context, d demand) (*worker, int, error) {
+	wt := &waiter{d: d, skipQueue: d.priority || d.tag != ""}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for {
+		if wt.skipQueue || p.turnLocked(wt.elem) {
+			w := p.pickWokenLocked(wt)
+			if w == nil {
+				w = p.pickLockedFor(d)
+			}
+			if w != nil {
+				p.leaveLocked(wt, w)
+				p.takeLocked(w)
+				return w, w.inflight - 1, nil
+			}
+		}
+		switch {
+		case wt.elem == nil:
+			wt.ready = make(chan struct{}, 1)
+			if p.fifo && !wt.skipQueue {
+				wt.elem = p.queue.PushBack(wt)
+			} else {
+				wt.elem = p.waiters.PushBack(wt)
+			}
+		case wt.woken:
+			// The worker we were woken up for was taken by a request
+			// which didn't have to wait, or is no longer eligible.
+			prev := wt.wokenFor
+			wt.woken, wt.wokenFor = false, nil
+			p.passOnLocked(prev)
+		}
+		p.mu.Unlock()
+		select {
+		case <-wt.ready:
+		case <-ctx.Done():
+		}
+		p.mu.Lock()
+		if err := ctx.Err(); err != nil {
+			p.leaveLocked(wt, nil)
+			return nil, 0, err
+		}
+	}
+}
+
+// pickWokenLocked returns the worker wt was woken up for, if it may still be
+// handed out to wt, which saves looking through all workers for the one which
+// became available. Reserved workers and the worker wt avoids are left to
+// pickLockedFor, which prefers others. p.mu must be held.
+func (p *pool) pickWokenLocked(wt *waiter) *worker {
+	w := wt.wokenFor
+	if w == nil || w == wt.d.avoid || p.balancer == BalancerWeightedRandom && p.weights[w.index] == 0 {
+		return nil
+	}
+	if !p.eligible(w, wt.d, false, time.Now()) {
+		return nil
+	}
+	return w
+}
+
+// takeLocked reserves one of w's concurrency slots. p.mu must be held.
+func (p *pool) takeLocked(w *worker) {
+	w.inflight++
+	if w.pooled {
+		p.spare--
+	}
+}
+
+// leaveLocked removes wt from the requests waiting in acquire, once it has
+// acquired got (nil if it gave up). If it was woken up for another worker, the
+// wakeup is passed on to the next request waiting for that worker, and if it
+// was at the front of p.queue, the next request in line is woken up to try.
+// p.mu must be held.
+func (p *pool) leaveLocked(wt *waiter, got *worker) {
+	if wt.elem == nil {
+		return // never waited
+	}
+	if p.fifo && !wt.skipQueue {
+		front := p.queue.Front() == wt.elem
+		p.queue.Remove(wt.elem)
+		if e := p.queue.Front(); front && e != nil {
+			if next := e.Value.(*waiter); !next.woken {
+				next.wake(nil)
+			}
+		}
+	} else {
+		p.waiters.Remove(wt.elem)
+	}
+	if wt.wokenFor != got {
+		p.passOnLocked(wt.wokenFor)
+	}
+}
+
+// passOnLocked passes on a wakeup for w (which may be nil) which the woken
+// request didn't use. p.mu must be held.
+func (p *pool) passOnLocked(w *worker) {
+	if w != nil && p.available(w, time.Now()) {
+		p.wakeLocked(w, 1)
+	}
+}
+
+// turnLocked reports whether the request at elem in p.queue (nil if it is not
+// queued) may acquire a worker. p.mu must be held.
+func (p *pool) turnLocked(elem *list.Element) bool {
+	if !p.fifo {
+		return true
+	}
+	if elem == nil {
+		return p.queue.Len() == 0
+	}
+	return p.queue.Front() == elem
+}
+
+// queued returns the number of requests waiting in acquire.
+func (p *pool) queued() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.waiters.Len() + p.queue.Len()
+}
+
+// tryAcquire is like acquire, but returns nil rather than waiting if no worker
+// is available (or, if p.fifo is set, other requests are waiting).
+func (p *pool) tryAcquire() *worker {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.turnLocked(nil) {
+		return nil
+	}
+	w := p.pickLocked(demand{}, false)
+	if w != nil {
+		p.takeLocked(w)
+	}
+	return w
+}
+
+// release returns a concurrency slot acquired for w.
+func (p *pool) release(w *worker) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	w.inflight--
+	if w.pooled {
+		p.spare++
+	}
+	w.lastUsed = time.Now()
+	p.broadcastLocked()
+	if p.available(w, w.lastUsed) {
+		p.wakeLocked(w, 1)
+	}
+}
+
+// validWeight reports whether weight may be given to a worker: NaN and
+// infinite weights would break the weighted-random balancer.
+func validWeight(weight float64) bool {
+	return !math.IsNaN(weight) && !math.IsInf(weight, 0) && weight >= 0
+}
+
+// setWeight changes the weight of the worker with the given index.
+func (p *pool) setWeight(index int, weight float64) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if index < 0 || index >= len(p.weights) {
+		return fmt.Errorf("no worker with index %d", index)
+	}
+	if !validWeight(weight) {
+		return fmt.Errorf("invalid weight %v", weight)
+	}
+	p.weights[index] = weight
+	p.broadcastLocked()
+	for _, w := range p.workers {
+		if w.index == index {
+			p.wakeWorkerLocked(w)
+		}
+	}
+	return nil
+}
+
+// setBalancer changes the balancer.
+func (p *pool) setBalancer(balancer string) error {
+	switch balancer {
+	case BalancerRoundRobin, BalancerWeightedRandom:
+	default:
+		return fmt.Errorf("unknown balancer %q", balancer)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.balancer = balancer
+	// Workers with a weight of zero may now be handed out.
+	for _, w := range p.workers {
+		p.wakeWorkerLocked(w)
+	}
+	return nil
+}
+
+// setConcurrency changes the concurrency assumed for workers not in the pool,
+// see saturation. Workers in the pool keep the concurrency they were started
+// with.
+func (p *pool) setConcurrency(concurrency int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.concurrency = concurrency
+}
+
+// drain stops new requests from being sent to the alive worker with the given
+// index, and returns it.
+func (p *pool) drain(index int) (*worker, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, w := range p.workers {
+		if w.index == index && w.ctx.Err() == nil {
+			return w, p.drainLocked(w)
+		}
+	}
+	return nil, fmt.Errorf("no alive worker with index %d", index)
+}
+
+// longestIdle returns the alive worker which has been idle the longest, if it
+// has been idle for at least d. Overflow workers are not considered, since
+// they are stopped rather than recycled when idle.
+func (p *pool) longestIdle(d time.Duration) *worker {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var idlest *worker
+	for _, w := range p.workers {
+		if w.overflow || w.ctx.Err() != nil || w.draining || w.inflight > 0 || time.Since(w.lastUsed) < d {
+			continue
+		}
+		if idlest == nil || w.lastUsed.Before(idlest.lastUsed) {
+			idlest = w
+		}
+	}
+	return idlest
+}
+
+// idleFor returns how long w has had no in-flight requests, or 0 if it has
+// some.
+func (p *pool) idleFor(w *worker) time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if w.inflight > 0 {
+		return 0
+	}
+	return time.Since(w.lastUsed)
+}
+
+// workerError is an error of a worker, for status.
+type workerError struct {
+	err  string
+	time time.Time
+}
+
+// recordError records err as the last error of the worker with the given
+// index, e.g. why it died or failed to become ready.
+func (p *pool) recordError(index int, err string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.lastErrors == nil {
+		p.lastErrors = make(map[int]workerError)
+	}
+	p.lastErrors[index] = workerError{err: err, time: time.Now()}
+}
+
+// recordHealthCheck records the result of a health check of w, and the number
+// of consecutive failed health checks, for status.
+func (p *pool) recordHealthCheck(w *worker, err error, failures int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	w.lastHealthCheck = time.Now()
+	w.lastHealthCheckErr = err
+	w.healthCheckFailures = failures
+}
+
+// lookup returns the alive worker with the given index.
+func (p *pool) lookup(index int) (*worker, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, w := range p.workers {
+		if w.index == index && w.ctx.Err() == nil {
+			return w, nil
+		}
+	}
+	return nil, fmt.Errorf("no alive worker with index %d", index)
+}
+
+// drainLocked stops new requests from being sent to w. p.mu must be held.
+func (p *pool) drainLocked(w *worker) error {
+	if w.draining {
+		return fmt.Errorf("worker %v: already draining", w.pid)
+	}
+	w.draining = true
+	return nil
+}
+
+// markDraining stops new requests from being sent to w.
+func (p *pool) markDraining(w *worker) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.drainLocked(w)
+}
+
+// alive returns a snapshot of the alive workers.
+func (p *pool) alive() []*worker {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var v []*worker
+	for _, w := range p.workers {
+		if w.ctx.Err() == nil {
+			v = append(v, w)
+		}
+	}
+	return v
+}
+
+// waitReplaced waits for a worker with the same index as old to be added to
+// the pool, returning false if that does not happen within timeout.
+func (p *pool) waitReplaced(old *worker, timeout time.Duration) bool {
+	deadline := time.After(timeout)
+	for {
+		p.mu.Lock()
+		for _, w := range p.workers {
+			if w != old && w.index == old.index && w.ctx.Err() == nil {
+				p.mu.Unlock()
+				return true
+			}
+		}
+		changed := p.changedLocked()
+		p.mu.Unlock()
+		select {
+		case <-changed:
+		case <-deadline:
+			return false
+		}
+	}
+}
+
+// idle reports whether w has no in-flight requests, along with a channel that
+// is closed when that may have changed.
+func (p *pool) idle(w *worker) (bool, <-chan struct{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return w.inflight == 0, p.changedLocked()
+}
+
+// ready returns the number of workers ready to serve requests, along with a
+// channel that is closed when that number may have changed.
+func (p *pool) ready() (int, <-chan struct{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var n int
+	for _, w := range p.workers {
+		if w.ctx.Err() == nil {
+			n++
+		}
+	}
+	return n, p.changedLocked()
+}
+
+// inflight returns the total number of in-flight requests, along with a
+// channel that is closed when that number may have changed.
+func (p *pool) inflight() (int, <-chan struct{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var n int
+	for _, w := range p.workers {
+		n += w.inflight
+	}
+	return n, p.changedLocked()
+}
+
+// saturation returns the ratio of in-flight requests to the capacity of n
+// workers. Workers not in the pool are assumed to have the default
+// concurrency. It may briefly exceed 1.0 while a dead worker's requests are
+// still finishing after its replacement has started.
+func (p *pool) saturation(n int) float64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var inflight, capacity int
+	for _, w := range p.workers {
+		inflight += w.inflight
+		capacity += w.concurrency
+	}
+	if missing := n - len(p.workers); missing > 0 {
+		capacity += missing * p.concurrency
+	}
+	return float64(inflight) / float64(capacity)
+}
+
+// reservedSaturation returns the ratio of in-flight requests to the capacity
+// of the reserved workers, see Config.ReservedWorkers. Like saturation, it
+// uses each worker's own concurrency, assuming the default for reserved
+// workers not in the pool.
+func (p *pool) reservedSaturation() float64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.reserved == 0 {
+		return 0
+	}
+	var inflight, capacity, n int
+	for _, w := range p.workers {
+		if w.index < p.reserved {
+			inflight += w.inflight
+			capacity += w.concurrency
+			n++
+		}
+	}
+	if missing := p.reserved - n; missing > 0 {
+		capacity += missing * p.concurrency
+	}
+	return float64(inflight) / float64(capacity)
+}
+
+// workerStatus describes a worker for debugging purposes.
+type workerStatus struct {
+	Index       int     `json:"index"`
+	PID         int     `json:"pid"`
+	Port        int     `json:"port"`
+	Inflight    int     `json:"inflight"`
+	Concurrency int     `json:"concurrency"`
+	Weight      float64 `json:"weight"`
+	Draining    bool    `json:"draining"`
+	Reserved    bool    `json:"reserved"`
+	Tag         string  `json:"tag,omitempty"`
+	Overflow    bool    `json:"overflow,omitempty"`
+
+	// The last health check, if any, and the number of consecutive failed
+	// health checks.
+	LastHealthCheck      *time.Time `json:"last_health_check,omitempty"`
+	LastHealthCheckError string     `json:"last_health_check_error,omitempty"`
+	HealthCheckFailures  int        `json:"health_check_failures"`
+
+	// Whether the worker's circuit breaker is open, see BreakerFailures.
+	BreakerOpen bool `json:"breaker_open"`
+
+	// The last error of a worker with this index, e.g. why the previous one
+	// died, if any.
+	LastError     string     `json:"last_error,omitempty"`
+	LastErrorTime *time.Time `json:"last_error_time,omitempty"`
+
+	// The first lines of the worker's output, see WorkerStartupOutput.
+	StartupOutput []string `json:"startup_output,omitempty"`
+}
+
+// status returns a snapshot of the alive workers.
+func (p *pool) status() []workerStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var v []workerStatus
+	for _, w := range p.workers {
+		if w.ctx.Err() != nil {
+			continue
+		}
+		status := workerStatus{
+			Index:               w.index,
+			PID:                 w.pid,
+			Port:                w.port,
+			Inflight:            w.inflight,
+			Concurrency:         w.concurrency,
+			Weight:              p.weights[w.index],
+			Draining:            w.draining,
+			Reserved:            w.index < p.reserved,
+			Tag:                 p.tag(w),
+			Overflow:            w.overflow,
+			HealthCheckFailures: w.healthCheckFailures,
+			BreakerOpen:         time.Now().Before(w.breakerOpenUntil),
+		}
+		if !w.lastHealthCheck.IsZero() {
+			t := w.lastHealthCheck
+			status.LastHealthCheck = &t
+		}
+		if w.lastHealthCheckErr != nil {
+			status.LastHealthCheckError = w.lastHealthCheckErr.Error()
+		}
+		if e, ok := p.lastErrors[w.index]; ok {
+			t := e.time
+			status.LastError = e.err
+			status.LastErrorTime = &t
+		}
+		if w.output != nil {
+			status.StartupOutput = w.output.startup()
+		}
+		v = append(v, status)
+	}
+	return v
+}
@@ -0,0 +1,470 @@
+package stabilizer
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// newTestWorker returns a worker with the given index and concurrency which is
+// not backed by anything, for testing the pool.
+func newTestWorker(index, concurrency int) *worker {
+	w := newWorker(context.Background(), 0, func() {})
+	w.index = index
+	w.concurrency = concurrency
+	return w
+}
+
+// TestPoolChurn acquires and releases workers from many goroutines while
+// workers keep dying and being replaced, as when they crash or time out. Run
+// it with -race.
+func TestPoolChurn(t *testing.T) {
+	for _, tst := range []struct {
+		name     string
+		balancer string
+		fifo     bool
+	}{
+		{"round-robin", BalancerRoundRobin, false},
+		{"weighted-random", BalancerWeightedRandom, false},
+		{"fifo", BalancerRoundRobin, true},
+	} {
+		t.Run(tst.name, func(t *testing.T) {
+			testPoolChurn(t, tst.balancer, tst.fifo)
+		})
+	}
+}
+
+func testPoolChurn(t *testing.T, balancer string, fifo bool) {
+	const (
+		workers     = 4
+		concurrency = 2
+		clients     = 32
+		requests    = 200
+	)
+	// The dead worker's weight makes it by far the most likely to be picked
+	// by the weighted-random balancer, were dead workers not skipped.
+	weights := []float64{1, 1, 1, 1, 1000}
+	p, err := newPool(balancer, concurrency, weights, fifo, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A worker which has died but not yet been removed from the pool.
+	dead := newTestWorker(workers, concurrency)
+	p.add(dead)
+	dead.kill(reasonCrash)
+	<-dead.done
+
+	var (
+		mu  sync.Mutex
+		all []*worker // every worker ever added
+	)
+	for i := 0; i < workers; i++ {
+		w := newTestWorker(i, concurrency)
+		all = append(all, w)
+		p.add(w)
+	}
+
+	// Churn: repeatedly kill a random worker, and replace it shortly after.
+	stop := make(chan struct{})
+	churned := make(chan struct{})
+	go func() {
+		defer close(churned)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			alive := p.alive()
+			if len(alive) == 0 {
+				continue
+			}
+			w := alive[rand.Intn(len(alive))]
+			if w == dead {
+				continue
+			}
+			w.kill(reasonCrash)
+			<-w.done
+			time.Sleep(time.Millisecond)
+			p.remove(w)
+			replacement := newTestWorker(w.index, concurrency)
+			mu.Lock()
+			all = append(all, replacement)
+			mu.Unlock()
+			p.add(replacement)
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < requests; j++ {
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				start := time.Now()
+				w, inflight, err := p.acquire(ctx, demand{})
+				cancel()
+				if err != nil {
+					t.Errorf("acquire: %v after %v", err, time.Since(start))
+					return
+				}
+				if w == dead {
+					t.Error("acquired a dead worker")
+				}
+				if inflight >= w.concurrency {
+					t.Errorf("acquired worker %d with %d requests in-flight, concurrency %d", w.index, inflight, w.concurrency)
+				}
+				if d := time.Since(start); d > 1*time.Second {
+					t.Errorf("acquire took %v", d)
+				}
+				time.Sleep(time.Duration(rand.Intn(100)) * time.Microsecond)
+				p.release(w)
+			}
+		}()
+	}
+	wg.Wait()
+	close(stop)
+	<-churned
+
+	if n, _ := p.inflight(); n != 0 {
+		t.Errorf("%d requests in-flight after all were released", n)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	mu.Lock()
+	defer mu.Unlock()
+	for _, w := range all {
+		if w.inflight != 0 {
+			t.Errorf("worker %d has %d requests in-flight after all were released", w.index, w.inflight)
+		}
+	}
+	if p.waiters.Len() != 0 || p.queue.Len() != 0 {
+		t.Errorf("%d requests waiting, %d queued after all finished", p.waiters.Len(), p.queue.Len())
+	}
+	checkSpare(t, p)
+}
+
+// checkSpare checks that p.spare matches the unused concurrency slots of the
+// workers in p. p.mu must be held.
+func checkSpare(t *testing.T, p *pool) {
+	t.Helper()
+	var spare int
+	for _, w := range p.workers {
+		spare += w.concurrency - w.inflight
+	}
+	if p.spare != spare {
+		t.Errorf("%d spare concurrency slots, want %d", p.spare, spare)
+	}
+}
+
+// TestPoolWakeups acquires workers for a mix of demands, some of which give up
+// waiting early, checking that requests waiting for a worker are always woken
+// up once one they could be handed out becomes available.
+func TestPoolWakeups(t *testing.T) {
+	for _, fifo := range []bool{false, true} {
+		t.Run(fmt.Sprintf("fifo=%v", fifo), func(t *testing.T) {
+			testPoolWakeups(t, fifo)
+		})
+	}
+}
+
+func testPoolWakeups(t *testing.T, fifo bool) {
+	const (
+		clients  = 32
+		requests = 200
+	)
+	// Worker 0 is reserved, and workers 0 and 1 are tagged.
+	p, err := newPool(BalancerRoundRobin, 1, []float64{1, 1, 1, 1}, fifo, 1, []string{"a", "a", "", ""})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		p.add(newTestWorker(i, 1))
+	}
+	demands := []demand{
+		{},
+		{priority: true},
+		{tag: "a"},
+		{tag: "a", avoidTag: true},
+		{priority: true, tag: "a"},
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < requests; j++ {
+				d := demands[rand.Intn(len(demands))]
+				// Some requests give up almost immediately, passing on
+				// any wakeup they received.
+				timeout := 5 * time.Second
+				giveUp := rand.Intn(4) == 0
+				if giveUp {
+					timeout = time.Duration(rand.Intn(50)) * time.Microsecond
+				}
+				ctx, cancel := context.WithTimeout(context.Background(), timeout)
+				start := time.Now()
+				w, _, err := p.acquire(ctx, d)
+				cancel()
+				if err != nil {
+					if !giveUp {
+						t.Errorf("acquire %+v: %v after %v", d, err, time.Since(start))
+						return
+					}
+					continue
+				}
+				if d.tag != "" && (p.tag(w) == d.tag) == d.avoidTag || w.index == 0 && !d.priority {
+					t.Errorf("acquired worker %d for %+v", w.index, d)
+				}
+				time.Sleep(time.Duration(rand.Intn(100)) * time.Microsecond)
+				p.release(w)
+			}
+		}()
+	}
+	wg.Wait()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.waiters.Len() != 0 || p.queue.Len() != 0 {
+		t.Errorf("%d requests waiting, %d queued after all finished", p.waiters.Len(), p.queue.Len())
+	}
+	checkSpare(t, p)
+}
+
+// TestPoolWakeupPassedOn checks that a request woken up for one worker which
+// acquires another passes the wakeup on to the next request waiting for it.
+func TestPoolWakeupPassedOn(t *testing.T) {
+	// Worker 0 is reserved and tagged.
+	p, err := newPool(BalancerRoundRobin, 1, []float64{1, 1}, false, 1, []string{"a", ""})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reserved, unreserved := newTestWorker(0, 1), newTestWorker(1, 1)
+	p.add(reserved)
+	p.add(unreserved)
+	for _, d := range []demand{{}, {priority: true}} {
+		if _, _, err := p.acquire(context.Background(), d); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The first request can be handed out either worker, the second only
+	// the reserved one.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	errs := make(chan error, 2)
+	for n, d := range []demand{{priority: true}, {priority: true, tag: "a"}} {
+		go func(d demand) {
+			_, _, err := p.acquire(ctx, d)
+			errs <- err
+		}(d)
+		waitFor(t, func() bool { return p.queued() == n+1 })
+	}
+
+	// Releasing the reserved worker wakes up the first request, and
+	// releasing the unreserved one then wakes up no one, since the first
+	// request is already woken up and the second can't be handed it out.
+	// The first request then prefers the unreserved worker, and must pass
+	// on its wakeup for the reserved one.
+	p.release(reserved)
+	p.release(unreserved)
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// TestPoolAvoid checks that the worker a request avoids (e.g. the one it just
+// failed on) is only handed out if no other worker is available.
+func TestPoolAvoid(t *testing.T) {
+	for _, balancer := range []string{BalancerRoundRobin, BalancerWeightedRandom} {
+		t.Run(balancer, func(t *testing.T) {
+			// The weights make worker 0 by far the most likely to be picked
+			// by the weighted-random balancer, were it not avoided.
+			p, err := newPool(balancer, 2, []float64{1000, 1}, false, 0, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w0, w1 := newTestWorker(0, 2), newTestWorker(1, 2)
+			p.add(w0)
+			p.add(w1)
+
+			for i := 0; i < 20; i++ {
+				w, _, err := p.acquire(context.Background(), demand{avoid: w0})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if w != w1 {
+					t.Fatalf("got worker %d, want 1", w.index)
+				}
+				p.release(w)
+			}
+
+			// Once worker 1 is busy, worker 0 is handed out after all.
+			for _, want := range []*worker{w1, w1, w0} {
+				w, _, err := p.acquire(context.Background(), demand{avoid: w0})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if w != want {
+					t.Fatalf("got worker %d, want %d", w.index, want.index)
+				}
+			}
+
+			// A request waiting for a worker is woken up for worker 0 too.
+			if _, _, err := p.acquire(context.Background(), demand{}); err != nil {
+				t.Fatal(err)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			got := make(chan *worker, 1)
+			go func() {
+				w, _, _ := p.acquire(ctx, demand{avoid: w0})
+				got <- w
+			}()
+			waitFor(t, func() bool { return p.queued() == 1 })
+			p.release(w0)
+			if w := <-got; w != w0 {
+				t.Errorf("got %v, want worker 0", w)
+			}
+		})
+	}
+}
+
+func TestPoolReservedSaturation(t *testing.T) {
+	p, err := newPool(BalancerRoundRobin, 10, []float64{1, 1, 1, 1}, false, 2, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := p.reservedSaturation(); got != 0 {
+		t.Errorf("no workers: got %v, want 0", got)
+	}
+
+	// A reserved worker which declared a lower concurrency than the default
+	// when it became ready.
+	w0 := newTestWorker(0, 2)
+	w0.inflight = 2
+	p.add(w0)
+	p.add(newTestWorker(2, 10))
+	// Worker 1 is not in the pool, so is assumed to have the default
+	// concurrency.
+	if got, want := p.reservedSaturation(), 2.0/12; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	w1 := newTestWorker(1, 2)
+	w1.inflight = 1
+	p.add(w1)
+	if got, want := p.reservedSaturation(), 3.0/4; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+// newBenchPool returns a pool of n workers, each with a concurrency of 1.
+func newBenchPool(n int, balancer string) *pool {
+	weights := make([]float64, n)
+	for i := range weights {
+		weights[i] = 1
+	}
+	p, err := newPool(balancer, 1, weights, false, 0, nil)
+	if err != nil {
+		panic(err)
+	}
+	for i := 0; i < n; i++ {
+		p.add(newTestWorker(i, 1))
+	}
+	return p
+}
+
+// BenchmarkAcquire measures acquiring and releasing a worker from pools of
+// various sizes: uncontended, saturated by 4 requests per worker, and with 8
+// requests per worker which each hold their worker for 200µs, so that most
+// are queued. For the latter, the x-semaphore metric compares the time taken
+// with that of a buffered channel used as a semaphore with the same capacity,
+// which hands out slots to queued goroutines without any thundering herd.
+func BenchmarkAcquire(b *testing.B) {
+	ctx := context.Background()
+	for _, balancer := range []string{BalancerRoundRobin, BalancerWeightedRandom} {
+		for _, n := range []int{4, 64, 256, 1024} {
+			b.Run(fmt.Sprintf("uncontended/%s/workers=%d", balancer, n), func(b *testing.B) {
+				p := newBenchPool(n, balancer)
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					w, _, _ := p.acquire(ctx, demand{})
+					p.release(w)
+				}
+			})
+			b.Run(fmt.Sprintf("saturated/%s/workers=%d", balancer, n), func(b *testing.B) {
+				p := newBenchPool(n, balancer)
+				b.ResetTimer()
+				benchmarkConcurrently(b.N, 4*n, 0, func() func() {
+					w, _, _ := p.acquire(ctx, demand{})
+					return func() { p.release(w) }
+				})
+			})
+		}
+	}
+	for _, n := range []int{4, 64, 256, 1024} {
+		b.Run(fmt.Sprintf("queued/workers=%d", n), func(b *testing.B) {
+			const hold = 200 * time.Microsecond
+			b.StopTimer()
+			sem := make(chan struct{}, n)
+			start := time.Now()
+			benchmarkConcurrently(b.N, 8*n, hold, func() func() {
+				sem <- struct{}{}
+				return func() { <-sem }
+			})
+			semaphore := time.Since(start)
+
+			p := newBenchPool(n, BalancerRoundRobin)
+			b.StartTimer()
+			start = time.Now()
+			cpu := cpuTime()
+			benchmarkConcurrently(b.N, 8*n, hold, func() func() {
+				w, _, _ := p.acquire(ctx, demand{})
+				return func() { p.release(w) }
+			})
+			b.ReportMetric(float64(time.Since(start))/float64(semaphore), "x-semaphore")
+			b.ReportMetric(float64(cpuTime()-cpu)/float64(b.N), "cpu-ns/op")
+		})
+	}
+}
+
+// benchmarkConcurrently makes about requests calls to acquire from the given
+// number of concurrent goroutines, calling the returned release function
+// after hold.
+func benchmarkConcurrently(requests, goroutines int, hold time.Duration, acquire func() (release func())) {
+	perGoroutine := requests/goroutines + 1
+	var wg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < perGoroutine; j++ {
+				release := acquire()
+				if hold > 0 {
+					time.Sleep(hold)
+				}
+				release()
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// cpuTime returns the CPU time used by the process so far.
+func cpuTime() time.Duration {
+	var usage syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage); err != nil {
+		panic(err)
+	}
+	return time.Duration(usage.Utime.Nano() + usage.Stime.Nano())
+}
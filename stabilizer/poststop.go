@@ -0,0 +1,41 @@
+package stabilizer
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// postStopTimeout is how long PostStopCommand may run before it is killed.
+const postStopTimeout = 1 * time.Minute
+
+// postStop runs PostStopCommand for a worker which has died, logging its
+// output and any failure.
+func (s *Stabilizer) postStop(w *worker) {
+	r := strings.NewReplacer(
+		"{{.PID}}", fmt.Sprint(w.pid),
+		"{{.Port}}", fmt.Sprint(w.port),
+		"{{.Index}}", fmt.Sprint(w.index),
+		"{{.Reason}}", w.reason,
+	)
+	var args []string
+	for _, arg := range s.config.PostStopArgs {
+		args = append(args, r.Replace(arg))
+	}
+
+	// Not s.ctx, since cleanup must still happen when shutting down.
+	ctx, cancel := context.WithTimeout(context.Background(), postStopTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, s.config.PostStopCommand, args...).CombinedOutput()
+	for _, line := range strings.Split(strings.TrimSuffix(string(out), "\n"), "\n") {
+		if line != "" {
+			log.Printf("worker %v: post-stop: %s", w.pid, line)
+		}
+	}
+	if err != nil {
+		log.Printf("worker %v: post-stop: %v", w.pid, err)
+	}
+}
@@ -0,0 +1,153 @@
+package stabilizer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// waitReady waits for w to respond successfully to a request for ReadyPath,
+// returning an error if it does not do so within ReadyTimeout or it dies
+// first. If ReadyPath is not set, workers are ready as soon as they start
+// (or, if ReadyCommand is set, once it succeeds).
+//
+// Workers may declare how many concurrent requests they can handle by
+// responding with a JSON body such as {"concurrency": 4}, overriding
+// Concurrency.
+func (s *Stabilizer) waitReady(w *worker) error {
+	if s.config.ReadyCommand != "" {
+		return s.waitReadyCommand(w)
+	}
+	if s.config.ReadyPath == "" {
+		return nil
+	}
+	client := &http.Client{Timeout: 1 * time.Second}
+	url := fmt.Sprintf("http://%s%s", w.addr(), s.config.ReadyPath)
+	deadline := time.After(s.config.ReadyTimeout)
+	for {
+		resp, err := client.Get(url)
+		if err == nil {
+			var body struct {
+				Concurrency int `json:"concurrency"`
+			}
+			_ = json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&body)
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				if body.Concurrency > 0 {
+					log.Printf("worker %v: concurrency set to %v", w.pid, body.Concurrency)
+					w.concurrency = body.Concurrency
+				}
+				return nil
+			}
+		}
+		select {
+		case <-w.done:
+			return fmt.Errorf("exited before becoming ready")
+		case <-deadline:
+			return fmt.Errorf("not ready after %v", s.config.ReadyTimeout)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// waitReadyCommand runs ReadyCommand until it exits successfully, returning an
+// error if it does not do so within ReadyTimeout or w dies first.
+func (s *Stabilizer) waitReadyCommand(w *worker) error {
+	r := strings.NewReplacer(
+		"{{.PID}}", fmt.Sprint(w.pid),
+		"{{.Port}}", fmt.Sprint(w.port),
+		"{{.Index}}", fmt.Sprint(w.index),
+	)
+	var args []string
+	for _, arg := range s.config.ReadyArgs {
+		args = append(args, r.Replace(arg))
+	}
+	ctx, cancel := context.WithTimeout(w.ctx, s.config.ReadyTimeout)
+	defer cancel()
+	var lastErr error
+	for {
+		out, err := exec.CommandContext(ctx, s.config.ReadyCommand, args...).CombinedOutput()
+		if err == nil {
+			return nil
+		}
+		lastErr = err
+		if out := strings.TrimSpace(string(out)); out != "" {
+			lastErr = fmt.Errorf("%v: %s", err, out)
+		}
+		select {
+		case <-w.done:
+			return fmt.Errorf("exited before becoming ready")
+		case <-ctx.Done():
+			return fmt.Errorf("not ready after %v: ready command: %v", s.config.ReadyTimeout, lastErr)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// healthCheck periodically checks that w still responds successfully to a
+// request for ReadyPath, killing it after HealthCheckFailures consecutive
+// failures.
+func (s *Stabilizer) healthCheck(w *worker) {
+	client := &http.Client{Timeout: s.config.HealthCheckInterval}
+	url := fmt.Sprintf("http://%s%s", w.addr(), s.config.ReadyPath)
+	ticker := time.NewTicker(s.config.HealthCheckInterval)
+	defer ticker.Stop()
+	var failures int
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+		}
+		resp, err := client.Get(url)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				err = fmt.Errorf("unexpected status %v", resp.StatusCode)
+			}
+		}
+		if err == nil {
+			failures = 0
+			s.pool.recordHealthCheck(w, nil, failures)
+			continue
+		}
+		failures++
+		s.pool.recordHealthCheck(w, err, failures)
+		log.Printf("worker %v: health check failed (%v/%v): %v", w.pid, failures, s.config.HealthCheckFailures, err)
+		if failures >= s.config.HealthCheckFailures {
+			log.Printf("worker %v: restarting due to failed health checks", w.pid)
+			w.kill(reasonUnhealthy)
+			return
+		}
+	}
+}
+
+// Ready returns the number of workers currently ready to serve requests.
+func (s *Stabilizer) Ready() int {
+	ready, _ := s.pool.ready()
+	return ready
+}
+
+// WaitReady blocks until at least n workers are ready to serve requests,
+// returning an error if ctx is canceled first.
+func (s *Stabilizer) WaitReady(ctx context.Context, n int) error {
+	log.Printf("waiting for %v workers to become ready", n)
+	for {
+		ready, changed := s.pool.ready()
+		if ready >= n {
+			log.Printf("%v workers ready", ready)
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return fmt.Errorf("only %v of %v workers ready: %v", ready, n, ctx.Err())
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package stabilizer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+)
+
+// Recording is a request sent to a worker and the worker's response, as
+// written to Config.Record and served by NewReplayHandler.
+type Recording struct {
+	Method        string      `json:"method"`
+	URL           string      `json:"url"` // the request URI, e.g. /foo?bar=baz
+	RequestHeader http.Header `json:"request_header"`
+	RequestBody   []byte      `json:"request_body,omitempty"`
+
+	Status int         `json:"status"`
+	Header http.Header `json:"header"`
+	Body   []byte      `json:"body,omitempty"`
+}
+
+// recorder writes Recordings to Config.Record.
+type recorder struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func (rec *recorder) write(r *Recording) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if err := rec.enc.Encode(r); err != nil {
+		log.Printf("recording %s %s: %v", r.Method, r.URL, err)
+	}
+}
+
+// syncBuffer is a bytes.Buffer which may be written and read concurrently,
+// as the transport sends the request body in its own goroutine.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) Bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]byte(nil), b.buf.Bytes()...)
+}
+
+// recordedRequestBody copies a request body to buf as it is sent to a worker.
+type recordedRequestBody struct {
+	io.ReadCloser
+	buf *syncBuffer
+}
+
+func (b *recordedRequestBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.buf.Write(p[:n])
+	return n, err
+}
+
+// recordRequest prepares req, about to be sent to a worker, for
+// recordResponse. It must be called by the director.
+func (s *Stabilizer) recordRequest(req *http.Request) {
+	if s.recorder == nil || req.Body == nil {
+		return
+	}
+	req.Body = &recordedRequestBody{ReadCloser: req.Body, buf: &syncBuffer{}}
+}
+
+// recordedResponseBody copies a response body as it is sent to the client,
+// and writes the Recording once it is closed.
+type recordedResponseBody struct {
+	io.ReadCloser
+	rec     *recorder
+	r       *Recording
+	reqBody *syncBuffer // nil if the request had no body
+	buf     bytes.Buffer
+	once    sync.Once
+}
+
+func (b *recordedResponseBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.buf.Write(p[:n])
+	return n, err
+}
+
+func (b *recordedResponseBody) Close() error {
+	b.once.Do(func() {
+		if b.reqBody != nil {
+			b.r.RequestBody = b.reqBody.Bytes()
+		}
+		b.r.Body = b.buf.Bytes()
+		b.rec.write(b.r)
+	})
+	return b.ReadCloser.Close()
+}
+
+// recordResponse arranges for resp, and the request it answers, to be written
+// to Config.Record once the response body has been sent to the client.
+func (s *Stabilizer) recordResponse(resp *http.Response) {
+	if s.recorder == nil {
+		return
+	}
+	req := resp.Request
+	body := &recordedResponseBody{
+		ReadCloser: resp.Body,
+		rec:        s.recorder,
+		r: &Recording{
+			Method:        req.Method,
+			URL:           req.URL.RequestURI(),
+			RequestHeader: req.Header.Clone(),
+			Status:        resp.StatusCode,
+			Header:        resp.Header.Clone(),
+		},
+	}
+	if reqBody, ok := req.Body.(*recordedRequestBody); ok {
+		body.reqBody = reqBody.buf
+	}
+	resp.Body = body
+}
+
+// replayHandler serves recorded responses, see NewReplayHandler.
+type replayHandler struct {
+	mu         sync.Mutex
+	recordings map[string][]*Recording // by method and URL
+}
+
+// NewReplayHandler returns a handler which serves the Recordings read from r,
+// as written to Config.Record, acting as a fake worker for testing the
+// stabilizer deterministically without the real worker. Requests are matched
+// by method and URL: recordings of the same request are replayed in the
+// order they were recorded, the last one being repeated. Requests with no
+// recording fail with a 404 Not Found.
+func NewReplayHandler(r io.Reader) (http.Handler, error) {
+	h := &replayHandler{recordings: make(map[string][]*Recording)}
+	dec := json.NewDecoder(bufio.NewReader(r))
+	for {
+		var rec Recording
+		if err := dec.Decode(&rec); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("reading recordings: %v", err)
+		}
+		key := rec.Method + " " + rec.URL
+		h.recordings[key] = append(h.recordings[key], &rec)
+	}
+	return h, nil
+}
+
+func (h *replayHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := r.Method + " " + r.URL.RequestURI()
+	h.mu.Lock()
+	recordings := h.recordings[key]
+	if len(recordings) > 1 {
+		h.recordings[key] = recordings[1:]
+	}
+	h.mu.Unlock()
+	if len(recordings) == 0 {
+		http.Error(w, fmt.Sprintf("no recorded response for %s", key), http.StatusNotFound)
+		return
+	}
+	rec := recordings[0]
+	for name, values := range rec.Header {
+		w.Header()[name] = values
+	}
+	w.WriteHeader(rec.Status)
+	w.Write(rec.Body)
+}
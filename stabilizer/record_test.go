@@ -0,0 +1,99 @@
+package stabilizer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// TestRecordReplay records the traffic to a worker and then replays it via
+// NewReplayHandler in place of the worker, which should be indistinguishable.
+func TestRecordReplay(t *testing.T) {
+	var n int32
+	worker := http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/count":
+			fmt.Fprintf(rw, "count %d", atomic.AddInt32(&n, 1))
+		case "/echo":
+			body, _ := ioutil.ReadAll(r.Body)
+			rw.Header().Set("X-Echo", "yes")
+			rw.WriteHeader(http.StatusCreated)
+			rw.Write(body)
+		default:
+			http.NotFound(rw, r)
+		}
+	})
+	requests := []struct {
+		method, path, body string
+	}{
+		{"GET", "/count", ""},
+		{"GET", "/count", ""},
+		{"POST", "/echo?x=1", "hello"},
+		{"GET", "/missing", ""},
+	}
+	type response struct {
+		status int
+		echo   string
+		body   string
+	}
+	do := func(ts *testStabilizer, method, path, body string) response {
+		req, _ := http.NewRequest(method, ts.srv.URL+path, strings.NewReader(body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(resp.Body)
+		return response{resp.StatusCode, resp.Header.Get("X-Echo"), string(b)}
+	}
+
+	// Record.
+	record := &syncBuffer{}
+	ts := newTestStabilizer(t, Config{Workers: 1, Record: record}, worker)
+	var want []response
+	for _, r := range requests {
+		want = append(want, do(ts, r.method, r.path, r.body))
+	}
+	waitFor(t, func() bool { return bytes.Count(record.Bytes(), []byte("\n")) == len(requests) })
+	ts.close()
+
+	var recordings []Recording
+	dec := json.NewDecoder(bytes.NewReader(record.Bytes()))
+	for dec.More() {
+		var r Recording
+		if err := dec.Decode(&r); err != nil {
+			t.Fatal(err)
+		}
+		recordings = append(recordings, r)
+	}
+	if r := recordings[2]; r.Method != "POST" || r.URL != "/echo?x=1" || string(r.RequestBody) != "hello" || string(r.Body) != "hello" || r.Status != http.StatusCreated {
+		t.Errorf("unexpected recording of POST /echo: %+v", r)
+	}
+
+	// Replay.
+	replay, err := NewReplayHandler(bytes.NewReader(record.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts = newTestStabilizer(t, Config{Workers: 1}, replay)
+	defer ts.close()
+	for i, r := range requests {
+		if got := do(ts, r.method, r.path, r.body); got != want[i] {
+			t.Errorf("%s %s: replayed %+v, recorded %+v", r.method, r.path, got, want[i])
+		}
+	}
+
+	// The last recording of a request is repeated, and requests which were
+	// not recorded fail.
+	if got := do(ts, "GET", "/count", ""); got.body != "count 2" {
+		t.Errorf("GET /count again: got %q, want the last recording repeated", got.body)
+	}
+	if got := do(ts, "GET", "/never", ""); got.status != http.StatusNotFound || !strings.Contains(got.body, "no recorded response") {
+		t.Errorf("GET /never: got %+v, want 404", got)
+	}
+}
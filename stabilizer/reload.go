@@ -0,0 +1,137 @@
+package stabilizer
+
+import (
+	"log"
+	"reflect"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// reloadableFields are the fields of Config which Reload applies at runtime.
+// Workers keep the Command, Args and Concurrency they were started with, so
+// changing those recycles all workers.
+var reloadableFields = map[string]bool{
+	"Command":               true,
+	"Args":                  true,
+	"Concurrency":           true,
+	"Balancer":              true,
+	"WorkerWeights":         true,
+	"Timeout":               true,
+	"TimeoutPerByte":        true,
+	"TimeoutBase":           true,
+	"TimeoutMax":            true,
+	"TimeoutDrainGrace":     true,
+	"QueueTimeout":          true,
+	"RequestDeadline":       true,
+	"ColdStartTimeout":      true,
+	"DrainWorkerTimeout":    true,
+	"MaxBodyBytes":          true,
+	"MaxResponseBytes":      true,
+	"VerifyResponseMaxBody": true,
+	"Retries":               true,
+	"RetryMaxBody":          true,
+	"BreakerFailures":       true,
+	"BreakerCooldown":       true,
+	"PauseRetryAfter":       true,
+}
+
+// current returns the configuration currently in effect, including changes
+// applied by Reload.
+func (s *Stabilizer) current() *Config {
+	if config, ok := s.reloaded.Load().(*Config); ok {
+		return config
+	}
+	return &s.config
+}
+
+// Reload applies the fields of config which can safely change at runtime
+// (timeouts, limits, balancing, and the worker command) to the running
+// stabilizer, and returns the names of the Config fields it applied and of
+// those which changed but only take effect after a restart. Changes to the
+// worker command or Concurrency are applied by a rolling recycle of all
+// workers, as with WatchBinary. Fields which are functions or interfaces, such
+// as OnOutcome, are ignored.
+//
+// config is validated, and defaults applied, just as by New. If it is
+// invalid, an error is returned and nothing is applied.
+func (s *Stabilizer) Reload(config Config) (applied, restart []string, err error) {
+	// Validate config by creating a Stabilizer from it, which is discarded
+	// without being started, so its metrics must not be registered.
+	config.Registerer = prometheus.NewRegistry()
+	next, err := New(config)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+	prev := s.current()
+	updated := *prev
+	v, nextV := reflect.ValueOf(&updated).Elem(), reflect.ValueOf(next.config)
+	for i := 0; i < v.NumField(); i++ {
+		name, field := v.Type().Field(i).Name, v.Field(i)
+		if field.Kind() == reflect.Func || field.Kind() == reflect.Interface {
+			continue
+		}
+		if reflect.DeepEqual(field.Interface(), nextV.Field(i).Interface()) {
+			continue
+		}
+		if !reloadableFields[name] {
+			restart = append(restart, name)
+			continue
+		}
+		field.Set(nextV.Field(i))
+		applied = append(applied, name)
+	}
+	if len(restart) > 0 {
+		log.Printf("reload: not applying changes to %s, which require a restart", strings.Join(restart, ", "))
+	}
+	if len(applied) == 0 {
+		log.Println("reload: no changes to apply")
+		return nil, restart, nil
+	}
+
+	if updated.Balancer != prev.Balancer {
+		if err := s.pool.setBalancer(updated.Balancer); err != nil {
+			return nil, nil, err
+		}
+	}
+	if !reflect.DeepEqual(updated.WorkerWeights, prev.WorkerWeights) {
+		for i := 0; i < updated.Workers; i++ {
+			weight := 1.0
+			if i < len(updated.WorkerWeights) {
+				weight = updated.WorkerWeights[i]
+			}
+			if err := s.pool.setWeight(i, weight); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	s.pool.setConcurrency(updated.Concurrency)
+	s.reloaded.Store(&updated)
+	if s.shadow != nil {
+		shadow := shadowConfig(updated)
+		s.shadow.pool.setConcurrency(shadow.Concurrency)
+		s.shadow.reloaded.Store(&shadow)
+	}
+	log.Printf("reload: applied changes to %s", strings.Join(applied, ", "))
+
+	commandChanged := updated.Command != prev.Command || !reflect.DeepEqual(updated.Args, prev.Args)
+	if commandChanged || updated.Concurrency != prev.Concurrency {
+		log.Println("reload: recycling workers to apply the new worker command or concurrency")
+		go func() {
+			if err := s.recycleWorkers(); err != nil {
+				log.Printf("reload: %v", err)
+			}
+		}()
+		if s.shadow != nil && updated.Concurrency != prev.Concurrency {
+			go func() {
+				if err := s.shadow.recycleWorkers(); err != nil {
+					log.Printf("reload: shadow pool: %v", err)
+				}
+			}()
+		}
+	}
+	return applied, restart, nil
+}
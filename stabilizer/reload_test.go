@@ -0,0 +1,103 @@
+package stabilizer
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReload(t *testing.T) {
+	config := Config{Command: "true", Workers: 2, Timeout: 10 * time.Second}
+	ts := newTestStabilizer(t, config, http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Write([]byte("hello"))
+	}))
+	defer ts.close()
+
+	config.Timeout = 5 * time.Second
+	config.MaxBodyBytes = 10
+	config.Balancer = BalancerWeightedRandom
+	config.WorkerWeights = []float64{1, 0}
+	config.Workers = 3
+	applied, restart, err := ts.Reload(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantApplied := []string{"Balancer", "WorkerWeights", "Timeout", "TimeoutBase", "MaxBodyBytes"}
+	if !reflect.DeepEqual(applied, wantApplied) {
+		t.Errorf("applied %q, want %q", applied, wantApplied)
+	}
+	if want := []string{"Workers"}; !reflect.DeepEqual(restart, want) {
+		t.Errorf("restart required for %q, want %q", restart, want)
+	}
+
+	if got := ts.current().Timeout; got != 5*time.Second {
+		t.Errorf("Timeout %v after reload, want 5s", got)
+	}
+	if ts.current().Workers != 2 {
+		t.Errorf("Workers %v after reload, want it unchanged", ts.current().Workers)
+	}
+	ts.pool.mu.Lock()
+	balancer, weight := ts.pool.balancer, ts.pool.weights[1]
+	ts.pool.mu.Unlock()
+	if balancer != BalancerWeightedRandom || weight != 0 {
+		t.Errorf("pool has balancer %q and weight %v for worker 1 after reload", balancer, weight)
+	}
+	resp, err := http.Post(ts.srv.URL, "text/plain", strings.NewReader(strings.Repeat("x", 100)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("got status %v after reloading MaxBodyBytes, want 413", resp.StatusCode)
+	}
+
+	// Reloading the same configuration again changes nothing.
+	if applied, _, err := ts.Reload(config); err != nil || len(applied) != 0 {
+		t.Errorf("reloading again applied %q, %v", applied, err)
+	}
+}
+
+func TestReloadInvalid(t *testing.T) {
+	config := Config{Command: "true", Workers: 2, Timeout: 10 * time.Second}
+	ts := newTestStabilizer(t, config, http.NotFoundHandler())
+	defer ts.close()
+
+	config.Timeout = 5 * time.Second
+	config.Balancer = "bogus"
+	if _, _, err := ts.Reload(config); err == nil {
+		t.Fatal("reloading with an unknown balancer succeeded")
+	}
+	if got := ts.current().Timeout; got != 10*time.Second {
+		t.Errorf("Timeout %v after failed reload, want it unchanged", got)
+	}
+}
+
+func TestReloadRecyclesWorkers(t *testing.T) {
+	config := Config{Command: "true", Workers: 2}
+	ts := newTestStabilizer(t, config, http.NotFoundHandler())
+	defer ts.close()
+
+	config.Args = []string{"-v"}
+	config.Concurrency = 3
+	if _, _, err := ts.Reload(config); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool {
+		if atomic.LoadInt32(&ts.spawned) != 4 {
+			return false
+		}
+		for _, w := range ts.pool.alive() {
+			if w.concurrency != 3 {
+				return false
+			}
+		}
+		return len(ts.pool.alive()) == 2
+	})
+	waitFor(t, func() bool { return !ts.recycleProgress().Active })
+	if p := ts.recycleProgress(); p.Recycled != 2 || p.Error != "" {
+		t.Errorf("recycled %d workers, error %q", p.Recycled, p.Error)
+	}
+}
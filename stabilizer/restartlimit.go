@@ -0,0 +1,56 @@
+package stabilizer
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// restartLimiter counts worker restarts within MaxTotalRestartsWindow, see
+// MaxTotalRestarts.
+type restartLimiter struct {
+	mu       sync.Mutex
+	restarts []time.Time // within the window, oldest first
+	exceeded bool
+}
+
+// countsTowardsRestartLimit reports whether a worker which died for reason
+// counts towards MaxTotalRestarts. Workers which were deliberately recycled
+// don't, since e.g. WatchBinary restarts every worker by design.
+func countsTowardsRestartLimit(reason string) bool {
+	switch reason {
+	case reasonManual, reasonRecycle, reasonMemory, reasonIdle, reasonOverflow:
+		return false
+	}
+	return true
+}
+
+// recordRestart records that w died (and, unless it was an overflow worker, is
+// being restarted), calling OnRestartLimit (once) if that exceeds
+// MaxTotalRestarts.
+func (s *Stabilizer) recordRestart(w *worker) {
+	if s.config.MaxTotalRestarts == 0 || s.ctx.Err() != nil || !countsTowardsRestartLimit(w.reason) {
+		return
+	}
+	l := &s.restartLimit
+	l.mu.Lock()
+	now := time.Now()
+	i := 0
+	for i < len(l.restarts) && now.Sub(l.restarts[i]) > s.config.MaxTotalRestartsWindow {
+		i++
+	}
+	l.restarts = append(l.restarts[i:], now)
+	n := len(l.restarts)
+	exceeded := n > s.config.MaxTotalRestarts && !l.exceeded
+	if exceeded {
+		l.exceeded = true
+	}
+	l.mu.Unlock()
+	if !exceeded {
+		return
+	}
+	log.Printf("WARNING: %d worker restarts within %v exceeds MaxTotalRestarts=%d, workers are most likely persistently broken", n, s.config.MaxTotalRestartsWindow, s.config.MaxTotalRestarts)
+	if s.config.OnRestartLimit != nil {
+		s.config.OnRestartLimit(n)
+	}
+}
@@ -0,0 +1,98 @@
+package stabilizer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+)
+
+// retryKey is the context key of a request's *retryState.
+type retryKey struct{}
+
+// retryState tracks the attempts made to proxy a request when Retries is
+// enabled.
+type retryState struct {
+	attempts int    // attempts made so far, including the current one
+	body     []byte // buffered request body, replayed for each attempt
+	tooLarge bool   // the body was too large to buffer, so retries are impossible
+	retry    bool   // set by errorHandler when the attempt should be retried
+}
+
+// newRetryState buffers the body of r so that it may be retried, replacing
+// r.Body. Bodies of unknown size or larger than RetryMaxBody are not buffered
+// and instead streamed as usual, making the request non-retryable.
+func (s *Stabilizer) newRetryState(r *http.Request) (*retryState, error) {
+	state := &retryState{}
+	if r.Body == nil || r.Body == http.NoBody || r.ContentLength == 0 {
+		return state, nil
+	}
+	if r.ContentLength < 0 || r.ContentLength > s.current().RetryMaxBody {
+		state.tooLarge = true
+		return state, nil
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, r.ContentLength))
+	if err != nil {
+		return nil, err
+	}
+	state.body = body
+	return state, nil
+}
+
+// attempt returns a copy of r for the next attempt, with a fresh body.
+func (state *retryState) attempt(ctx context.Context, r *http.Request) *http.Request {
+	state.attempts++
+	state.retry = false
+	r = r.WithContext(context.WithValue(ctx, retryKey{}, state))
+	if state.body != nil {
+		r.Body = ioutil.NopCloser(bytes.NewReader(state.body))
+	}
+	return r
+}
+
+// shouldRetry reports whether a request which failed with err on w should be
+// retried, on another worker if one is available (see demand.avoid). Requests
+// which timed out are never retried, since the worker was most likely stuck on
+// the request itself. Requests which the worker could not be connected to are
+// always safe to retry, while other failures (e.g. the worker dying
+// mid-request) are only retried for idempotent methods. This includes
+// responses which were truncated, when VerifyResponseMaxBody is enabled.
+//
+// If the request would have been retried but its body was too large to
+// buffer, it responds with an hss_not_retryable error and returns true, so the
+// caller must not write a response either way.
+func (s *Stabilizer) shouldRetry(rw http.ResponseWriter, r *http.Request, w *worker, err error) bool {
+	state, _ := r.Context().Value(retryKey{}).(*retryState)
+	if state == nil || r.Context().Err() != nil || state.attempts > s.current().Retries {
+		return false
+	}
+	if !isDialError(err) && !idempotent(r.Method) {
+		return false
+	}
+	if state.tooLarge {
+		limit := s.current().RetryMaxBody
+		log.Printf("worker %v: not retrying request with body larger than %v bytes: %v", w.pid, limit, err)
+		s.setWorkerHeaders(rw.Header(), r, w)
+		rw.Header().Set("X-Stabilizer-Not-Retryable", "body-too-large")
+		s.metrics.responses.WithLabelValues(statusClass(http.StatusServiceUnavailable)).Inc()
+		s.writeError(rw, r, http.StatusServiceUnavailable, "hss_not_retryable", fmt.Sprintf("worker %v: %v (not retried: request body larger than %v bytes)", w.pid, err, limit))
+		return true
+	}
+	log.Printf("worker %v: retrying request: %v", w.pid, err)
+	s.metrics.retries.Inc()
+	state.retry = true
+	return true
+}
+
+// idempotent reports whether requests with the given method may safely be
+// sent more than once.
+func idempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,87 @@
+package stabilizer
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// TestRetryOtherWorker checks that a failed request is retried on another
+// worker, even if the balancer would most likely pick the same one again.
+func TestRetryOtherWorker(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		hosts []string // the workers requests were sent to
+	)
+	ts := newTestStabilizer(t, Config{
+		Workers:          2,
+		Retries:          1,
+		Balancer:         BalancerWeightedRandom,
+		WorkerWeights:    []float64{1000, 1},
+		WorkerHostHeader: "rewrite",
+	}, http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		hosts = append(hosts, r.Host)
+		first := len(hosts) == 1
+		mu.Unlock()
+		if first {
+			// Like a worker dying mid-request.
+			panic(http.ErrAbortHandler)
+		}
+		rw.Write([]byte("ok"))
+	}))
+	defer ts.close()
+
+	resp, body := ts.get(t, "/")
+	if resp.StatusCode != http.StatusOK || body != "ok" {
+		t.Fatalf("got %v %q, want 200 ok", resp.StatusCode, body)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(hosts) != 2 || hosts[0] == hosts[1] {
+		t.Errorf("request sent to workers %q, want two different ones", hosts)
+	}
+}
+
+func TestNotRetryable(t *testing.T) {
+	ts := newTestStabilizer(t, Config{Workers: 1, Retries: 1, RetryMaxBody: 10}, http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		panic(http.ErrAbortHandler)
+	}))
+	defer ts.close()
+
+	req, err := http.NewRequest("PUT", ts.srv.URL, strings.NewReader(strings.Repeat("x", 100)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("got status %v, want 503", resp.StatusCode)
+	}
+	if got := resp.Header.Get("X-Stabilizer-Not-Retryable"); got != "body-too-large" {
+		t.Errorf("got X-Stabilizer-Not-Retryable %q, want body-too-large", got)
+	}
+	if got := resp.Header.Get("Content-Type"); got != "application/json" {
+		t.Errorf("got Content-Type %q, want application/json", got)
+	}
+	var got struct {
+		Code  string `json:"code"`
+		Error string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Code != "hss_not_retryable" {
+		t.Errorf("got code %q, want hss_not_retryable", got.Code)
+	}
+	if want := "(not retried: request body larger than 10 bytes)"; !strings.HasSuffix(got.Error, want) {
+		t.Errorf("got error %q, want it to end with %q", got.Error, want)
+	}
+}
@@ -0,0 +1,169 @@
+package stabilizer
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"sync"
+)
+
+// shadowPool is a separate set of workers which a percentage of requests are
+// mirrored to, with their responses discarded.
+type shadowPool struct {
+	*Stabilizer
+	client *http.Client
+}
+
+// newShadowPool returns the shadow pool of parent, whose workers share its
+// configuration (other than the command, see shadowConfig) and metrics.
+func newShadowPool(parent *Stabilizer) (*shadowPool, error) {
+	config := shadowConfig(parent.config)
+	weights := make([]float64, config.Workers)
+	for i := range weights {
+		weights[i] = 1
+	}
+	pool, err := newPool(config.Balancer, config.Concurrency, weights, config.FairQueue, 0, nil)
+	if err != nil {
+		return nil, err
+	}
+	s := &Stabilizer{
+		config:          config,
+		metrics:         parent.metrics,
+		pool:            pool,
+		poolName:        "shadow",
+		outputRequestID: parent.outputRequestID,
+	}
+	s.spawn = s.spawnProcess
+	return &shadowPool{
+		Stabilizer: s,
+		client: &http.Client{
+			Transport: s.newTransport(),
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}, nil
+}
+
+// shadowConfig returns the configuration of the shadow pool of a stabilizer
+// with the given configuration.
+func shadowConfig(config Config) Config {
+	config.Command = config.ShadowCommand
+	config.Args = config.ShadowArgs
+	config.Workers = config.ShadowWorkers
+	config.Balancer = BalancerRoundRobin
+	config.WorkerWeights = nil
+	config.WatchBinary = false
+	config.FallbackCommand = ""
+	config.MaxTotalRestarts = 0
+	config.MaxOverflowWorkers = 0
+	return config
+}
+
+// prepare decides whether r should be mirrored and, if so, arranges for it to
+// be mirrored. The request body is copied as it is sent to the real worker,
+// rather than read up front, so that mirroring never delays the real request,
+// and the mirrored request is only sent once the whole body has been read. So
+// only requests with a known Content-Length no larger than ShadowMaxBody are
+// mirrored, and only if their body is read in full.
+func (sp *shadowPool) prepare(r *http.Request) {
+	if rand.Float64()*100 >= sp.config.ShadowPercent {
+		return
+	}
+	if r.ContentLength < 0 || r.ContentLength > sp.config.ShadowMaxBody {
+		sp.metrics.shadowRequests.WithLabelValues("skipped").Inc()
+		return
+	}
+	shadow := r.Clone(context.Background())
+	shadow.RequestURI = ""
+	if r.ContentLength == 0 {
+		shadow.Body = http.NoBody
+		go sp.mirror(shadow)
+		return
+	}
+	r.Body = &shadowBody{ReadCloser: r.Body, sp: sp, shadow: shadow}
+}
+
+// shadowBody copies the body of a request which is to be mirrored as it is
+// read, and mirrors the request once it has been read in full.
+type shadowBody struct {
+	io.ReadCloser
+	sp     *shadowPool
+	shadow *http.Request
+
+	mu   sync.Mutex
+	buf  bytes.Buffer
+	done bool // the request was mirrored, or won't be
+}
+
+func (b *shadowBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.done {
+		return n, err
+	}
+	b.buf.Write(p[:n])
+	switch {
+	case int64(b.buf.Len()) > b.shadow.ContentLength || err != nil && err != io.EOF:
+		b.done = true
+		b.sp.metrics.shadowRequests.WithLabelValues("skipped").Inc()
+	case err == io.EOF:
+		b.done = true
+		b.shadow.Body = ioutil.NopCloser(bytes.NewReader(b.buf.Bytes()))
+		go b.sp.mirror(b.shadow)
+	}
+	return n, err
+}
+
+// Close skips mirroring the request, unless its body was read in full, e.g.
+// because the worker responded without reading it.
+func (b *shadowBody) Close() error {
+	b.mu.Lock()
+	if !b.done {
+		b.done = true
+		b.sp.metrics.shadowRequests.WithLabelValues("skipped").Inc()
+	}
+	b.mu.Unlock()
+	return b.ReadCloser.Close()
+}
+
+// mirror sends a request copied by prepare to a shadow worker, discarding
+// the response. It never waits for a shadow worker to become available: if
+// none is, the request is dropped.
+func (sp *shadowPool) mirror(r *http.Request) {
+	w := sp.pool.tryAcquire()
+	if w == nil {
+		sp.metrics.shadowRequests.WithLabelValues("dropped").Inc()
+		return
+	}
+	defer sp.pool.release(w)
+
+	timeout := sp.requestTimeout(r)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	r = r.WithContext(context.WithValue(ctx, workerKey{}, w))
+	sp.rewriteRequestHeaders(r.Header)
+	sp.setDeadlineHeader(r)
+	r.URL.Scheme = "http"
+	r.URL.Host = w.addr()
+
+	resp, err := sp.client.Do(r)
+	if err != nil {
+		sp.metrics.shadowRequests.WithLabelValues("error").Inc()
+		if ctx.Err() != nil {
+			log.Printf("shadow worker %v: restarting due to timeout", w.pid)
+			w.kill(reasonTimeout)
+			return
+		}
+		log.Printf("shadow worker %v: %v", w.pid, err)
+		return
+	}
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	sp.metrics.shadowRequests.WithLabelValues("ok").Inc()
+}
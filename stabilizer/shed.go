@@ -0,0 +1,39 @@
+package stabilizer
+
+import (
+	"log"
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+// sampleLoadAverage samples the system load average every second, for use by
+// overloaded, until the stabilizer is shut down.
+func (s *Stabilizer) sampleLoadAverage() {
+	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
+	for {
+		load, err := readLoadAverage()
+		if err != nil {
+			log.Println("load average:", err)
+		} else {
+			atomic.StoreUint64(&s.loadAverage, math.Float64bits(load))
+		}
+		select {
+		case <-ticker.C:
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+// currentLoadAverage returns the most recently sampled load average.
+func (s *Stabilizer) currentLoadAverage() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&s.loadAverage))
+}
+
+// overloaded reports whether new requests should be shed because the system
+// load average exceeds MaxLoadAvg.
+func (s *Stabilizer) overloaded() bool {
+	return s.config.MaxLoadAvg > 0 && s.currentLoadAverage() > s.config.MaxLoadAvg
+}
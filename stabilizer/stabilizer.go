@@ -0,0 +1,1713 @@
+// Package stabilizer implements a reverse proxy which divides requests among
+// multiple copies of an HTTP server, restarting any copy which gets stuck.
+package stabilizer
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	oldfreeport "github.com/phayes/freeport"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	freeport "github.com/slimsag/freeport"
+)
+
+// Balancers which may be used for Config.Balancer.
+const (
+	BalancerRoundRobin     = "round-robin"
+	BalancerWeightedRandom = "weighted-random"
+)
+
+// Config configures a Stabilizer. Fields left as their zero value use the
+// documented default.
+type Config struct {
+	// Command is the worker command to run, and Args its arguments.
+	// "{{.Port}}" in Args is replaced with the port the worker must listen on.
+	// Relative paths, like that of FallbackCommand and ShadowCommand, are
+	// relative to the working directory when New is called rather than to
+	// WorkerDir, and New fails if the command is not executable.
+	Command string
+	Args    []string
+
+	// Workers is the number of worker subprocesses to spawn (default 8).
+	Workers int
+
+	// StaticWorkers, if not empty, is a list of host:port addresses of
+	// externally-managed workers to proxy to instead of spawning Command.
+	// Workers is then the number of addresses, and ReadyPath is required:
+	// rather than being restarted, workers which e.g. time out are taken
+	// out of rotation until they pass their readiness check again.
+	StaticWorkers []string
+
+	// Concurrency is the number of concurrent requests to allow per worker
+	// (default 10).
+	Concurrency int
+
+	// Balancer is how requests are divided among workers: BalancerRoundRobin
+	// (the default) or BalancerWeightedRandom.
+	Balancer string
+
+	// WorkerWeights are the weights of each worker by index for the
+	// weighted-random balancer. Workers without a weight have a weight of 1.
+	WorkerWeights []float64
+
+	// WorkerTags are labels of each worker by index (e.g. "canary" or
+	// "gpu"), for heterogeneous pools. Workers without a tag, or with an
+	// empty one, are untagged. Requests with the TagHeader request header
+	// set to a tag are only sent to workers with that tag, or if it is
+	// prefixed with "!" (e.g. "!canary"), to workers without it. Tagged
+	// requests skip the FairQueue. A worker's tag is sent in the
+	// X-Worker-Tag response header.
+	WorkerTags []string
+	TagHeader  string
+
+	// Timeout is how long a request to a worker may take before it is killed
+	// (default 10s).
+	Timeout time.Duration
+
+	// TimeoutHeader and TimeoutQuery are the request header and query
+	// parameter which may be used to override Timeout per request, if not
+	// empty. The header takes precedence. Timeouts which are not positive
+	// are ignored, and they are capped at TimeoutMax if non-zero.
+	TimeoutHeader string
+	TimeoutQuery  string
+
+	// ExtendTimeoutDuringUpload restarts the timeout of requests whenever
+	// more of their body is sent to the worker, so that a slow client
+	// uploading a large body isn't mistaken for a stuck worker. The timeout
+	// is then measured from when the body was sent completely, or from the
+	// last progress sending it.
+	ExtendTimeoutDuringUpload bool
+
+	// TimeoutPerByte, if non-zero, scales the timeout of requests with a
+	// known Content-Length to TimeoutBase (default Timeout) plus this much
+	// per byte of the request body, capped at TimeoutMax if non-zero. The
+	// timeout header and query parameter still take precedence, though they
+	// are capped at TimeoutMax too.
+	TimeoutPerByte time.Duration
+	TimeoutBase    time.Duration
+	TimeoutMax     time.Duration
+
+	// StripRequestHeaders are removed from requests before they are sent to
+	// workers (e.g. internal authentication headers), and SetRequestHeaders
+	// are then set on them, replacing any sent by the client.
+	StripRequestHeaders []string
+	SetRequestHeaders   http.Header
+
+	// StripResponseHeaders are removed from responses before they are sent
+	// to clients, and SetResponseHeaders are then set on them (e.g. CORS or
+	// X-Frame-Options), replacing any set by the worker. Both also apply to
+	// errors generated by the stabilizer itself.
+	StripResponseHeaders []string
+	SetResponseHeaders   http.Header
+
+	// Compress, if true, gzips responses for clients which accept it, if
+	// the worker didn't already encode them, their Content-Type is one of
+	// CompressTypes and they are at least CompressMinBytes (default 1024)
+	// long, or of unknown length. CompressTypes are media types, or e.g.
+	// "text/*" for all text types, and default to text types, JSON,
+	// JavaScript, XML and SVG. Event streams (text/event-stream) are never
+	// compressed.
+	Compress         bool
+	CompressMinBytes int64
+	CompressTypes    []string
+
+	// DeadlineHeader, if not empty, is the request header used to tell
+	// workers when their request will time out, as an RFC 3339 timestamp.
+	DeadlineHeader string
+
+	// KeepWorkersOnTimeout, if true, only fails requests which time out
+	// rather than also killing the worker.
+	KeepWorkersOnTimeout bool
+
+	// TimeoutDrainGrace, if non-zero, drains workers whose requests time out
+	// rather than killing them immediately, so that their other in-flight
+	// requests are given up to this long to finish before the worker is
+	// killed. Drained workers receive no new requests.
+	TimeoutDrainGrace time.Duration
+
+	// TimeoutSignal, if non-zero, is sent to workers before they are killed
+	// due to a timeout, e.g. SIGQUIT so that Go workers dump their goroutine
+	// stacks to their output, which is logged. They are then given
+	// TimeoutSignalGrace (default 1s) to exit on their own before being
+	// killed, during which they receive no new requests.
+	TimeoutSignal      syscall.Signal
+	TimeoutSignalGrace time.Duration
+
+	// MinHealthyUptime is how long a worker must stay alive to count as
+	// having started successfully (default 10s). Workers which crash, fail to
+	// become ready or fail their health checks sooner than this are restarted
+	// with exponential backoff, so that a crash-looping worker cannot
+	// hot-loop.
+	MinHealthyUptime time.Duration
+
+	// BrokenWorkerTimeouts, if non-zero, is the number of consecutive workers
+	// in the same slot which must time out within MinHealthyUptime of
+	// starting, without having responded to any request, for the slot to be
+	// considered broken: e.g. the worker accepts connections but hangs on
+	// every request. Broken workers are restarted with backoff (and count
+	// towards FallbackAfter) like crashing ones, rather than immediately.
+	BrokenWorkerTimeouts int
+
+	// ReadyPath, if not empty, is a path which workers must respond to GET
+	// requests for with 200 OK before receiving requests.
+	ReadyPath string
+
+	// ReadyCommand, if not empty, is run with ReadyArgs until it exits
+	// successfully before workers receive requests, as an alternative to
+	// ReadyPath for workers without an HTTP readiness endpoint. "{{.PID}}",
+	// "{{.Port}}" and "{{.Index}}" in ReadyArgs are replaced with the
+	// worker's details.
+	ReadyCommand string
+	ReadyArgs    []string
+
+	// ReadyTimeout is how long to wait for a worker to become ready before
+	// restarting it (default 30s).
+	ReadyTimeout time.Duration
+
+	// HealthCheckInterval, if non-zero, is how often to check that workers
+	// still respond to ReadyPath. Workers are restarted after
+	// HealthCheckFailures (default 3) consecutive failures.
+	HealthCheckInterval time.Duration
+	HealthCheckFailures int
+
+	// BreakerFailures, if non-zero, is the number of consecutive failed
+	// requests after which a worker's circuit breaker opens, taking it out
+	// of rotation for BreakerCooldown (default 10s) without restarting it.
+	// Requests which time out or otherwise fail to get a response count as
+	// failures, as do responses with one of BreakerStatusCodes (by default,
+	// any 5xx status code). Other responses, e.g. 404s, reset the count.
+	BreakerFailures    int
+	BreakerCooldown    time.Duration
+	BreakerStatusCodes []int
+
+	// DrainWorkerTimeout is how long a drained worker may finish in-flight
+	// requests before it is killed anyway (zero means wait forever).
+	DrainWorkerTimeout time.Duration
+
+	// RedactCommandArgs, if set, logs only the name of the worker command at
+	// startup rather than the full command, since its arguments may contain
+	// secrets. Even otherwise, the values of arguments which look like they
+	// contain secrets, e.g. "-api-key=..." or "--password ...", are redacted.
+	RedactCommandArgs bool
+
+	// WorkerDir, if not empty, is the working directory of workers. "{{.Index}}"
+	// and "{{.Port}}" in it are replaced with the worker's index and port, in
+	// which case the directory is created if it does not exist.
+	WorkerDir string
+
+	// NoSetpgid spawns workers in our own process group, rather than a new
+	// one. Subprocesses of workers may then not be killed.
+	NoSetpgid bool
+
+	// WatchBinary watches Command (as changed by any Reload) for changes on
+	// disk, and recycles all workers once it has stopped changing for
+	// WatchBinaryDebounce (default 5s).
+	WatchBinary         bool
+	WatchBinaryDebounce time.Duration
+
+	// RecycleParallelism is how many workers are recycled at a time when
+	// recycling all workers, e.g. due to WatchBinary (default 1).
+	RecycleParallelism int
+
+	// WorkerHostHeader is the Host header sent to workers: "preserve" (the
+	// default, the client's), "rewrite" (to the worker's address), or a
+	// literal value.
+	WorkerHostHeader string
+
+	// MaxLoadAvg, if non-zero, rejects new requests while the 1-minute system
+	// load average exceeds it (Linux only).
+	MaxLoadAvg float64
+
+	// ErrorTemplates, if not empty, is a directory of custom error response
+	// templates named by error code, e.g. hss_worker_timeout.html.
+	ErrorTemplates string
+
+	// MaxWorkerIdle, if non-zero, is how long a worker may go without serving
+	// a request before it is gracefully recycled.
+	MaxWorkerIdle time.Duration
+
+	// MaxOverflowWorkers, if non-zero, is how many temporary workers may be
+	// started beyond Workers to absorb bursts of traffic. One is started
+	// whenever a request has waited OverflowAfter (default 1s) for a free
+	// worker, unless those already starting will absorb the queued requests,
+	// and it is stopped once it has been idle for OverflowIdle (default 30s).
+	// Overflow workers are not restarted if they die. It cannot be used with
+	// StaticWorkers.
+	MaxOverflowWorkers int
+	OverflowAfter      time.Duration
+	OverflowIdle       time.Duration
+
+	// MemoryHighWatermark, if non-zero, is the fraction (e.g. 0.9) of the
+	// cgroup memory limit above which the worker using the most memory is
+	// recycled, before the whole container is OOM-killed (Linux only).
+	MemoryHighWatermark float64
+
+	// PostStopCommand, if not empty, is run with PostStopArgs whenever a
+	// worker dies, for whatever reason, e.g. to clean up after it.
+	// "{{.PID}}", "{{.Port}}", "{{.Index}}" and "{{.Reason}}" in
+	// PostStopArgs are replaced with the worker's details. It runs in the
+	// background, so it does not delay the worker being restarted, and is
+	// killed if it takes longer than a minute. Shutdown waits for it.
+	PostStopCommand string
+	PostStopArgs    []string
+
+	// FallbackCommand, if not empty, is a known-good worker command (with
+	// FallbackArgs) which a worker slot switches to after FallbackAfter
+	// (default 5) consecutive workers failed to start, e.g. during a bad
+	// deploy. After FallbackRecheck (default 5m) the primary command is
+	// retried, falling back again if it still fails.
+	FallbackCommand string
+	FallbackArgs    []string
+	FallbackAfter   int
+	FallbackRecheck time.Duration
+
+	// MetricsPath, if not empty, is a path which Prometheus metrics are
+	// served at instead of being proxied to workers.
+	MetricsPath string
+
+	// HealthPath, if not empty, is a path at which the health state of the
+	// stabilizer is served instead of being proxied to workers: HealthHealthy
+	// if all workers are ready, HealthDegraded if only some are, or
+	// HealthUnhealthy if none are (or we are shutting down). It responds with
+	// 503 Service Unavailable if unhealthy, and HealthPath+"/strict" also
+	// does so if degraded.
+	HealthPath string
+
+	// ShadowCommand, if not empty, spawns ShadowWorkers (default 1) shadow
+	// workers with ShadowArgs, and mirrors ShadowPercent (default 100) percent
+	// of requests to them, discarding their responses. Request bodies are
+	// copied as they are sent to the real worker, and the request is only
+	// mirrored once its whole body has been read; requests with bodies
+	// larger than ShadowMaxBody (default 1MB) are not mirrored.
+	ShadowCommand string
+	ShadowArgs    []string
+	ShadowWorkers int
+	ShadowPercent float64
+	ShadowMaxBody int64
+
+	// VerifyResponseMaxBody, if non-zero, buffers worker responses with a
+	// Content-Length of at most this many bytes, so that responses truncated
+	// by the worker dying fail with a 502 (or are retried) rather than being
+	// passed on to the client.
+	VerifyResponseMaxBody int64
+
+	// MaxResponseBytes, if non-zero, caps the size of worker response bodies.
+	// Responses declaring a larger Content-Length fail with a 502, and others
+	// are truncated once they exceed it by resetting the client connection.
+	MaxResponseBytes int64
+
+	// MaxBodyBytes, if non-zero, caps the size of request bodies. Requests
+	// declaring a larger Content-Length are rejected with a 413 Payload Too
+	// Large and the error code hss_body_too_large before reaching a worker,
+	// and those of unknown length fail the same way once they exceed it.
+	MaxBodyBytes int64
+
+	// WorkerKeepAlive is the TCP keep-alive period of connections to workers
+	// (default 30s, negative disables keep-alives).
+	WorkerKeepAlive time.Duration
+
+	// WorkerDisableKeepAlives opens a new connection to the worker for every
+	// request, rather than reusing idle connections.
+	WorkerDisableKeepAlives bool
+
+	// WorkerTCPNagle enables Nagle's algorithm on connections to workers,
+	// i.e. disables TCP_NODELAY, which is otherwise set so that small
+	// requests and responses are sent without delay.
+	WorkerTCPNagle bool
+
+	// WorkerOutputBuffer is the number of lines of worker output buffered
+	// before the oldest are dropped (default 1000), so that workers are never
+	// blocked writing to stdout or stderr if logging falls behind.
+	WorkerOutputBuffer int
+
+	// WorkerStartupOutput is the number of initial lines of each worker's
+	// output to keep for the lifetime of the worker and show in
+	// /debug/workers, e.g. to see the version or configuration it printed
+	// at startup. By default none are kept.
+	WorkerStartupOutput int
+
+	// WorkerOutputRequestID, if not empty, is a regular expression matched
+	// against each line of worker output to extract a request ID which the
+	// worker echoed, e.g. from an X-Request-ID request header: its first
+	// submatch, or the whole match if it has none. Matching lines are logged
+	// tagged with request_id=<ID>, so that they can be correlated with the
+	// request.
+	WorkerOutputRequestID string
+
+	// WorkerMaxConns, if non-zero, is the maximum number of TCP connections
+	// to each worker.
+	WorkerMaxConns int
+
+	// Variant, if not empty, is a short label identifying this set of workers
+	// (e.g. "canary") which is sent in the X-Worker-Variant response header
+	// alongside X-Worker. It is used instead of the worker's arguments, which
+	// may contain secrets.
+	Variant string
+
+	// Retries is the number of times a failed request is retried on another
+	// worker (default 0). Requests which time out are never retried, and
+	// requests which reached the worker are only retried for idempotent
+	// methods. Retrying requires buffering request bodies, so requests with
+	// bodies larger than RetryMaxBody (default 1MB) or of unknown size are not
+	// retried, and fail with hss_not_retryable instead.
+	Retries      int
+	RetryMaxBody int64
+
+	// QueueTimeout, if non-zero, is how long a request may wait for a worker
+	// to become available before failing with hss_queue_timeout.
+	QueueTimeout time.Duration
+
+	// RequestDeadline, if non-zero, bounds the total time spent on a
+	// request, including waiting for a worker and any Retries, after which
+	// it fails with a 504 Gateway Timeout and the error code
+	// hss_request_deadline. Unlike Timeout, which applies to each attempt,
+	// the worker is not killed when it is exceeded, since it was not
+	// necessarily stuck.
+	RequestDeadline time.Duration
+
+	// FairQueue hands out workers to queued requests strictly in the order
+	// they arrived. Otherwise, queued requests are woken up in the order they
+	// arrived when a worker becomes available, but a request which arrives in
+	// the meantime may get the worker first, so under sustained load an
+	// unlucky request may wait much longer than ones which arrived after it.
+	FairQueue bool
+
+	// ReservedWorkers, if non-zero, is the number of workers (those with the
+	// lowest indexes) which are only handed out to high-priority requests,
+	// so that e.g. health-critical traffic always has capacity even when
+	// other requests saturate the rest of the pool. High-priority requests
+	// are those with a non-empty PriorityHeader, or whose path matches
+	// PriorityPaths (as for DenyPaths). They use unreserved workers when
+	// available, falling back to reserved ones, and skip the FairQueue.
+	ReservedWorkers int
+	PriorityHeader  string
+	PriorityPaths   []string
+
+	// BalanceDebug logs which worker was selected for each request, along
+	// with its in-flight requests at the time, as space-separated key=value
+	// pairs prefixed by "balance:", for auditing the balancer.
+	BalanceDebug bool
+
+	// DebugHeaders logs the full headers of each request as it is sent to a
+	// worker (including those added by the stabilizer, such as
+	// X-Forwarded-For and Host) and of the worker's response as it was
+	// received, for diagnosing header propagation. The values of the
+	// headers in DebugHeadersRedact (by default Authorization, Cookie,
+	// Proxy-Authorization and Set-Cookie), and of AuthHeader, are redacted.
+	DebugHeaders       bool
+	DebugHeadersRedact []string
+
+	// ColdStart is how requests are handled while no workers are ready,
+	// e.g. before the first worker has started: ColdStartBlock (the default)
+	// queues them as usual, ColdStartFast503 fails them immediately, and
+	// ColdStartWaitWithTimeout waits up to ColdStartTimeout (default 10s)
+	// for a worker to become ready before failing them. Such failures use
+	// the hss_no_workers_ready error code.
+	ColdStart        string
+	ColdStartTimeout time.Duration
+
+	// AuthTokens, if not empty, are the shared secrets which requests must
+	// present in the AuthHeader request header (default X-Auth-Token) to be
+	// proxied to workers. Other requests are rejected with hss_unauthorized.
+	AuthTokens []string
+	AuthHeader string
+
+	// PerClientConcurrency, if non-zero, is the number of requests each
+	// client may have in flight (including queued) at a time, so that one
+	// client can't monopolize the pool. Further requests are rejected with
+	// a 429 Too Many Requests and the error code hss_client_concurrency.
+	// Clients are identified by the value of their ClientHeader request
+	// header (default AuthHeader), and requests without one are not
+	// limited.
+	PerClientConcurrency int
+	ClientHeader         string
+
+	// DenyPaths and AllowPaths restrict which request paths are proxied to
+	// workers. Entries beginning with ^ are regular expressions matched
+	// against the path, and all others are path prefixes. Requests matching
+	// DenyPaths are rejected with a 403, and if AllowPaths is not empty,
+	// requests not matching it are rejected with a 404. DenyPaths takes
+	// precedence over AllowPaths.
+	DenyPaths  []string
+	AllowPaths []string
+
+	// DebugHeaderCIDRs, if not empty, limits the X-Worker and
+	// X-Worker-Variant response headers to clients whose IP address is in
+	// one of these CIDR ranges (e.g. "10.0.0.0/8"), since they reveal
+	// details of the workers. They are removed from responses to other
+	// clients. By default they are sent to all clients.
+	DebugHeaderCIDRs []string
+
+	// MaxTotalRestarts, if not zero, is the number of worker restarts
+	// within MaxTotalRestartsWindow (default 10m) beyond which the pool is
+	// considered to be persistently broken, e.g. by a bad deploy, rather
+	// than merely having a few bad workers. A warning is then logged and
+	// OnRestartLimit is called, once, typically to exit so that the
+	// instance is taken out of service. Workers recycled deliberately, e.g.
+	// due to WatchBinary, MaxWorkerIdle, memory pressure or the admin API,
+	// don't count.
+	MaxTotalRestarts       int
+	MaxTotalRestartsWindow time.Duration
+	OnRestartLimit         func(restarts int)
+
+	// OnOutcome, if not nil, is called with the Outcome of each request sent
+	// to a worker, e.g. to feed analytics. It is called from a single
+	// goroutine, asynchronously so that it never adds latency to requests:
+	// if it falls behind, outcomes are dropped.
+	OnOutcome func(Outcome)
+
+	// Record, if not nil, is where each request sent to a worker and the
+	// worker's response are written as a JSON-encoded Recording per line,
+	// once the response has been sent to the client. Bodies are recorded in
+	// full, so this is meant for capturing traffic to replay in tests with
+	// NewReplayHandler, not for production use.
+	Record io.Writer
+
+	// PauseRetryAfter is the Retry-After sent with responses to requests
+	// received while paused (default 10s), see Pause.
+	PauseRetryAfter time.Duration
+
+	// AdminToken, if not empty, is the bearer token required by AdminHandler.
+	AdminToken string
+
+	// PrometheusAppName is the Prometheus namespace of all metrics, which
+	// are in the "hss" subsystem (e.g. myapp_hss_worker_restarts), and
+	// Registerer is where they are registered (default
+	// prometheus.DefaultRegisterer). Multiple Stabilizers must use distinct
+	// app names or registerers.
+	PrometheusAppName string
+	Registerer        prometheus.Registerer
+}
+
+// withDefaults returns a copy of c with defaults applied.
+func (c Config) withDefaults() Config {
+	if c.Workers == 0 {
+		c.Workers = 8
+	}
+	if c.Concurrency == 0 {
+		c.Concurrency = 10
+	}
+	if c.BreakerCooldown == 0 {
+		c.BreakerCooldown = 10 * time.Second
+	}
+	if c.PauseRetryAfter == 0 {
+		c.PauseRetryAfter = 10 * time.Second
+	}
+	if c.ColdStart == "" {
+		c.ColdStart = ColdStartBlock
+	}
+	if c.ColdStartTimeout == 0 {
+		c.ColdStartTimeout = 10 * time.Second
+	}
+	if c.Balancer == "" {
+		c.Balancer = BalancerRoundRobin
+	}
+	if c.Timeout == 0 {
+		c.Timeout = 10 * time.Second
+	}
+	if c.TimeoutBase == 0 {
+		c.TimeoutBase = c.Timeout
+	}
+	if c.MinHealthyUptime == 0 {
+		c.MinHealthyUptime = 10 * time.Second
+	}
+	if c.ReadyTimeout == 0 {
+		c.ReadyTimeout = 30 * time.Second
+	}
+	if c.HealthCheckFailures == 0 {
+		c.HealthCheckFailures = 3
+	}
+	if c.WatchBinaryDebounce == 0 {
+		c.WatchBinaryDebounce = 5 * time.Second
+	}
+	if c.RecycleParallelism == 0 {
+		c.RecycleParallelism = 1
+	}
+	if c.WorkerHostHeader == "" {
+		c.WorkerHostHeader = "preserve"
+	}
+	if c.ShadowWorkers == 0 {
+		c.ShadowWorkers = 1
+	}
+	if c.ShadowPercent == 0 {
+		c.ShadowPercent = 100
+	}
+	if c.ShadowMaxBody == 0 {
+		c.ShadowMaxBody = 1 << 20
+	}
+	if c.RetryMaxBody == 0 {
+		c.RetryMaxBody = 1 << 20
+	}
+	if c.FallbackAfter == 0 {
+		c.FallbackAfter = 5
+	}
+	if c.FallbackRecheck == 0 {
+		c.FallbackRecheck = 5 * time.Minute
+	}
+	if c.DebugHeadersRedact == nil {
+		c.DebugHeadersRedact = defaultDebugHeadersRedact
+	}
+	if c.CompressMinBytes == 0 {
+		c.CompressMinBytes = 1024
+	}
+	if c.CompressTypes == nil {
+		c.CompressTypes = defaultCompressTypes
+	}
+	if c.TimeoutSignalGrace == 0 {
+		c.TimeoutSignalGrace = 1 * time.Second
+	}
+	if c.MaxTotalRestartsWindow == 0 {
+		c.MaxTotalRestartsWindow = 10 * time.Minute
+	}
+	if c.OverflowAfter == 0 {
+		c.OverflowAfter = 1 * time.Second
+	}
+	if c.OverflowIdle == 0 {
+		c.OverflowIdle = 30 * time.Second
+	}
+	if c.AuthHeader == "" {
+		c.AuthHeader = "X-Auth-Token"
+	}
+	if c.ClientHeader == "" {
+		c.ClientHeader = c.AuthHeader
+	}
+	if c.WorkerKeepAlive == 0 {
+		c.WorkerKeepAlive = 30 * time.Second
+	}
+	if c.WorkerOutputBuffer == 0 {
+		c.WorkerOutputBuffer = 1000
+	}
+	if c.Registerer == nil {
+		c.Registerer = prometheus.DefaultRegisterer
+	}
+	return c
+}
+
+// Stabilizer runs multiple copies of an HTTP server (workers) and acts as a
+// reverse proxy to them, restarting any worker which a request times out on.
+type Stabilizer struct {
+	// config is the configuration given to New. Fields which Reload may
+	// change (see reloadableFields) must be read via current instead.
+	config Config
+
+	reloadMu sync.Mutex   // serializes Reload
+	reloaded atomic.Value // *Config, as last applied by Reload
+
+	ctx    context.Context // canceled to kill all workers
+	cancel func()
+	wg     sync.WaitGroup // of the goroutines managing each worker
+
+	commandTargetsMu sync.Mutex
+	commandTargets   map[string]string // binary each command last resolved to, see resolveCommand
+
+	recycleMu sync.Mutex
+	recycle   recycleStatus // progress of the current or last recycle
+
+	shutdownMu sync.Mutex
+	resume     chan struct{} // closed by CancelShutdown, nil unless Shutdown may be canceled
+
+	proxy           *httputil.ReverseProxy
+	metrics         *metrics
+	metricsHandler  http.Handler    // served at MetricsPath, if set
+	errorPages      *errorTemplates // custom error responses, if any
+	shadow          *shadowPool     // requests are mirrored to, if set
+	denyPaths       *pathMatcher    // from DenyPaths, if set
+	allowPaths      *pathMatcher    // from AllowPaths, if set
+	priorityPaths   *pathMatcher    // from PriorityPaths, if set
+	outputRequestID *regexp.Regexp  // from WorkerOutputRequestID, if set
+	debugNets       []*net.IPNet    // from DebugHeaderCIDRs
+	breakerStatus   map[int]bool    // from BreakerStatusCodes, if set
+	pool            *pool
+	poolName        string       // primary or shadow, for metrics
+	spawn           spawnFunc    // starts workers, replaced by tests
+	loadAverage     uint64       // float64 bits, accessed atomically
+	maxQueueWait    int64        // longest time.Duration spent in acquire, accessed atomically
+	shuttingDown    int32        // accessed atomically
+	paused          int32        // accessed atomically
+	fallbackSlots   int32        // worker slots using FallbackCommand, accessed atomically
+	outcomes        chan Outcome // queued for OnOutcome, if set
+	recorder        *recorder    // writes to Record, if set
+	restartLimit    restartLimiter
+	conns           workerConns // to workers, by address
+	clients         clientLimiter
+	overflow        overflowWorkers
+}
+
+// New returns a new Stabilizer. Workers are not spawned until Start is called.
+func New(config Config) (*Stabilizer, error) {
+	if len(config.StaticWorkers) > 0 {
+		if config.Command != "" {
+			return nil, errors.New("StaticWorkers and Command are mutually exclusive")
+		}
+		if config.ReadyPath == "" {
+			return nil, errors.New("StaticWorkers requires ReadyPath")
+		}
+		if config.WatchBinary || config.FallbackCommand != "" || config.MemoryHighWatermark > 0 || config.MaxOverflowWorkers > 0 {
+			return nil, errors.New("StaticWorkers cannot be used with WatchBinary, FallbackCommand, MemoryHighWatermark or MaxOverflowWorkers, which manage local processes")
+		}
+		if err := parseStaticWorkers(config.StaticWorkers); err != nil {
+			return nil, fmt.Errorf("StaticWorkers: %v", err)
+		}
+		config.Workers = len(config.StaticWorkers)
+	}
+	config = config.withDefaults()
+	if config.Command == "" && len(config.StaticWorkers) == 0 {
+		return nil, errors.New("no worker command specified")
+	}
+	for _, c := range []struct {
+		name    string
+		command *string
+	}{
+		{"Command", &config.Command},
+		{"FallbackCommand", &config.FallbackCommand},
+		{"ShadowCommand", &config.ShadowCommand},
+	} {
+		if *c.command == "" {
+			continue
+		}
+		var err error
+		if *c.command, err = absCommand(*c.command); err != nil {
+			return nil, fmt.Errorf("%s: %v", c.name, err)
+		}
+	}
+	switch config.ColdStart {
+	case ColdStartBlock, ColdStartFast503, ColdStartWaitWithTimeout:
+	default:
+		return nil, fmt.Errorf("unknown ColdStart %q", config.ColdStart)
+	}
+	if config.ReservedWorkers < 0 || config.ReservedWorkers >= config.Workers {
+		return nil, fmt.Errorf("invalid ReservedWorkers %v, must be less than Workers (%v)", config.ReservedWorkers, config.Workers)
+	}
+	if config.MaxOverflowWorkers < 0 {
+		return nil, fmt.Errorf("invalid MaxOverflowWorkers %v", config.MaxOverflowWorkers)
+	}
+	if config.PerClientConcurrency < 0 {
+		return nil, fmt.Errorf("invalid PerClientConcurrency %v", config.PerClientConcurrency)
+	}
+	if config.MaxTotalRestarts < 0 {
+		return nil, fmt.Errorf("invalid MaxTotalRestarts %v", config.MaxTotalRestarts)
+	}
+	if config.RecycleParallelism < 0 {
+		return nil, fmt.Errorf("invalid RecycleParallelism %v", config.RecycleParallelism)
+	}
+	if config.ReadyCommand != "" && config.ReadyPath != "" {
+		return nil, errors.New("ReadyCommand and ReadyPath are mutually exclusive")
+	}
+	if config.HealthCheckInterval > 0 && config.ReadyPath == "" {
+		return nil, errors.New("HealthCheckInterval requires ReadyPath")
+	}
+	if len(config.WorkerTags) > config.Workers {
+		return nil, fmt.Errorf("%d worker tags specified but only %d workers", len(config.WorkerTags), config.Workers)
+	}
+	if len(config.WorkerWeights) > config.Workers {
+		return nil, fmt.Errorf("%d worker weights specified but only %d workers", len(config.WorkerWeights), config.Workers)
+	}
+	weights := make([]float64, config.Workers+config.MaxOverflowWorkers)
+	for i := range weights {
+		weights[i] = 1
+		if i < len(config.WorkerWeights) {
+			weights[i] = config.WorkerWeights[i]
+		}
+		if !validWeight(weights[i]) {
+			return nil, fmt.Errorf("invalid weight %v", weights[i])
+		}
+	}
+	pool, err := newPool(config.Balancer, config.Concurrency, weights, config.FairQueue, config.ReservedWorkers, config.WorkerTags)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Stabilizer{
+		config:   config,
+		pool:     pool,
+		poolName: "primary",
+	}
+	s.spawn = s.spawnProcess
+	if len(config.StaticWorkers) > 0 {
+		s.spawn = s.spawnStatic
+	}
+	if config.BreakerStatusCodes != nil {
+		s.breakerStatus = make(map[int]bool)
+		for _, code := range config.BreakerStatusCodes {
+			s.breakerStatus[code] = true
+		}
+	}
+	for _, cidr := range config.DebugHeaderCIDRs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("DebugHeaderCIDRs: %v", err)
+		}
+		s.debugNets = append(s.debugNets, ipNet)
+	}
+	if config.OnOutcome != nil {
+		s.outcomes = make(chan Outcome, outcomeQueueSize)
+	}
+	if config.Record != nil {
+		s.recorder = &recorder{enc: json.NewEncoder(config.Record)}
+	}
+	if s.denyPaths, err = newPathMatcher(config.DenyPaths); err != nil {
+		return nil, fmt.Errorf("DenyPaths: %v", err)
+	}
+	if s.allowPaths, err = newPathMatcher(config.AllowPaths); err != nil {
+		return nil, fmt.Errorf("AllowPaths: %v", err)
+	}
+	if s.priorityPaths, err = newPathMatcher(config.PriorityPaths); err != nil {
+		return nil, fmt.Errorf("PriorityPaths: %v", err)
+	}
+	if config.WorkerOutputRequestID != "" {
+		if s.outputRequestID, err = regexp.Compile(config.WorkerOutputRequestID); err != nil {
+			return nil, fmt.Errorf("WorkerOutputRequestID: %v", err)
+		}
+	}
+	if config.ErrorTemplates != "" {
+		s.errorPages, err = loadErrorTemplates(config.ErrorTemplates)
+		if err != nil {
+			return nil, fmt.Errorf("loading error templates: %v", err)
+		}
+	}
+	if config.MetricsPath != "" {
+		s.metricsHandler = promhttp.Handler()
+	}
+	s.metrics = newMetrics(s)
+	if config.ShadowCommand != "" {
+		s.shadow, err = newShadowPool(s)
+		if err != nil {
+			return nil, fmt.Errorf("shadow pool: %v", err)
+		}
+	}
+	var transport http.RoundTripper = s.newTransport()
+	if config.DebugHeaders {
+		transport = &headerLogger{s: s, next: transport}
+	}
+	s.proxy = &httputil.ReverseProxy{
+		Director:       s.director,
+		Transport:      transport,
+		ModifyResponse: s.modifyResponse,
+		ErrorHandler:   s.errorHandler,
+	}
+	return s, nil
+}
+
+// Start spawns the workers, which are killed when ctx is canceled or Shutdown
+// is called.
+func (s *Stabilizer) Start(ctx context.Context) error {
+	if s.ctx != nil {
+		return errors.New("already started")
+	}
+	if s.config.MaxLoadAvg > 0 {
+		if _, err := readLoadAverage(); err != nil {
+			return err
+		}
+	}
+	if s.config.MemoryHighWatermark > 0 {
+		if err := checkCgroupMemory(); err != nil {
+			return err
+		}
+	}
+	s.ctx, s.cancel = context.WithCancel(ctx)
+	if s.shadow != nil {
+		s.shadow.ctx = s.ctx
+		s.shadow.ensureWorkers(s.shadow.config.Workers)
+	}
+	s.ensureWorkers(s.config.Workers)
+	if s.config.MaxLoadAvg > 0 {
+		go s.sampleLoadAverage()
+	}
+	if s.outcomes != nil {
+		go s.reportOutcomes()
+	}
+	if s.config.MaxWorkerIdle > 0 {
+		go s.recycleIdleWorkers()
+	}
+	if s.config.MemoryHighWatermark > 0 {
+		go s.watchMemory()
+	}
+	if s.config.WatchBinary {
+		go s.watchBinary(s.config.WatchBinaryDebounce)
+	}
+	return nil
+}
+
+// ErrShutdownCanceled is returned by Shutdown if CancelShutdown is called.
+var ErrShutdownCanceled = errors.New("shutdown canceled")
+
+// Shutdown stops accepting new requests, waits for in-flight requests to
+// finish and then kills all workers. If ctx is canceled first, workers are
+// killed immediately and ctx's error is returned. If CancelShutdown is called
+// while waiting for in-flight requests, ErrShutdownCanceled is returned and
+// the workers are kept.
+func (s *Stabilizer) Shutdown(ctx context.Context) error {
+	resume := make(chan struct{})
+	start := time.Now()
+	s.shutdownMu.Lock()
+	atomic.StoreInt32(&s.shuttingDown, 1)
+	s.resume = resume
+	s.shutdownMu.Unlock()
+	var err error
+	for {
+		inflight, changed := s.pool.inflight()
+		if inflight == 0 {
+			break
+		}
+		select {
+		case <-changed:
+			continue
+		case <-resume:
+			return ErrShutdownCanceled
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+		break
+	}
+	s.shutdownMu.Lock()
+	if s.resume != resume {
+		// Canceled just as the last request finished.
+		s.shutdownMu.Unlock()
+		return ErrShutdownCanceled
+	}
+	s.resume = nil
+	s.shutdownMu.Unlock()
+	s.metrics.drainDuration.WithLabelValues("shutdown").Observe(time.Since(start).Seconds())
+	if s.cancel != nil {
+		s.cancel()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		if s.shadow != nil {
+			s.shadow.wg.Wait()
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	return err
+}
+
+// CancelShutdown cancels an in-progress Shutdown which is still waiting for
+// in-flight requests to finish, so that new requests are accepted again. It
+// reports whether there was such a Shutdown to cancel.
+func (s *Stabilizer) CancelShutdown() bool {
+	s.shutdownMu.Lock()
+	defer s.shutdownMu.Unlock()
+	if s.resume == nil {
+		return false
+	}
+	close(s.resume)
+	s.resume = nil
+	atomic.StoreInt32(&s.shuttingDown, 0)
+	return true
+}
+
+func templateArgs(args []string, port string) []string {
+	var v []string
+	for _, arg := range args {
+		v = append(v, strings.Replace(arg, "{{.Port}}", port, -1))
+	}
+	return v
+}
+
+// spawnFunc starts a new worker with the given index, which should listen on
+// port, using FallbackCommand if fallback is true. It is a field of Stabilizer
+// so that tests can substitute in-process workers (see newWorker) for real
+// subprocesses.
+type spawnFunc func(ctx context.Context, index, port int, fallback bool) *worker
+
+// spawnProcess is the default spawnFunc, which runs the worker command.
+func (s *Stabilizer) spawnProcess(ctx context.Context, index, port int, fallback bool) *worker {
+	config := s.current()
+	command, args := config.Command, config.Args
+	if fallback {
+		command, args = s.config.FallbackCommand, s.config.FallbackArgs
+	}
+	args = templateArgs(args, fmt.Sprint(port))
+	dir := s.config.WorkerDir
+	if strings.Contains(dir, "{{") {
+		dir = strings.Replace(dir, "{{.Index}}", fmt.Sprint(index), -1)
+		dir = strings.Replace(dir, "{{.Port}}", fmt.Sprint(port), -1)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			log.Printf("worker spawn: %v", err)
+		}
+	}
+	s.resolveCommand(command)
+	output := newOutputBuffer(s.config.WorkerOutputBuffer, s.metrics.workerOutputDropped.Inc, s.config.WorkerStartupOutput)
+	return spawnWorker(ctx, !s.config.NoSetpgid, dir, output, s.outputRequestID, port, command, args...)
+}
+
+// workerKey is the context key of the worker acquired for a request.
+type workerKey struct{}
+
+// acquire waits for a worker to become available for r, for at most
+// QueueTimeout (if set), and reserves it. If avoid is not nil, another worker
+// is preferred over it, e.g. when retrying a request which failed on it.
+func (s *Stabilizer) acquire(r *http.Request, avoid *worker) (*worker, error) {
+	ctx := r.Context()
+	if timeout := s.current().QueueTimeout; timeout > 0 {
+		var cancel func()
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	if s.config.MaxOverflowWorkers > 0 {
+		timer := time.AfterFunc(s.config.OverflowAfter, s.spawnOverflow)
+		defer timer.Stop()
+	}
+	start := time.Now()
+	d := s.demand(r)
+	d.avoid = avoid
+	w, inflight, err := s.pool.acquire(ctx, d)
+	wait := time.Since(start)
+	s.metrics.queueWait.Observe(wait.Seconds())
+	for {
+		max := atomic.LoadInt64(&s.maxQueueWait)
+		if int64(wait) <= max || atomic.CompareAndSwapInt64(&s.maxQueueWait, max, int64(wait)) {
+			break
+		}
+	}
+	if err == nil {
+		if tag := s.pool.tag(w); tag != "" {
+			s.metrics.taggedRequests.WithLabelValues(tag).Inc()
+		}
+	}
+	if s.config.BalanceDebug && err == nil {
+		log.Printf("balance: method=%s path=%q worker=%d pid=%d addr=%s inflight=%d concurrency=%d balancer=%s wait=%.6f",
+			r.Method, r.URL.Path, w.index, w.pid, w.addr(), inflight, w.concurrency, s.current().Balancer, wait.Seconds())
+	}
+	return w, err
+}
+
+// demand returns which workers r may be handed out.
+func (s *Stabilizer) demand(r *http.Request) demand {
+	d := demand{priority: s.isPriority(r)}
+	if s.config.TagHeader != "" {
+		d.tag = r.Header.Get(s.config.TagHeader)
+		if strings.HasPrefix(d.tag, "!") {
+			d.tag, d.avoidTag = d.tag[1:], true
+		}
+	}
+	return d
+}
+
+// isPriority reports whether r is a high-priority request, which may be
+// handed out reserved workers (see ReservedWorkers).
+func (s *Stabilizer) isPriority(r *http.Request) bool {
+	if s.config.PriorityHeader != "" && r.Header.Get(s.config.PriorityHeader) != "" {
+		return true
+	}
+	return s.priorityPaths != nil && s.priorityPaths.match(r.URL.Path)
+}
+
+func (s *Stabilizer) release(w *worker) {
+	s.pool.release(w)
+}
+
+// killWorker kills w for reason. If it is being killed due to a timeout and
+// TimeoutSignal is set, it is first sent that signal and given
+// TimeoutSignalGrace to exit on its own, so that e.g. a Go worker can dump its
+// goroutine stacks to show why it was stuck. If it does exit, killWorker
+// returns once all of its output (e.g. the stack dump) has been logged.
+func (s *Stabilizer) killWorker(w *worker, reason string) {
+	if reason == reasonTimeout && s.config.TimeoutSignal != 0 && w.cmd != nil {
+		w.setReason(reason)
+		log.Printf("worker %v: sending %v signal before killing", w.pid, s.config.TimeoutSignal)
+		if err := w.signal(w.pid, s.config.TimeoutSignal); err != nil {
+			log.Printf("worker %v: sending %v signal: %v", w.pid, s.config.TimeoutSignal, err)
+		}
+		select {
+		case <-w.done:
+			select {
+			case <-w.logged:
+			case <-time.After(outputDrainTimeout):
+			}
+		case <-time.After(s.config.TimeoutSignalGrace):
+		}
+	}
+	w.kill(reason)
+}
+
+// drainWorker waits for the in-flight requests of a draining worker to finish
+// and then kills it, so that it is restarted. If they do not finish within
+// timeout (if non-zero), the worker is killed anyway.
+func (s *Stabilizer) drainWorker(w *worker, reason string, timeout time.Duration) {
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		deadline = time.After(timeout)
+	}
+	log.Printf("worker %v: draining", w.pid)
+	start := time.Now()
+	defer func() {
+		s.metrics.drainDuration.WithLabelValues(reason).Observe(time.Since(start).Seconds())
+	}()
+	for {
+		idle, changed := s.pool.idle(w)
+		if idle {
+			if w.overflow {
+				log.Printf("worker %v: drained, stopping", w.pid)
+			} else {
+				log.Printf("worker %v: drained, restarting", w.pid)
+			}
+			s.metrics.workerDrains.Inc()
+			s.killWorker(w, reason)
+			return
+		}
+		select {
+		case <-changed:
+		case <-w.done:
+			return
+		case <-deadline:
+			log.Printf("worker %v: killing after drain timeout of %v with requests still in-flight", w.pid, timeout)
+			s.metrics.workerDrainKills.Inc()
+			s.killWorker(w, reason)
+			return
+		}
+	}
+}
+
+func getFreePort() (port int, err error) {
+	if v, _ := strconv.ParseBool(os.Getenv("USE_OLD_FREEPORT")); v == true {
+		return oldfreeport.GetFreePort()
+	}
+	return freeport.GetFreePort()
+}
+
+// ensureWorkers ensures that n workers are always alive. If they die, they
+// will be started again until the stabilizer is shut down.
+func (s *Stabilizer) ensureWorkers(n int) {
+	if len(s.config.StaticWorkers) > 0 {
+		log.Printf("static workers: %s", strings.Join(s.config.StaticWorkers, ", "))
+	} else {
+		log.Printf("worker command: %s", s.commandString())
+	}
+	for i := 0; i < n; i++ {
+		s.wg.Add(1)
+		go func(i int) {
+			defer s.wg.Done()
+			var (
+				flaps    int // consecutive workers which died before MinHealthyUptime
+				timeouts int // consecutive workers which timed out before responding, see BrokenWorkerTimeouts
+				fallback fallbackState
+			)
+			for s.ctx.Err() == nil {
+				var workerPort int
+				if len(s.config.StaticWorkers) == 0 {
+					var err error
+					workerPort, err = getFreePort()
+					if err != nil {
+						log.Println("failed to find free port")
+						time.Sleep(1 * time.Second)
+						continue
+					}
+				}
+
+				spawned := time.Now()
+				w := s.spawn(s.ctx, i, workerPort, fallback.active)
+				if !w.started.IsZero() {
+					s.metrics.workersSpawned.WithLabelValues(s.poolName).Inc()
+					s.metrics.workerSpawn.WithLabelValues(s.poolName).Observe(time.Since(spawned).Seconds())
+				} else {
+					s.metrics.spawnFailures.WithLabelValues(s.poolName).Inc()
+				}
+				w.index = i
+				w.concurrency = s.current().Concurrency
+				if w.host != "" {
+					log.Printf("worker %v: static worker at %v", w.index, w.addr())
+				} else {
+					log.Printf("worker %v: started on port %v", w.pid, w.port)
+				}
+				if err := s.waitReady(w); err != nil {
+					log.Printf("worker %v: %v", w.pid, err)
+					s.pool.recordError(i, err.Error())
+					w.kill(reasonUnready)
+					<-w.done
+				} else {
+					s.metrics.workerReady.WithLabelValues(s.poolName).Observe(time.Since(spawned).Seconds())
+					s.pool.add(w)
+					if s.config.HealthCheckInterval > 0 {
+						go s.healthCheck(w)
+					}
+					if fallback.active {
+						go s.recheckFallback(w, fallback.since)
+					}
+					<-w.done
+					s.pool.remove(w)
+				}
+				s.workerExited(w)
+				prevFlaps := flaps
+				backoff := s.restartBackoff(w, &flaps, &timeouts)
+				if s.config.FallbackCommand != "" && s.ctx.Err() == nil {
+					s.updateFallback(&fallback, i, flaps, flaps > prevFlaps)
+				}
+				if backoff > 0 {
+					select {
+					case <-time.After(backoff):
+					case <-s.ctx.Done():
+					}
+				}
+			}
+		}(i)
+	}
+}
+
+// workerExited cleans up after w, which has died, and records why. It is
+// called for every worker, whether or not it is then restarted.
+func (s *Stabilizer) workerExited(w *worker) {
+	if err := w.exitError(); err != "" && s.ctx.Err() == nil {
+		s.pool.recordError(w.index, err)
+	}
+	// Connections to the dead worker can only fail requests.
+	s.conns.closeAll(w)
+	s.metrics.workerExited(w)
+	s.recordRestart(w)
+	if s.config.PostStopCommand != "" {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.postStop(w)
+		}()
+	}
+}
+
+// newTransport returns the transport used to send requests to workers.
+func (s *Stabilizer) newTransport() *http.Transport {
+	dialer := &net.Dialer{
+		Timeout:   2000 * time.Millisecond,
+		KeepAlive: s.config.WorkerKeepAlive,
+	}
+	return &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := dialer.DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			if tc, ok := conn.(*net.TCPConn); ok {
+				if err := tc.SetNoDelay(!s.config.WorkerTCPNagle); err != nil {
+					conn.Close()
+					return nil, err
+				}
+			}
+			// The dial is for the request which the worker was acquired
+			// for, see ServeHTTP.
+			if w, ok := ctx.Value(workerKey{}).(*worker); ok {
+				return s.conns.track(w, conn), nil
+			}
+			return conn, nil
+		},
+		TLSHandshakeTimeout: 10 * time.Second,
+		// Forward Expect: 100-continue to the worker and wait for it to ask
+		// for the request body, so that a worker rejecting the request up
+		// front saves the client from uploading it. The client is only sent
+		// 100 Continue once the body is read, i.e. after a worker has been
+		// acquired and has agreed to receive it. Workers which ignore the
+		// header are sent the body after this delay.
+		ExpectContinueTimeout: 1 * time.Second,
+		// Each worker listens on its own port, and so is a separate host.
+		MaxConnsPerHost:     s.config.WorkerMaxConns,
+		MaxIdleConnsPerHost: s.config.WorkerMaxConns,
+		DisableKeepAlives:   s.config.WorkerDisableKeepAlives,
+	}
+}
+
+// requestTimeout returns the timeout for the request, which may be overridden
+// via the TimeoutHeader request header or, failing that, the TimeoutQuery
+// query parameter. Otherwise it is scaled by the size of the request body if
+// TimeoutPerByte is set.
+func (s *Stabilizer) requestTimeout(req *http.Request) time.Duration {
+	config := s.current()
+	if s.config.TimeoutHeader != "" {
+		if timeout, ok := parseTimeoutOverride(req.Header.Get(s.config.TimeoutHeader), config.TimeoutMax); ok {
+			return timeout
+		}
+	}
+	if s.config.TimeoutQuery != "" {
+		if timeout, ok := parseTimeoutOverride(req.URL.Query().Get(s.config.TimeoutQuery), config.TimeoutMax); ok {
+			return timeout
+		}
+	}
+	if config.TimeoutPerByte > 0 && req.ContentLength >= 0 {
+		// Compute in floating point, since a large Content-Length could
+		// overflow a Duration.
+		timeout := float64(config.TimeoutBase) + float64(config.TimeoutPerByte)*float64(req.ContentLength)
+		if config.TimeoutMax > 0 && timeout > float64(config.TimeoutMax) {
+			return config.TimeoutMax
+		}
+		if timeout > math.MaxInt64 {
+			return math.MaxInt64
+		}
+		return time.Duration(timeout)
+	}
+	return config.Timeout
+}
+
+// parseTimeoutOverride parses a timeout given by a request, which is only
+// valid if positive, and is capped at max if non-zero.
+func parseTimeoutOverride(value string, max time.Duration) (time.Duration, bool) {
+	timeout, err := time.ParseDuration(value)
+	if err != nil || timeout <= 0 {
+		return 0, false
+	}
+	if max > 0 && timeout > max {
+		return max, true
+	}
+	return timeout, true
+}
+
+// ConnState tracks the number of open client connections in the
+// frontend_connections metric. Use it as the ConnState of the http.Server
+// serving s.
+func (s *Stabilizer) ConnState(conn net.Conn, state http.ConnState) {
+	switch state {
+	case http.StateNew:
+		s.metrics.frontendConns.Inc()
+	case http.StateHijacked, http.StateClosed:
+		s.metrics.frontendConns.Dec()
+	}
+}
+
+// ServeHTTP proxies a request to a worker.
+func (s *Stabilizer) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	if s.metricsHandler != nil && r.URL.Path == s.config.MetricsPath {
+		// The metrics path is reserved, and never proxied to workers.
+		s.metricsHandler.ServeHTTP(rw, r)
+		return
+	}
+	if s.isHealthPath(r.URL.Path) {
+		// Like the metrics path, for load balancers and orchestrators.
+		s.serveHealth(rw, r)
+		return
+	}
+	// Before authenticating, which removes AuthHeader.
+	client := s.clientIdentity(r)
+	if !s.authenticated(r) {
+		s.writeError(rw, r, http.StatusUnauthorized, "hss_unauthorized", "missing or invalid "+s.config.AuthHeader+" header")
+		return
+	}
+	if !s.checkPath(rw, r) {
+		return
+	}
+	if atomic.LoadInt32(&s.shuttingDown) != 0 {
+		s.writeError(rw, r, http.StatusServiceUnavailable, "hss_shutting_down", "shutting down")
+		return
+	}
+	if s.Paused() {
+		s.writePaused(rw, r)
+		return
+	}
+	if s.overloaded() {
+		s.metrics.loadShed.Inc()
+		s.writeError(rw, r, http.StatusServiceUnavailable, "hss_overloaded", fmt.Sprintf("load average %v exceeds %v", s.currentLoadAverage(), s.config.MaxLoadAvg))
+		return
+	}
+	r, cancel := s.withRequestDeadline(r)
+	defer cancel()
+	release := s.acquireClient(rw, r, client)
+	if release == nil {
+		return
+	}
+	defer release()
+	if !s.checkBodySize(rw, r) {
+		return
+	}
+	if !s.checkColdStart(rw, r) {
+		return
+	}
+	s.wrapClientBody(r)
+
+	if s.shadow != nil {
+		s.shadow.prepare(r)
+	}
+
+	start := time.Now()
+	outcome := s.newOutcome(r)
+	if outcome != nil {
+		r = r.WithContext(context.WithValue(r.Context(), outcomeKey{}, outcome))
+	}
+
+	var state *retryState
+	if s.current().Retries > 0 {
+		var err error
+		state, err = s.newRetryState(r)
+		if err != nil {
+			s.writeError(rw, r, http.StatusBadRequest, "hss_bad_request", fmt.Sprintf("reading request body: %v", err))
+			return
+		}
+	}
+	var failed *worker // the worker the last attempt failed on, if retrying
+	for {
+		w, err := s.acquire(r, failed)
+		if err != nil {
+			if s.requestDeadlineExceeded(r) {
+				s.writeRequestDeadlineExceeded(rw, r)
+				return
+			}
+			if r.Context().Err() != nil {
+				// The client has gone away while the request was queued.
+				log.Println("request", r.URL, "canceled while waiting for a worker")
+				return
+			}
+			s.metrics.queueTimeouts.Inc()
+			s.writeError(rw, r, http.StatusServiceUnavailable, "hss_queue_timeout", fmt.Sprintf("no worker available after %v", s.current().QueueTimeout))
+			return
+		}
+
+		// The timeout starts once the request has been sent to a worker,
+		// and each attempt gets the full timeout.
+		// The worker is released only once the response body has been
+		// copied, so that drains wait for responses to finish streaming.
+		ctx := context.WithValue(r.Context(), workerKey{}, w)
+		if state == nil {
+			req, cancel := s.withTimeout(ctx, r, s.requestTimeout(r))
+			s.serveProxy(rw, req, w, cancel)
+			s.finishOutcome(outcome, w, start)
+			return
+		}
+		// The request body has already been read, so the timeout need not
+		// be extended during the upload.
+		ctx, cancel := context.WithTimeout(ctx, s.requestTimeout(r))
+		s.serveProxy(rw, state.attempt(ctx, r), w, cancel)
+		if !state.retry {
+			s.finishOutcome(outcome, w, start)
+			return
+		}
+		failed = w
+	}
+}
+
+// serveProxy proxies req to w, then cancels its context and releases w. The
+// proxy aborts the handler by panicking if copying the response body fails,
+// so both are deferred.
+func (s *Stabilizer) serveProxy(rw http.ResponseWriter, req *http.Request, w *worker, cancel func()) {
+	defer s.release(w)
+	defer cancel()
+	s.proxy.ServeHTTP(rw, req)
+}
+
+func (s *Stabilizer) director(req *http.Request) {
+	// Target the worker acquired by ServeHTTP.
+	worker := req.Context().Value(workerKey{}).(*worker)
+	target, _ := url.Parse("http://" + worker.addr())
+	log.Println("request", req.URL, target)
+
+	// Copy what httputil.NewSingleHostReverseProxy would do.
+	req.URL.Scheme = target.Scheme
+	req.URL.Host = target.Host
+	req.URL.Path = path.Join(target.Path, req.URL.Path)
+	if target.RawQuery == "" || req.URL.RawQuery == "" {
+		req.URL.RawQuery = target.RawQuery + req.URL.RawQuery
+	} else {
+		req.URL.RawQuery = target.RawQuery + "&" + req.URL.RawQuery
+	}
+	switch s.config.WorkerHostHeader {
+	case "preserve":
+	case "rewrite":
+		req.Host = target.Host
+	default:
+		req.Host = s.config.WorkerHostHeader
+	}
+	if _, ok := req.Header["User-Agent"]; !ok {
+		// explicitly disable User-Agent so it's not set to default value
+		req.Header.Set("User-Agent", "")
+	}
+	s.rewriteRequestHeaders(req.Header)
+	s.setDeadlineHeader(req)
+	s.recordRequest(req)
+}
+
+// rewriteRequestHeaders removes StripRequestHeaders from, and adds
+// SetRequestHeaders to, the headers of a request to a worker.
+func (s *Stabilizer) rewriteRequestHeaders(h http.Header) {
+	for _, name := range s.config.StripRequestHeaders {
+		h.Del(name)
+	}
+	for name, values := range s.config.SetRequestHeaders {
+		h[http.CanonicalHeaderKey(name)] = values
+	}
+}
+
+// rewriteResponseHeaders removes StripResponseHeaders from, and adds
+// SetResponseHeaders to, the headers of a response to a client.
+func (s *Stabilizer) rewriteResponseHeaders(h http.Header) {
+	for _, name := range s.config.StripResponseHeaders {
+		h.Del(name)
+	}
+	for name, values := range s.config.SetResponseHeaders {
+		h[http.CanonicalHeaderKey(name)] = values
+	}
+}
+
+// setDeadlineHeader tells the worker when the request will time out via the
+// DeadlineHeader request header, so that cooperative workers can abort the
+// request themselves rather than being killed.
+func (s *Stabilizer) setDeadlineHeader(req *http.Request) {
+	if s.config.DeadlineHeader == "" {
+		return
+	}
+	if deadline, ok := req.Context().Deadline(); ok {
+		req.Header.Set(s.config.DeadlineHeader, deadline.UTC().Format(time.RFC3339Nano))
+	}
+}
+
+// workerForRequest returns the worker acquired by ServeHTTP for r.
+func (s *Stabilizer) workerForRequest(r *http.Request) *worker {
+	return r.Context().Value(workerKey{}).(*worker)
+}
+
+func (s *Stabilizer) modifyResponse(r *http.Response) error {
+	if err := s.limitResponseBody(r); err != nil {
+		return err
+	}
+	if err := s.verifyResponseBody(r); err != nil {
+		return err
+	}
+	s.recordResponse(r)
+
+	// Set the X-Worker response header for debugging purposes.
+	w := s.workerForRequest(r.Request)
+	atomic.StoreInt32(&w.responded, 1)
+	s.setWorkerHeaders(r.Header, r.Request, w)
+	s.rewriteResponseHeaders(r.Header)
+	s.compressResponse(r)
+	s.metrics.responses.WithLabelValues(statusClass(r.StatusCode)).Inc()
+	s.setOutcome(r.Request, OutcomeOK, r.StatusCode)
+	s.recordBreakerResult(w, s.breakerFailure(r.StatusCode))
+	return nil
+}
+
+// debugHeadersAllowed reports whether the client which sent r may see the
+// X-Worker response headers.
+func (s *Stabilizer) debugHeadersAllowed(r *http.Request) bool {
+	if len(s.debugNets) == 0 {
+		return true
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	for _, ipNet := range s.debugNets {
+		if ip != nil && ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// setWorkerHeaders sets the response headers identifying the worker which
+// handled r, if the client may see them (see DebugHeaderCIDRs).
+func (s *Stabilizer) setWorkerHeaders(h http.Header, r *http.Request, w *worker) {
+	if !s.debugHeadersAllowed(r) {
+		// Don't let workers set them either.
+		h.Del("X-Worker")
+		h.Del("X-Worker-Variant")
+		h.Del("X-Worker-Tag")
+		return
+	}
+	if w.host != "" {
+		// Static workers have no PID.
+		h.Set("X-Worker", w.addr())
+	} else {
+		h.Set("X-Worker", fmt.Sprint(w.pid))
+	}
+	if s.config.Variant != "" {
+		h.Set("X-Worker-Variant", s.config.Variant)
+	}
+	if tag := s.pool.tag(w); tag != "" {
+		h.Set("X-Worker-Tag", tag)
+	}
+}
+
+func (s *Stabilizer) errorHandler(rw http.ResponseWriter, r *http.Request, err error) {
+	// Set the X-Worker response header for debugging purposes.
+	w := s.workerForRequest(r)
+	s.metrics.proxyErrors.WithLabelValues(classifyProxyError(err)).Inc()
+	if s.requestDeadlineExceeded(r) {
+		// Not necessarily the worker's fault, e.g. if the request spent
+		// most of its time queued, so it is neither killed nor counted
+		// towards its breaker.
+		log.Printf("worker %v: request deadline of %v exceeded", w.pid, s.current().RequestDeadline)
+		s.setOutcome(r, OutcomeTimeout, http.StatusGatewayTimeout)
+		s.metrics.responses.WithLabelValues(statusClass(http.StatusGatewayTimeout)).Inc()
+		s.setWorkerHeaders(rw.Header(), r, w)
+		s.writeRequestDeadlineExceeded(rw, r)
+		return
+	}
+	var bodyErr *clientBodyError
+	var bodyTooLarge *bodyTooLargeError
+	if errors.As(err, &bodyTooLarge) {
+		// Like a malformed body, below.
+		log.Printf("worker %v: %v", w.pid, err)
+		s.setOutcome(r, OutcomeError, http.StatusRequestEntityTooLarge)
+		s.metrics.responses.WithLabelValues(statusClass(http.StatusRequestEntityTooLarge)).Inc()
+		s.writeBodyTooLarge(rw, r, bodyTooLarge)
+		return
+	}
+	if errors.As(err, &bodyErr) {
+		// The client sent a malformed body, which is neither the worker's
+		// fault nor worth retrying.
+		log.Printf("worker %v: %v", w.pid, err)
+		s.setOutcome(r, OutcomeError, http.StatusBadRequest)
+		s.metrics.responses.WithLabelValues(statusClass(http.StatusBadRequest)).Inc()
+		s.writeError(rw, r, http.StatusBadRequest, "hss_bad_request", err.Error())
+		return
+	}
+	var tooLarge *responseTooLargeError
+	if !errors.Is(err, context.Canceled) && !errors.As(err, &tooLarge) {
+		// Not the worker's fault if the client went away, or if it
+		// correctly responded to a request for something too large.
+		s.recordBreakerResult(w, true)
+	}
+	switch {
+	case errors.Is(r.Context().Err(), context.DeadlineExceeded):
+		s.setOutcome(r, OutcomeTimeout, http.StatusServiceUnavailable)
+	case errors.Is(r.Context().Err(), context.Canceled):
+		s.setOutcome(r, OutcomeCanceled, http.StatusServiceUnavailable)
+	case isDialError(err):
+		s.setOutcome(r, OutcomeDialError, http.StatusServiceUnavailable)
+	default:
+		s.setOutcome(r, OutcomeError, http.StatusServiceUnavailable)
+	}
+	if !errors.As(err, &tooLarge) && s.shouldRetry(rw, r, w, err) {
+		return
+	}
+	s.metrics.responses.WithLabelValues(statusClass(http.StatusServiceUnavailable)).Inc()
+	s.setWorkerHeaders(rw.Header(), r, w)
+
+	// If the request timed out, kill the worker since it may be stuck.
+	// It will automatically restart.
+	if r.Context().Err() != nil {
+		if s.config.KeepWorkersOnTimeout {
+			log.Printf("worker %v: request timed out", w.pid)
+			s.writeError(rw, r, http.StatusServiceUnavailable, "hss_worker_timeout", fmt.Sprintf("worker %v: request timed out", w.pid))
+			return
+		}
+		if grace := s.current().TimeoutDrainGrace; grace > 0 {
+			// The worker may already be draining, e.g. due to another
+			// request timing out.
+			if err := s.pool.markDraining(w); err == nil {
+				log.Printf("worker %v: restarting due to timeout once other requests finish", w.pid)
+				go s.drainWorker(w, reasonTimeout, grace)
+			}
+		} else if s.config.TimeoutSignal != 0 {
+			if err := s.pool.markDraining(w); err == nil {
+				log.Printf("worker %v: restarting due to timeout", w.pid)
+				go s.killWorker(w, reasonTimeout)
+			}
+		} else {
+			log.Printf("worker %v: restarting due to timeout", w.pid)
+			w.kill(reasonTimeout)
+		}
+		s.writeError(rw, r, http.StatusServiceUnavailable, "hss_worker_timeout", fmt.Sprintf("worker %v: restarted due to timeout", w.pid))
+		return
+	}
+
+	// If we couldn't connect to the worker at all, it is most likely
+	// still starting up (or has just died and is being restarted),
+	// which is very different from a worker that is stuck.
+	if isDialError(err) {
+		log.Printf("worker %v: dial error: %v", w.pid, err)
+		s.metrics.workerDialErrors.Inc()
+		s.writeError(rw, r, http.StatusServiceUnavailable, "hss_worker_dial_error", fmt.Sprintf("worker %v: %v", w.pid, err))
+		return
+	}
+
+	// If the worker closed the connection mid-response, it most likely
+	// died, and the response it did send is not trustworthy.
+	var truncated *truncatedResponseError
+	if errors.As(err, &truncated) {
+		log.Printf("worker %v: %v", w.pid, err)
+		s.setOutcome(r, OutcomeError, http.StatusBadGateway)
+		s.writeError(rw, r, http.StatusBadGateway, "hss_worker_truncated_response", fmt.Sprintf("worker %v: %v", w.pid, err))
+		return
+	}
+
+	if errors.As(err, &tooLarge) {
+		log.Printf("worker %v: %v", w.pid, err)
+		s.setOutcome(r, OutcomeError, http.StatusBadGateway)
+		s.writeError(rw, r, http.StatusBadGateway, "hss_response_too_large", fmt.Sprintf("worker %v: %v", w.pid, err))
+		return
+	}
+
+	// Technically we could hit other errors here if e.g. communication
+	// between our reverse proxy and the worker was failing for some
+	// other reason like the network being flooded, but in practice
+	// this is unlikely to happen and instead the most likely case is
+	// that the worker was killed due to another request on the same
+	// worker timing out. In this case, having a different error code
+	// to handle is not that useful so we also return
+	// hss_worker_timeout.
+	log.Printf("worker %v: %v", w.pid, err)
+	s.writeError(rw, r, http.StatusServiceUnavailable, "hss_worker_timeout", fmt.Sprintf("worker %v: %v", w.pid, err))
+}
+
+// statusClass returns the class of an HTTP status code, e.g. "5xx", to bound
+// the cardinality of metric labels.
+func statusClass(code int) string {
+	if code < 100 || code > 599 {
+		return "other"
+	}
+	return fmt.Sprintf("%dxx", code/100)
+}
+
+// classifyProxyError returns the class of an error proxying a request to a
+// worker, for metrics.
+func classifyProxyError(err error) string {
+	var (
+		netErr    net.Error
+		bodyErr   *clientBodyError
+		truncated *truncatedResponseError
+		tooLarge  *responseTooLargeError
+		tlsErr    tls.RecordHeaderError
+	)
+	switch {
+	case errors.As(err, &bodyErr):
+		return "bad_request"
+	case errors.Is(err, context.Canceled):
+		return "canceled" // the client went away
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.As(err, &truncated):
+		return "truncated"
+	case errors.As(err, &tooLarge):
+		return "too_large"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "connection_refused"
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE):
+		return "connection_reset"
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return "eof"
+	case errors.As(err, &tlsErr):
+		return "tls"
+	case isDialError(err):
+		return "dial"
+	}
+	return "other"
+}
+
+// isDialError reports whether err occurred while connecting to a worker, e.g.
+// because it is still booting and not yet listening on its port.
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
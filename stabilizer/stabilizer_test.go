@@ -0,0 +1,803 @@
+package stabilizer
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// testStabilizer is a started Stabilizer whose workers are served in-process
+// by a handler (see newWorker), rather than by worker processes.
+type testStabilizer struct {
+	*Stabilizer
+	srv           *httptest.Server // serving the Stabilizer
+	handler       http.Handler     // serving each worker
+	shadowHandler http.Handler     // serving each shadow worker, if any
+	spawned       int32            // number of workers spawned, accessed atomically
+}
+
+// newTestStabilizer returns a started Stabilizer with config, whose workers
+// are served by handler. It waits for all of the workers to become ready.
+func newTestStabilizer(t *testing.T, config Config, handler http.Handler) *testStabilizer {
+	t.Helper()
+	return newShadowTestStabilizer(t, config, handler, nil)
+}
+
+// newShadowTestStabilizer is like newTestStabilizer, but if shadow is not nil
+// requests are also mirrored to a shadow pool (see Config.ShadowCommand) whose
+// workers are served by shadow.
+func newShadowTestStabilizer(t *testing.T, config Config, handler, shadow http.Handler) *testStabilizer {
+	t.Helper()
+	if config.Command == "" {
+		config.Command = "true" // never run, see spawn
+	}
+	if shadow != nil {
+		config.ShadowCommand = "true"
+	}
+	config.Registerer = prometheus.NewRegistry()
+	s, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := &testStabilizer{Stabilizer: s, handler: handler, shadowHandler: shadow}
+	s.spawn = ts.spawn
+	if shadow != nil {
+		s.shadow.spawn = ts.spawnShadow
+	}
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	ts.srv = httptest.NewServer(s)
+	ts.waitReady(t, s.config.Workers)
+	return ts
+}
+
+// spawn is the spawnFunc of a testStabilizer, which serves each worker with
+// its own httptest.Server.
+func (ts *testStabilizer) spawn(ctx context.Context, index, port int, fallback bool) *worker {
+	atomic.AddInt32(&ts.spawned, 1)
+	return serveWorker(ctx, ts.handler)
+}
+
+// spawnShadow is the spawnFunc of a testStabilizer's shadow pool.
+func (ts *testStabilizer) spawnShadow(ctx context.Context, index, port int, fallback bool) *worker {
+	return serveWorker(ctx, ts.shadowHandler)
+}
+
+// serveWorker returns a worker served by handler with its own
+// httptest.Server.
+func serveWorker(ctx context.Context, handler http.Handler) *worker {
+	srv := httptest.NewServer(handler)
+	return newWorker(ctx, srv.Listener.Addr().(*net.TCPAddr).Port, func() {
+		// Like killing a process, abort any in-flight requests.
+		srv.CloseClientConnections()
+		srv.Close()
+	})
+}
+
+// waitReady waits for n workers to be ready to serve requests.
+func (ts *testStabilizer) waitReady(t *testing.T, n int) {
+	t.Helper()
+	deadline := time.After(10 * time.Second)
+	for {
+		ready, changed := ts.pool.ready()
+		if ready == n {
+			return
+		}
+		select {
+		case <-changed:
+		case <-deadline:
+			t.Fatalf("%d workers ready, want %d", ready, n)
+		}
+	}
+}
+
+// close shuts down the Stabilizer and its workers.
+func (ts *testStabilizer) close() {
+	ts.srv.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	ts.Shutdown(ctx)
+}
+
+// get requests path from the Stabilizer, returning the response with its
+// body read.
+func (ts *testStabilizer) get(t *testing.T, path string) (*http.Response, string) {
+	t.Helper()
+	resp, err := http.Get(ts.srv.URL + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(body)
+}
+
+// getBody returns the body of a response to a GET request for url, or the
+// error, for use outside of the test's goroutine.
+func getBody(url string) string {
+	resp, err := http.Get(url)
+	if err != nil {
+		return err.Error()
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err.Error()
+	}
+	return string(body)
+}
+
+// errorCode returns the code of a JSON error response body.
+func errorCode(t *testing.T, body string) string {
+	t.Helper()
+	var v struct {
+		Code string `json:"code"`
+	}
+	if err := json.Unmarshal([]byte(body), &v); err != nil {
+		t.Fatalf("decoding error response %q: %v", body, err)
+	}
+	return v.Code
+}
+
+func TestProxy(t *testing.T) {
+	ts := newTestStabilizer(t, Config{Workers: 2}, http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("X-Path", r.URL.Path)
+		rw.Write([]byte("hello"))
+	}))
+	defer ts.close()
+
+	resp, body := ts.get(t, "/foo")
+	if resp.StatusCode != http.StatusOK || body != "hello" || resp.Header.Get("X-Path") != "/foo" {
+		t.Errorf("got %v %q (X-Path %q), want 200 hello", resp.StatusCode, body, resp.Header.Get("X-Path"))
+	}
+}
+
+func TestTimeoutRestartsWorker(t *testing.T) {
+	ts := newTestStabilizer(t, Config{Workers: 1, Timeout: 100 * time.Millisecond}, http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/stuck" {
+			<-r.Context().Done()
+			return
+		}
+		rw.Write([]byte("ok"))
+	}))
+	defer ts.close()
+
+	resp, body := ts.get(t, "/stuck")
+	if resp.StatusCode != http.StatusServiceUnavailable || errorCode(t, body) != "hss_worker_timeout" {
+		t.Fatalf("got %v %s, want 503 hss_worker_timeout", resp.StatusCode, body)
+	}
+
+	// The stuck worker is replaced, and the replacement serves requests.
+	waitFor(t, func() bool { return atomic.LoadInt32(&ts.spawned) == 2 })
+	ts.waitReady(t, 1)
+	if resp, body := ts.get(t, "/"); resp.StatusCode != http.StatusOK || body != "ok" {
+		t.Errorf("after restart: got %v %q, want 200 ok", resp.StatusCode, body)
+	}
+}
+
+func TestAcquireQueues(t *testing.T) {
+	release := make(chan struct{})
+	ts := newTestStabilizer(t, Config{Workers: 1, Concurrency: 1}, http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			<-release
+		}
+		rw.Write([]byte(r.URL.Path))
+	}))
+	defer ts.close()
+
+	slow := make(chan string)
+	go func() { slow <- getBody(ts.srv.URL + "/slow") }()
+	waitFor(t, func() bool { n, _ := ts.pool.inflight(); return n == 1 })
+
+	// The second request waits for the worker to be released.
+	queued := make(chan string)
+	go func() { queued <- getBody(ts.srv.URL + "/queued") }()
+	waitFor(t, func() bool { return ts.pool.queued() == 1 })
+	select {
+	case body := <-queued:
+		t.Fatalf("queued request finished early: %q", body)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	if body := <-slow; body != "/slow" {
+		t.Errorf("slow request: got %q", body)
+	}
+	if body := <-queued; body != "/queued" {
+		t.Errorf("queued request: got %q", body)
+	}
+}
+
+func TestQueueTimeout(t *testing.T) {
+	release := make(chan struct{})
+	ts := newTestStabilizer(t, Config{Workers: 1, Concurrency: 1, QueueTimeout: 50 * time.Millisecond}, http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer ts.close()
+	defer close(release)
+
+	go http.Get(ts.srv.URL + "/slow")
+	waitFor(t, func() bool { n, _ := ts.pool.inflight(); return n == 1 })
+
+	resp, body := ts.get(t, "/")
+	if resp.StatusCode != http.StatusServiceUnavailable || errorCode(t, body) != "hss_queue_timeout" {
+		t.Errorf("got %v %s, want 503 hss_queue_timeout", resp.StatusCode, body)
+	}
+}
+
+func TestProxyTrailers(t *testing.T) {
+	ts := newTestStabilizer(t, Config{Workers: 1}, http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Trailer", "Grpc-Status")
+		rw.Header().Set("X-TE", r.Header.Get("Te"))
+		rw.Write([]byte("body"))
+		rw.(http.Flusher).Flush()
+		rw.Header().Set("Grpc-Status", "0")
+		rw.Header().Set(http.TrailerPrefix+"Grpc-Message", "unannounced")
+	}))
+	defer ts.close()
+
+	req, _ := http.NewRequest("GET", ts.srv.URL, nil)
+	req.Header.Set("TE", "trailers")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if _, ok := resp.Trailer["Grpc-Status"]; !ok {
+		t.Errorf("announced trailer missing from Trailer header: %v", resp.Trailer)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil || string(body) != "body" {
+		t.Fatalf("got body %q, %v", body, err)
+	}
+	if got := resp.Header.Get("X-TE"); got != "trailers" {
+		t.Errorf("worker got TE %q, want trailers", got)
+	}
+	if got := resp.Trailer.Get("Grpc-Status"); got != "0" {
+		t.Errorf("announced trailer Grpc-Status = %q, want 0", got)
+	}
+	if got := resp.Trailer.Get("Grpc-Message"); got != "unannounced" {
+		t.Errorf("unannounced trailer Grpc-Message = %q, want unannounced", got)
+	}
+}
+
+// sendExpectContinue sends a request with a body of body's length and an
+// Expect: 100-continue header to the Stabilizer, returning the first response
+// and, if it is 100 Continue, sending the body and returning the final one
+// too.
+func (ts *testStabilizer) sendExpectContinue(t *testing.T, body string) (first, final *http.Response) {
+	t.Helper()
+	conn, err := net.Dial("tcp", ts.srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	fmt.Fprintf(conn, "POST / HTTP/1.1\r\nHost: test\r\nExpect: 100-continue\r\nContent-Length: %d\r\n\r\n", len(body))
+	br := bufio.NewReader(conn)
+	first, err = http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.StatusCode != http.StatusContinue {
+		return first, nil
+	}
+	io.WriteString(conn, body)
+	final, err = http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return first, final
+}
+
+func TestExpectContinueRejected(t *testing.T) {
+	// The worker rejects the request without asking for its body, which the
+	// client is then never asked to send.
+	ts := newTestStabilizer(t, Config{Workers: 1}, http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Connection", "close")
+		rw.WriteHeader(http.StatusRequestEntityTooLarge)
+	}))
+	defer ts.close()
+
+	first, _ := ts.sendExpectContinue(t, "too large")
+	if first.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("got status %v, want 413 without 100 Continue", first.StatusCode)
+	}
+}
+
+func TestExpectContinueIgnored(t *testing.T) {
+	// The worker never responds with 100 Continue but waits for the body,
+	// which it is sent after ExpectContinueTimeout.
+	ts := newTestStabilizer(t, Config{Workers: 1}, http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Expect") != "100-continue" {
+			http.Error(rw, "Expect header not forwarded", http.StatusBadRequest)
+			return
+		}
+		// Hijack the connection so that 100 Continue is not sent
+		// automatically when reading the body.
+		conn, buf, err := rw.(http.Hijacker).Hijack()
+		if err != nil {
+			panic(err)
+		}
+		defer conn.Close()
+		body := make([]byte, r.ContentLength)
+		if _, err := io.ReadFull(buf, body); err != nil {
+			return
+		}
+		fmt.Fprintf(buf, "HTTP/1.1 200 OK\r\nConnection: close\r\nContent-Length: %d\r\n\r\n%s", len(body), body)
+		buf.Flush()
+	}))
+	defer ts.close()
+
+	first, final := ts.sendExpectContinue(t, "uploaded")
+	if first.StatusCode != http.StatusContinue || final == nil {
+		t.Fatalf("got status %v, want 100 Continue", first.StatusCode)
+	}
+	defer final.Body.Close()
+	body, _ := ioutil.ReadAll(final.Body)
+	if final.StatusCode != http.StatusOK || string(body) != "uploaded" {
+		t.Errorf("got %v %q, want 200 uploaded", final.StatusCode, body)
+	}
+}
+
+// timeoutError is a net.Error which timed out.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestClassifyProxyError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{&net.OpError{Op: "dial", Net: "tcp", Err: errors.New("no route to host")}, "dial"},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, "connection_refused"},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: timeoutError{}}, "timeout"},
+		{&net.OpError{Op: "read", Net: "tcp", Err: timeoutError{}}, "timeout"},
+		{context.DeadlineExceeded, "timeout"},
+		{fmt.Errorf("proxying: %w", context.DeadlineExceeded), "timeout"},
+		{context.Canceled, "canceled"},
+		{fmt.Errorf("proxying: %w", context.Canceled), "canceled"},
+		{&clientBodyError{err: io.ErrUnexpectedEOF}, "bad_request"},
+		{&clientBodyError{err: errors.New("invalid chunk length")}, "bad_request"},
+		{&truncatedResponseError{got: 1, want: 2, err: io.ErrUnexpectedEOF}, "truncated"},
+		{&responseTooLargeError{size: 2, max: 1}, "too_large"},
+		{&net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}, "connection_reset"},
+		{&net.OpError{Op: "write", Net: "tcp", Err: os.NewSyscallError("write", syscall.EPIPE)}, "connection_reset"},
+		{io.EOF, "eof"},
+		{io.ErrUnexpectedEOF, "eof"},
+		{tls.RecordHeaderError{Msg: "first record does not look like a TLS handshake"}, "tls"},
+		{errors.New("something else"), "other"},
+	}
+	for _, tst := range tests {
+		if got := classifyProxyError(tst.err); got != tst.want {
+			t.Errorf("classifyProxyError(%v) = %q, want %q", tst.err, got, tst.want)
+		}
+	}
+}
+
+// http10Worker responds with the request's Host and User-Agent, and for
+// /stream a response of unknown length.
+var http10Worker = http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/stream" {
+		rw.Write([]byte("streamed "))
+		rw.(http.Flusher).Flush()
+		rw.Write([]byte("response"))
+		return
+	}
+	rw.Header().Set("X-Host", r.Host)
+	rw.Header().Set("X-User-Agent", strings.Join(r.Header["User-Agent"], ","))
+	rw.Write([]byte("ok"))
+})
+
+// dialHTTP10 connects to the Stabilizer, returning a function which sends an
+// HTTP/1.0 request with the given header lines and reads the response.
+func (ts *testStabilizer) dialHTTP10(t *testing.T) (conn net.Conn, do func(path string, header ...string) (*http.Response, string)) {
+	t.Helper()
+	conn, err := net.Dial("tcp", ts.srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	br := bufio.NewReader(conn)
+	return conn, func(path string, header ...string) (*http.Response, string) {
+		t.Helper()
+		fmt.Fprintf(conn, "GET %s HTTP/1.0\r\n%s\r\n", path, strings.Join(append(header, ""), "\r\n"))
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp, string(body)
+	}
+}
+
+func TestHTTP10KeepAlive(t *testing.T) {
+	ts := newTestStabilizer(t, Config{Workers: 1}, http10Worker)
+	defer ts.close()
+	conn, do := ts.dialHTTP10(t)
+	defer conn.Close()
+
+	for i := 0; i < 2; i++ {
+		resp, body := do("/", "Host: example.com", "Connection: keep-alive")
+		if resp.StatusCode != http.StatusOK || body != "ok" {
+			t.Fatalf("request %d: got %v %q, want 200 ok", i, resp.StatusCode, body)
+		}
+		if resp.ProtoMinor != 0 || resp.Close || resp.Header.Get("Connection") != "keep-alive" {
+			t.Errorf("request %d: got %s, Connection %q, want a kept-alive HTTP/1.0 response", i, resp.Proto, resp.Header.Get("Connection"))
+		}
+		if got := resp.Header.Get("X-Host"); got != "example.com" {
+			t.Errorf("worker got Host %q, want example.com", got)
+		}
+	}
+}
+
+func TestHTTP10Close(t *testing.T) {
+	ts := newTestStabilizer(t, Config{Workers: 1}, http10Worker)
+	defer ts.close()
+	conn, do := ts.dialHTTP10(t)
+	defer conn.Close()
+
+	resp, body := do("/", "Host: example.com")
+	if resp.StatusCode != http.StatusOK || body != "ok" || !resp.Close {
+		t.Errorf("got %v %q (close %v), want 200 ok and the connection closed", resp.StatusCode, body, resp.Close)
+	}
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("read after response: got %v, want EOF", err)
+	}
+}
+
+func TestHTTP10MissingHost(t *testing.T) {
+	ts := newTestStabilizer(t, Config{Workers: 1}, http10Worker)
+	defer ts.close()
+	conn, do := ts.dialHTTP10(t)
+	defer conn.Close()
+
+	resp, body := do("/")
+	if resp.StatusCode != http.StatusOK || body != "ok" {
+		t.Fatalf("got %v %q, want 200 ok", resp.StatusCode, body)
+	}
+	if got := resp.Header.Get("X-Host"); !strings.HasPrefix(got, "127.0.0.1:") {
+		t.Errorf("worker got Host %q, want its own address", got)
+	}
+	if got := resp.Header.Get("X-User-Agent"); got != "" {
+		t.Errorf("worker got User-Agent %q, want none", got)
+	}
+}
+
+func TestHTTP10UnknownLength(t *testing.T) {
+	ts := newTestStabilizer(t, Config{Workers: 1}, http10Worker)
+	defer ts.close()
+	conn, do := ts.dialHTTP10(t)
+	defer conn.Close()
+
+	// HTTP/1.0 has no chunked encoding, so the response is ended by closing
+	// the connection, even though the client asked to keep it alive.
+	resp, body := do("/stream", "Host: example.com", "Connection: keep-alive")
+	if resp.StatusCode != http.StatusOK || body != "streamed response" {
+		t.Errorf("got %v %q, want 200 streamed response", resp.StatusCode, body)
+	}
+	if len(resp.TransferEncoding) > 0 || resp.ContentLength != -1 || !resp.Close {
+		t.Errorf("got Transfer-Encoding %v, Content-Length %v, close %v, want a response delimited by closing the connection", resp.TransferEncoding, resp.ContentLength, resp.Close)
+	}
+}
+
+// TestRequestBodyStreamed checks that request bodies are streamed to workers
+// as they arrive, rather than buffered: the worker receives the start of the
+// body before the client has sent the rest, which it only does once the
+// worker has received the start.
+func TestRequestBodyStreamed(t *testing.T) {
+	const (
+		first = 1 << 20
+		total = 16 << 20
+	)
+	started := make(chan struct{}, 1)
+	ts := newTestStabilizer(t, Config{Workers: 1}, http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		n, err := io.CopyN(ioutil.Discard, r.Body, first)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		started <- struct{}{}
+		rest, _ := io.Copy(ioutil.Discard, r.Body)
+		fmt.Fprint(rw, n+rest)
+	}))
+	defer ts.close()
+
+	for _, chunked := range []bool{false, true} {
+		pr, pw := io.Pipe()
+		go func() {
+			chunk := make([]byte, 64<<10)
+			for sent := 0; sent < total; sent += len(chunk) {
+				if sent == first {
+					select {
+					case <-started:
+					case <-time.After(10 * time.Second):
+						pw.CloseWithError(errors.New("the worker did not receive the start of the body before the rest was sent"))
+						return
+					}
+				}
+				if _, err := pw.Write(chunk); err != nil {
+					return
+				}
+			}
+			pw.Close()
+		}()
+		req, _ := http.NewRequest("POST", ts.srv.URL, pr)
+		if !chunked {
+			req.ContentLength = total
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("chunked=%v: %v", chunked, err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || string(body) != fmt.Sprint(total) {
+			t.Errorf("chunked=%v: got %v %q, want 200 %v", chunked, resp.StatusCode, body, total)
+		}
+	}
+}
+
+func TestOutcome(t *testing.T) {
+	outcomes := make(chan Outcome, 10)
+	ts := newTestStabilizer(t, Config{
+		Workers:   1,
+		Timeout:   200 * time.Millisecond,
+		OnOutcome: func(o Outcome) { outcomes <- o },
+	}, http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/hang" {
+			<-r.Context().Done()
+			return
+		}
+		fmt.Fprint(rw, "ok")
+	}))
+	defer ts.close()
+
+	next := func() Outcome {
+		t.Helper()
+		select {
+		case o := <-outcomes:
+			return o
+		case <-time.After(10 * time.Second):
+			t.Fatal("timed out waiting for an outcome")
+			return Outcome{}
+		}
+	}
+
+	ts.get(t, "/")
+	if o := next(); o.Outcome != OutcomeOK || o.Status != http.StatusOK || o.Path != "/" {
+		t.Errorf("got %+v, want an ok outcome for /", o)
+	}
+
+	ts.get(t, "/hang")
+	if o := next(); o.Outcome != OutcomeTimeout {
+		t.Errorf("got outcome %q, want %q", o.Outcome, OutcomeTimeout)
+	}
+	ts.waitReady(t, 1)
+
+	// A client which goes away isn't a worker timeout.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequest("GET", ts.srv.URL+"/hang", nil)
+	if resp, err := http.DefaultClient.Do(req.WithContext(ctx)); err == nil {
+		resp.Body.Close()
+		t.Fatal("got a response, want the request to be canceled")
+	}
+	if o := next(); o.Outcome != OutcomeCanceled {
+		t.Errorf("got outcome %q, want %q", o.Outcome, OutcomeCanceled)
+	}
+}
+
+// TestRequestBodyBackpressure checks that the memory used for a request body
+// is bounded: while the worker isn't reading the body, the stabilizer stops
+// reading it from the client, so the client's writes stall long before the
+// whole body has been sent, rather than it being buffered.
+func TestRequestBodyBackpressure(t *testing.T) {
+	const (
+		first = 1 << 20
+		total = 64 << 20
+	)
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	ts := newTestStabilizer(t, Config{Workers: 1}, http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		n, err := io.CopyN(ioutil.Discard, r.Body, first)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		started <- struct{}{}
+		<-release
+		rest, _ := io.Copy(ioutil.Discard, r.Body)
+		fmt.Fprint(rw, n+rest)
+	}))
+	defer ts.close()
+
+	var sent int64 // bytes written by the client, accessed atomically
+	pr, pw := io.Pipe()
+	go func() {
+		chunk := make([]byte, 64<<10)
+		for atomic.LoadInt64(&sent) < total {
+			if _, err := pw.Write(chunk); err != nil {
+				return
+			}
+			atomic.AddInt64(&sent, int64(len(chunk)))
+		}
+		pw.Close()
+	}()
+	type result struct {
+		status int
+		body   string
+		err    error
+	}
+	done := make(chan result, 1)
+	go func() {
+		req, _ := http.NewRequest("POST", ts.srv.URL, pr)
+		req.ContentLength = total
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			done <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		done <- result{resp.StatusCode, string(body), err}
+	}()
+
+	select {
+	case <-started:
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for the worker to receive the start of the body")
+	}
+	// Wait for the client's writes to stall, which only the (kernel and
+	// stabilizer) buffers between it and the worker allow it to get ahead by.
+	deadline := time.Now().Add(10 * time.Second)
+	for prev := int64(-1); ; {
+		n := atomic.LoadInt64(&sent)
+		if n == prev || n >= total || time.Now().After(deadline) {
+			break
+		}
+		prev = n
+		time.Sleep(200 * time.Millisecond)
+	}
+	if n := atomic.LoadInt64(&sent); n > total/2 {
+		t.Errorf("client sent %d of %d bytes while the worker wasn't reading, want the stabilizer to stop reading the body", n, total)
+	}
+
+	close(release)
+	res := <-done
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+	if res.status != http.StatusOK || res.body != fmt.Sprint(total) {
+		t.Errorf("got %v %q, want 200 %v", res.status, res.body, total)
+	}
+}
+
+// TestShadowUnaffected checks that requests are mirrored to shadow workers
+// once their body has been sent to the real worker, and that shadow workers
+// which fail or hang don't affect the real response.
+func TestShadowUnaffected(t *testing.T) {
+	for _, tst := range []struct {
+		name   string
+		shadow func(release <-chan struct{})
+	}{
+		{"failing", func(<-chan struct{}) { panic(http.ErrAbortHandler) }},
+		{"slow", func(release <-chan struct{}) { <-release }},
+	} {
+		t.Run(tst.name, func(t *testing.T) {
+			mirrored := make(chan string, 10)
+			release := make(chan struct{})
+			ts := newShadowTestStabilizer(t, Config{Workers: 1}, http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+				body, _ := ioutil.ReadAll(r.Body)
+				fmt.Fprintf(rw, "real %s", body)
+			}), http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+				body, _ := ioutil.ReadAll(r.Body)
+				mirrored <- string(body)
+				tst.shadow(release)
+			}))
+			defer ts.close()
+			defer close(release)
+
+			for i := 0; i < 3; i++ {
+				start := time.Now()
+				resp, err := http.Post(ts.srv.URL, "text/plain", strings.NewReader(fmt.Sprint("body ", i)))
+				if err != nil {
+					t.Fatal(err)
+				}
+				body, _ := ioutil.ReadAll(resp.Body)
+				resp.Body.Close()
+				if want := fmt.Sprint("real body ", i); resp.StatusCode != http.StatusOK || string(body) != want {
+					t.Errorf("got %v %q, want 200 %q", resp.StatusCode, body, want)
+				}
+				if d := time.Since(start); d > 2*time.Second {
+					t.Errorf("request took %v", d)
+				}
+			}
+			// The first request is always mirrored, as a shadow worker is
+			// free; later ones may be dropped while it is busy.
+			select {
+			case got := <-mirrored:
+				if got != "body 0" {
+					t.Errorf("shadow worker received %q, want %q", got, "body 0")
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatal("timed out waiting for the request to be mirrored")
+			}
+		})
+	}
+}
+
+func TestTimeoutOverride(t *testing.T) {
+	ts := newTestStabilizer(t, Config{
+		Workers:       1,
+		Timeout:       10 * time.Second,
+		TimeoutHeader: "X-Stabilize-Timeout",
+		TimeoutQuery:  "stabilize_timeout",
+		TimeoutMax:    time.Minute,
+	}, http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer ts.close()
+
+	tests := []struct {
+		name   string
+		header string
+		query  string
+		want   time.Duration
+	}{
+		{"default", "", "", 10 * time.Second},
+		{"header", "2s", "", 2 * time.Second},
+		{"query", "", "3s", 3 * time.Second},
+		{"header wins", "2s", "3s", 2 * time.Second},
+		{"invalid header", "soon", "3s", 3 * time.Second},
+		{"invalid", "soon", "later", 10 * time.Second},
+		{"zero", "0s", "", 10 * time.Second},
+		{"negative", "", "-1s", 10 * time.Second},
+		{"capped", "1h", "", time.Minute},
+	}
+	for _, tst := range tests {
+		r := httptest.NewRequest("GET", "/?stabilize_timeout="+tst.query, nil)
+		if tst.header != "" {
+			r.Header.Set("X-Stabilize-Timeout", tst.header)
+		}
+		if got := ts.requestTimeout(r); got != tst.want {
+			t.Errorf("%s: got %v, want %v", tst.name, got, tst.want)
+		}
+	}
+
+	// The overridden timeout applies to the request.
+	start := time.Now()
+	resp, body := ts.get(t, "/?stabilize_timeout=100ms")
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("got %v %q, want a 503", resp.StatusCode, body)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("request took %v, want it to time out after 100ms", d)
+	}
+}
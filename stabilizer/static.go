@@ -0,0 +1,35 @@
+package stabilizer
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// parseStaticWorkers checks that each of StaticWorkers is a valid host:port
+// address.
+func parseStaticWorkers(addrs []string) error {
+	for _, addr := range addrs {
+		_, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return err
+		}
+		if _, err := strconv.Atoi(port); err != nil {
+			return fmt.Errorf("invalid port in %q", addr)
+		}
+	}
+	return nil
+}
+
+// spawnStatic is the spawnFunc used with StaticWorkers. Rather than starting
+// a process, it returns a worker for the externally-managed backend with the
+// given index. Killing such a worker only takes it out of rotation: it is
+// added back once it passes its readiness check again.
+func (s *Stabilizer) spawnStatic(ctx context.Context, index, _ int, _ bool) *worker {
+	host, port, _ := net.SplitHostPort(s.config.StaticWorkers[index])
+	w := newWorker(ctx, 0, func() {})
+	w.host = host
+	w.port, _ = strconv.Atoi(port)
+	return w
+}
@@ -0,0 +1,111 @@
+package stabilizer
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// withTimeout returns a copy of r with ctx and the given timeout, and a
+// function to call once the request is done. If ExtendTimeoutDuringUpload is
+// set and r has a body, the timeout is restarted whenever more of the body is
+// sent to the worker, so that slow uploads aren't mistaken for stuck workers.
+func (s *Stabilizer) withTimeout(ctx context.Context, r *http.Request, timeout time.Duration) (*http.Request, func()) {
+	if !s.config.ExtendTimeoutDuringUpload || r.ContentLength == 0 {
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		return r.WithContext(ctx), cancel
+	}
+	uctx, cancel := newUploadContext(ctx, timeout)
+	r = r.WithContext(uctx)
+	r.Body = &uploadBody{ReadCloser: r.Body, ctx: uctx}
+	return r, cancel
+}
+
+// uploadContext is a context which, like one returned by context.WithTimeout,
+// fails with context.DeadlineExceeded after a timeout, except that the timeout
+// can be restarted with extend.
+type uploadContext struct {
+	context.Context // the parent
+	timeout         time.Duration
+	timer           *time.Timer
+	done            chan struct{}
+
+	mu       sync.Mutex
+	err      error
+	deadline time.Time
+}
+
+func newUploadContext(parent context.Context, timeout time.Duration) (*uploadContext, func()) {
+	c := &uploadContext{
+		Context:  parent,
+		timeout:  timeout,
+		done:     make(chan struct{}),
+		deadline: time.Now().Add(timeout),
+	}
+	c.timer = time.AfterFunc(timeout, func() { c.cancel(context.DeadlineExceeded) })
+	go func() {
+		select {
+		case <-parent.Done():
+			c.cancel(parent.Err())
+		case <-c.done:
+		}
+	}()
+	return c, func() {
+		c.timer.Stop()
+		c.cancel(context.Canceled)
+	}
+}
+
+func (c *uploadContext) cancel(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return
+	}
+	c.err = err
+	close(c.done)
+}
+
+// extend restarts the timeout, unless the context is already done.
+func (c *uploadContext) extend() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return
+	}
+	c.timer.Reset(c.timeout)
+	c.deadline = time.Now().Add(c.timeout)
+}
+
+func (c *uploadContext) Deadline() (time.Time, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.deadline, true
+}
+
+func (c *uploadContext) Done() <-chan struct{} {
+	return c.done
+}
+
+func (c *uploadContext) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// uploadBody is a request body which extends the timeout of ctx whenever it
+// is read from.
+type uploadBody struct {
+	io.ReadCloser
+	ctx *uploadContext
+}
+
+func (b *uploadBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 || err == io.EOF {
+		b.ctx.extend()
+	}
+	return n, err
+}
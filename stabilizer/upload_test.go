@@ -0,0 +1,117 @@
+package stabilizer
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// slowReader returns one byte of its input at a time, every interval.
+type slowReader struct {
+	r        io.Reader
+	interval time.Duration
+}
+
+func (r *slowReader) Read(p []byte) (int, error) {
+	time.Sleep(r.interval)
+	return r.r.Read(p[:1])
+}
+
+func TestUploadContextExtends(t *testing.T) {
+	ctx, cancel := newUploadContext(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	body := &uploadBody{
+		ReadCloser: ioutil.NopCloser(&slowReader{r: strings.NewReader("0123456789"), interval: 20 * time.Millisecond}),
+		ctx:        ctx,
+	}
+
+	// The upload takes 200ms, longer longer than the timeout, but the timeout
+	// is extended as each byte arrives.
+	if _, err := ioutil.ReadAll(body); err != nil {
+		t.Fatal(err)
+	}
+	if err := ctx.Err(); err != nil {
+		t.Fatalf("context done during upload: %v", err)
+	}
+	if deadline, ok := ctx.Deadline(); !ok || time.Until(deadline) <= 0 {
+		t.Errorf("deadline %v not extended", deadline)
+	}
+
+	// Once the upload is done, the timeout applies as usual.
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("context not done after timeout")
+	}
+	if err := ctx.Err(); err != context.DeadlineExceeded {
+		t.Errorf("got error %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestUploadContextStall(t *testing.T) {
+	ctx, cancel := newUploadContext(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	body := &uploadBody{ReadCloser: pr, ctx: ctx}
+	go func() {
+		pw.Write([]byte("some"))
+		// Then stall.
+	}()
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(body, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("context not done after the upload stalled")
+	}
+	if err := ctx.Err(); err != context.DeadlineExceeded {
+		t.Errorf("got error %v, want %v", err, context.DeadlineExceeded)
+	}
+	if d := time.Since(start); d > 1*time.Second {
+		t.Errorf("canceled %v after the upload stalled, want about 50ms", d)
+	}
+}
+
+func TestUploadContextParentCanceled(t *testing.T) {
+	parent, cancelParent := context.WithCancel(context.Background())
+	ctx, cancel := newUploadContext(parent, time.Hour)
+	defer cancel()
+	cancelParent()
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("context not done after its parent was canceled")
+	}
+	if err := ctx.Err(); err != context.Canceled {
+		t.Errorf("got error %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestExtendTimeoutDuringUpload(t *testing.T) {
+	ts := newTestStabilizer(t, Config{Workers: 1, Timeout: 200 * time.Millisecond, ExtendTimeoutDuringUpload: true}, http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		rw.Write(body)
+	}))
+	defer ts.close()
+
+	// The upload takes 400ms, twice the timeout.
+	body := &slowReader{r: strings.NewReader("0123456789"), interval: 40 * time.Millisecond}
+	resp, err := http.Post(ts.srv.URL, "text/plain", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	got, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(got) != "0123456789" {
+		t.Errorf("got %v %q, want 200 0123456789", resp.StatusCode, got)
+	}
+}
@@ -0,0 +1,114 @@
+package stabilizer
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+)
+
+// truncatedResponseError is returned by verifyResponseBody when a worker's
+// response body is shorter than its declared Content-Length, most likely
+// because the worker died mid-response.
+type truncatedResponseError struct {
+	got, want int64
+	err       error
+}
+
+func (e *truncatedResponseError) Error() string {
+	return fmt.Sprintf("truncated response: got %v of %v bytes: %v", e.got, e.want, e.err)
+}
+
+// verifyResponseBody buffers the body of resp if it has a declared
+// Content-Length of at most VerifyResponseMaxBody bytes, returning a
+// *truncatedResponseError if the worker closed the connection before sending
+// all of it. Because nothing has been sent to the client yet, the request can
+// then fail cleanly (or be retried) rather than being passed on truncated.
+// Other responses are streamed as usual.
+func (s *Stabilizer) verifyResponseBody(resp *http.Response) error {
+	if resp.ContentLength <= 0 || resp.ContentLength > s.current().VerifyResponseMaxBody {
+		return nil
+	}
+	if resp.Request.Method == http.MethodHead || resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotModified {
+		return nil
+	}
+	body := make([]byte, resp.ContentLength)
+	n, err := io.ReadFull(resp.Body, body)
+	resp.Body.Close()
+	if err != nil {
+		return &truncatedResponseError{got: int64(n), want: resp.ContentLength, err: err}
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return nil
+}
+
+// responseTooLargeError is returned by limitResponseBody when a worker's
+// response declares a Content-Length larger than MaxResponseBytes.
+type responseTooLargeError struct {
+	size, max int64
+}
+
+func (e *responseTooLargeError) Error() string {
+	return fmt.Sprintf("response of %v bytes exceeds the maximum of %v bytes", e.size, e.max)
+}
+
+// limitResponseBody enforces MaxResponseBytes on resp. Responses declaring a
+// larger Content-Length are rejected with a *responseTooLargeError before
+// anything is sent to the client. Other responses have their body limited,
+// so that the proxy aborts the connection to the client once it is exceeded.
+func (s *Stabilizer) limitResponseBody(resp *http.Response) error {
+	limit := s.current().MaxResponseBytes
+	if limit <= 0 {
+		return nil
+	}
+	if resp.ContentLength > limit {
+		s.metrics.responsesTooLarge.Inc()
+		return &responseTooLargeError{size: resp.ContentLength, max: limit}
+	}
+	w := s.workerForRequest(resp.Request)
+	resp.Body = &limitedBody{
+		ReadCloser: resp.Body,
+		remaining:  limit,
+		exceeded: func() {
+			log.Printf("worker %v: warning: truncating response to %v at %v bytes", w.pid, resp.Request.URL, limit)
+			s.metrics.responsesTooLarge.Inc()
+		},
+	}
+	return nil
+}
+
+// errResponseTooLarge is returned by limitedBody once its limit is exceeded.
+var errResponseTooLarge = errors.New("response exceeds the maximum size")
+
+// limitedBody is a response body which returns errResponseTooLarge, calling
+// exceeded once, if more than remaining bytes are read from it.
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+	exceeded  func()
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.remaining <= 0 {
+		// Check whether there is anything left beyond the limit.
+		var one [1]byte
+		n, err := b.ReadCloser.Read(one[:])
+		if n > 0 {
+			if b.exceeded != nil {
+				b.exceeded()
+				b.exceeded = nil
+			}
+			return 0, errResponseTooLarge
+		}
+		return 0, err
+	}
+	if int64(len(p)) > b.remaining {
+		p = p[:b.remaining]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	return n, err
+}
@@ -0,0 +1,46 @@
+package stabilizer
+
+import (
+	"io/ioutil"
+	"net/http"
+	"testing"
+)
+
+// truncatingWorker declares a 100 byte response, but drops the connection
+// after sending only some of it, as if it had crashed.
+var truncatingWorker = http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+	conn, buf, err := rw.(http.Hijacker).Hijack()
+	if err != nil {
+		panic(err)
+	}
+	defer conn.Close()
+	buf.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 100\r\n\r\nonly part of the body")
+	buf.Flush()
+})
+
+func TestVerifyResponseTruncated(t *testing.T) {
+	ts := newTestStabilizer(t, Config{Workers: 1, VerifyResponseMaxBody: 1024}, truncatingWorker)
+	defer ts.close()
+
+	resp, body := ts.get(t, "/")
+	if resp.StatusCode != http.StatusBadGateway || errorCode(t, body) != "hss_worker_truncated_response" {
+		t.Errorf("got %v %s, want 502 hss_worker_truncated_response", resp.StatusCode, body)
+	}
+}
+
+func TestVerifyResponseTooLargeToBuffer(t *testing.T) {
+	// The response is larger than VerifyResponseMaxBody, so it is streamed
+	// and the client's connection is aborted instead, rather than the
+	// response appearing to be complete.
+	ts := newTestStabilizer(t, Config{Workers: 1, VerifyResponseMaxBody: 10}, truncatingWorker)
+	defer ts.close()
+
+	resp, err := http.Get(ts.srv.URL)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if body, err := ioutil.ReadAll(resp.Body); err == nil {
+		t.Errorf("got complete %v response %q, want an error", resp.StatusCode, body)
+	}
+}
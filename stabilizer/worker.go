@@ -0,0 +1,316 @@
+package stabilizer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+type worker struct {
+	ctx    context.Context
+	index  int
+	host   string // for StaticWorkers, or empty for local workers
+	port   int
+	cancel func()
+	pid    int
+	cmd    *exec.Cmd
+	output *outputBuffer
+	done   chan struct{}
+
+	// outputPipe is the read end of the process's stdout and stderr, which is
+	// copied to output until EOF, when outputDone is closed.
+	outputPipe *os.File
+	outputDone chan struct{}
+	logged     chan struct{} // closed once all of the output has been logged
+
+	// requestID extracts request IDs from lines of output, if not nil.
+	requestID *regexp.Regexp
+
+	started    time.Time
+	startErr   error // why the process could not be started, if it wasn't
+	reasonOnce sync.Once
+	reason     string // why the worker died, valid once done is closed
+
+	// signalMu guards exited, so that the process is never signalled once it
+	// is known to have been reaped and its pid may have been reused.
+	signalMu sync.Mutex
+	exited   bool // whether the process has been reaped, guarded by signalMu
+
+	concurrency int   // maximum in-flight requests, set before being added to the pool
+	overflow    bool  // whether this is an overflow worker, see MaxOverflowWorkers
+	responded   int32 // whether the worker has responded to any request, accessed atomically
+
+	inflight int       // guarded by pool.mu
+	draining bool      // guarded by pool.mu
+	pooled   bool      // whether it is in the pool, guarded by pool.mu
+	lastUsed time.Time // when a request last finished, guarded by pool.mu
+
+	// The result of the last health check, guarded by pool.mu.
+	lastHealthCheck     time.Time
+	lastHealthCheckErr  error
+	healthCheckFailures int // consecutive
+
+	// The state of the worker's circuit breaker, guarded by pool.mu.
+	breakerFailures  int // consecutive
+	breakerOpenUntil time.Time
+}
+
+// Reasons for a worker dying, as recorded by kill.
+const (
+	reasonCrash     = "crash"     // the process exited on its own
+	reasonTimeout   = "timeout"   // a request to the worker timed out
+	reasonManual    = "manual"    // the worker was drained via the admin API
+	reasonRecycle   = "recycle"   // the worker was recycled, e.g. by -watch-binary
+	reasonUnready   = "unready"   // the worker did not become ready in time
+	reasonUnhealthy = "unhealthy" // the worker failed its health checks
+	reasonMemory    = "memory"    // the worker was recycled due to cgroup memory pressure
+	reasonIdle      = "idle"      // the worker was recycled by -max-worker-idle
+	reasonOverflow  = "overflow"  // an overflow worker was stopped after being idle
+)
+
+// outputDrainTimeout is how long to wait, once a worker has exited, for the
+// rest of its output to be read. It is only reached if a subprocess of the
+// worker outlives it while holding its stdout or stderr open.
+const outputDrainTimeout = 5 * time.Second
+
+// addr returns the address requests are sent to.
+func (w *worker) addr() string {
+	host := w.host
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	return net.JoinHostPort(host, strconv.Itoa(w.port))
+}
+
+// kill kills the worker, recording the reason it died. If the worker is
+// already dying, the original reason is kept.
+func (w *worker) kill(reason string) {
+	w.setReason(reason)
+	w.cancel()
+}
+
+// setReason records reason as why the worker died, unless it already has
+// one, e.g. before sending it a signal which may cause it to exit.
+func (w *worker) setReason(reason string) {
+	w.reasonOnce.Do(func() { w.reason = reason })
+}
+
+// exitError describes why the worker died once done is closed, or returns ""
+// if it was deliberately stopped, e.g. to be recycled.
+func (w *worker) exitError() string {
+	if w.startErr != nil {
+		return fmt.Sprintf("failed to start: %v", w.startErr)
+	}
+	if !countsTowardsRestartLimit(w.reason) {
+		return ""
+	}
+	switch w.reason {
+	case reasonCrash:
+		if w.cmd != nil && w.cmd.ProcessState != nil {
+			return fmt.Sprintf("crashed: %v", w.cmd.ProcessState)
+		}
+		return "crashed"
+	case reasonTimeout:
+		return "killed after a request timed out"
+	case reasonUnhealthy:
+		return "killed after failing health checks"
+	case reasonUnready:
+		return "" // recorded along with why by the caller
+	}
+	return w.reason
+}
+
+// signal sends sig to pid (the worker's pid, or its negation for its process
+// group), unless the process has already been reaped.
+func (w *worker) signal(pid int, sig syscall.Signal) error {
+	w.signalMu.Lock()
+	defer w.signalMu.Unlock()
+	if w.exited {
+		return fmt.Errorf("worker %v: process already exited", w.pid)
+	}
+	return syscall.Kill(pid, sig)
+}
+
+// freeze suspends the worker (and its subprocesses, if it has its own process
+// group) with SIGSTOP, so that it stops responding as if it were stuck. It is
+// resumed only by being killed.
+func (w *worker) freeze() error {
+	if w.cmd == nil {
+		return fmt.Errorf("worker %v: not a process", w.pid)
+	}
+	pid := w.pid
+	if w.cmd.SysProcAttr.Setpgid {
+		pid = -pid
+	}
+	return w.signal(pid, syscall.SIGSTOP)
+}
+
+// watch monitors the worker until it dies.
+func (w *worker) watch() {
+	go func() {
+		<-w.ctx.Done()
+		w.signalMu.Lock()
+		defer w.signalMu.Unlock()
+		if w.exited {
+			// The process has already exited, and its pid may be reused.
+			return
+		}
+
+		// Kill the process.
+		if err := w.cmd.Process.Kill(); err != nil {
+			log.Printf("worker %v: killing process: %v", w.pid, err)
+		}
+
+		// Also kill subprocesses (OS X, Linux) -- not supported on Windows.
+		// Without a process group of its own, the worker's group is our own.
+		if w.cmd.SysProcAttr.Setpgid {
+			syscall.Kill(-w.pid, 15)
+			// Resume subprocesses suspended by freeze, so that they receive
+			// the signal.
+			syscall.Kill(-w.pid, syscall.SIGCONT)
+		}
+	}()
+
+	// Wait for the process to exit, whether because it was killed above or
+	// because it crashed on its own. Once reaped it is never signalled again:
+	// the reason is recorded without killing it, and done is closed before
+	// the context is canceled so that the goroutine above is a no-op.
+	go func() {
+		state, _ := w.cmd.Process.Wait()
+		w.signalMu.Lock()
+		w.cmd.ProcessState = state
+		w.exited = true
+		w.signalMu.Unlock()
+		w.setReason(reasonCrash)
+		close(w.done)
+		w.cancel()
+
+		// Read the rest of the output before closing the buffer, so that
+		// nothing written just before exiting is lost.
+		select {
+		case <-w.outputDone:
+		case <-time.After(outputDrainTimeout):
+			log.Printf("worker %v: output still open %v after exiting, closing it", w.pid, outputDrainTimeout)
+			w.outputPipe.Close()
+			<-w.outputDone
+		}
+		w.output.Close()
+	}()
+
+	defer close(w.logged)
+	for {
+		line, ok := w.output.next()
+		if !ok {
+			log.Printf("worker %v: %s", w.pid, w.cmd.ProcessState)
+			return
+		}
+		log.Printf("worker %v: %s%s", w.pid, w.outputTag(line), line)
+	}
+}
+
+// outputTag returns the request_id tag to log a line of output with, if it
+// contains a request ID.
+func (w *worker) outputTag(line string) string {
+	if w.requestID == nil {
+		return ""
+	}
+	m := w.requestID.FindStringSubmatch(line)
+	if m == nil {
+		return ""
+	}
+	id := m[0]
+	if len(m) > 1 {
+		id = m[1]
+	}
+	return "request_id=" + id + ": "
+}
+
+// newWorker returns a worker listening on port which is not backed by a
+// process, e.g. one served by an httptest.Server. stop is called once the
+// worker is killed, after which it is considered dead. Its pid is zero.
+func newWorker(ctx context.Context, port int, stop func()) *worker {
+	ctx, cancel := context.WithCancel(ctx)
+	w := &worker{
+		ctx:     ctx,
+		port:    port,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+		started: time.Now(),
+	}
+	go func() {
+		<-ctx.Done()
+		w.kill(reasonCrash)
+		stop()
+		close(w.done)
+	}()
+	return w
+}
+
+// spawnWorker spawns a new worker process in dir (or our working directory, if
+// empty). stderr and stdout will be written to output and logged from there,
+// tagged with the request IDs extracted by requestID (if not nil).
+// The done channel signals when the worker has died, and w.cancel() can be
+// used to kill the worker.
+func spawnWorker(ctx context.Context, setpgid bool, dir string, output *outputBuffer, requestID *regexp.Regexp, port int, command string, args ...string) *worker {
+	ctx, cancel := context.WithCancel(ctx)
+	cmd := exec.CommandContext(ctx, command, args...)
+	cmd.Dir = dir
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		// Create a new process group so any subprocesses the worker spawns can
+		// be killed.
+		Setpgid: setpgid,
+	}
+	w := &worker{
+		ctx:        ctx,
+		port:       port,
+		cancel:     cancel,
+		cmd:        cmd,
+		output:     output,
+		done:       make(chan struct{}),
+		outputDone: make(chan struct{}),
+		logged:     make(chan struct{}),
+		requestID:  requestID,
+	}
+	fail := func(err error) *worker {
+		log.Printf("worker spawn: error: %v", err)
+		w.startErr = err
+		cancel()
+		close(w.done)
+		return w
+	}
+
+	// Use our own pipe for output, rather than letting exec copy it, so that
+	// the copy can be waited for (see watch) without waiting for subprocesses
+	// which inherited it to exit too.
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return fail(err)
+	}
+	cmd.Stderr = pw
+	cmd.Stdout = pw
+	err = cmd.Start()
+	pw.Close()
+	if err != nil {
+		pr.Close()
+		return fail(err)
+	}
+	w.outputPipe = pr
+	go func() {
+		io.Copy(output, pr)
+		pr.Close()
+		close(w.outputDone)
+	}()
+	w.pid = w.cmd.Process.Pid
+	w.started = time.Now()
+	go w.watch()
+	return w
+}
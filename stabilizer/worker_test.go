@@ -0,0 +1,111 @@
+package stabilizer
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestWorkerCrash(t *testing.T) {
+	output := newOutputBuffer(100, func() {}, 0)
+	w := spawnWorker(context.Background(), true, "", output, nil, 0, "sh", "-c", "exit 3")
+	select {
+	case <-w.done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("worker did not exit")
+	}
+	if w.reason != reasonCrash {
+		t.Errorf("reason = %q, want %q", w.reason, reasonCrash)
+	}
+	if got := w.exitError(); !strings.Contains(got, "exit status 3") {
+		t.Errorf("exitError() = %q, want exit status 3", got)
+	}
+
+	// Once reaped, the worker must never be signalled again.
+	if err := w.freeze(); err == nil {
+		t.Error("freeze after exit: expected error")
+	}
+	w.kill(reasonManual)
+	if w.reason != reasonCrash {
+		t.Errorf("reason after kill = %q, want %q", w.reason, reasonCrash)
+	}
+}
+
+// TestWorkerOutputBeforeExit checks that output written just before a worker
+// exits is read in full before its output buffer is closed.
+func TestWorkerOutputBeforeExit(t *testing.T) {
+	logs, restore := captureLog()
+	defer restore()
+	output := newOutputBuffer(10000, func() { t.Error("dropped output") }, 0)
+	w := spawnWorker(context.Background(), true, "", output, nil, 0, "sh", "-c", "i=0; while [ $i -lt 2000 ]; do echo line$i; i=$((i+1)); done; exit 1")
+	<-w.done
+	waitFor(t, func() bool { return strings.Contains(string(logs.Bytes()), "exit status 1") })
+	if got := string(logs.Bytes()); !strings.Contains(got, "line1999\n") {
+		t.Errorf("last line of output missing from logs:\n%s", got)
+	}
+}
+
+// captureLog redirects the log package's output until restore is called.
+func captureLog() (logs *syncBuffer, restore func()) {
+	logs = &syncBuffer{}
+	log.SetOutput(logs)
+	return logs, func() { log.SetOutput(os.Stderr) }
+}
+
+// waitFor waits up to 10s for cond to become true.
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for condition")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// TestWorkerOutputPipeClosed checks that the output pipe of an exited worker
+// is closed, rather than leaking a file descriptor per worker.
+func TestWorkerOutputPipeClosed(t *testing.T) {
+	fds, err := ioutil.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Skip("cannot count open files:", err)
+	}
+	before := len(fds)
+	for i := 0; i < 20; i++ {
+		w := spawnWorker(context.Background(), true, "", newOutputBuffer(100, func() {}, 0), nil, 0, "sh", "-c", "echo hello")
+		<-w.done
+		<-w.outputDone
+	}
+	fds, _ = ioutil.ReadDir("/proc/self/fd")
+	if after := len(fds); after > before+2 {
+		t.Errorf("%d open files after running workers, %d before", after, before)
+	}
+}
+
+// TestKillWorkerTimeoutSignal checks that the output a worker writes in
+// response to TimeoutSignal, e.g. a stack dump, is logged in full by the time
+// killWorker returns.
+func TestKillWorkerTimeoutSignal(t *testing.T) {
+	logs, restore := captureLog()
+	defer restore()
+	s := &Stabilizer{config: Config{TimeoutSignal: syscall.SIGQUIT, TimeoutSignalGrace: 10 * time.Second}}
+	output := newOutputBuffer(10000, func() { t.Error("dropped output") }, 0)
+	script := `trap 'i=0; while [ $i -lt 500 ]; do echo "goroutine $i"; i=$((i+1)); done; exit 2' QUIT; echo ready; while true; do sleep 0.01; done`
+	w := spawnWorker(context.Background(), true, "", output, nil, 0, "sh", "-c", script)
+	waitFor(t, func() bool { return strings.Contains(string(logs.Bytes()), "ready") })
+
+	s.killWorker(w, reasonTimeout)
+	got := string(logs.Bytes())
+	if !strings.Contains(got, "goroutine 499\n") || !strings.Contains(got, "exit status 2") {
+		t.Errorf("stack dump not logged in full:\n%s", got)
+	}
+	if w.reason != reasonTimeout {
+		t.Errorf("reason = %q, want %q", w.reason, reasonTimeout)
+	}
+}
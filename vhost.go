@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/slimsag/http-server-stabilizer/stabilizer"
+)
+
+var (
+	flagVhosts                    vhostFlags
+	flagVhostUnmatchedStatus      = flag.Int("vhost-unmatched-status", 0, "with -vhost, respond with this status to requests for hosts not given by any -vhost, rather than sending them to the default workers")
+	flagVhostUnmatchedBodyFile    = flag.String("vhost-unmatched-body-file", "", "with -vhost, respond with the contents of this file to requests for hosts not given by any -vhost (with -vhost-unmatched-status, default 404), rather than sending them to the default workers")
+	flagVhostUnmatchedContentType = flag.String("vhost-unmatched-content-type", "", "Content-Type of -vhost-unmatched-body-file (default detected from its contents)")
+)
+
+func init() {
+	flag.Var(&flagVhosts, "vhost", "send requests for the given comma-separated hosts to their own workers running the given command (may be repeated), e.g. -vhost='a.example.com,b.example.com=./app -port={{.Port}}'; an empty command sends them to the default workers")
+}
+
+// vhostFlags collects -vhost flags.
+type vhostFlags []string
+
+func (v *vhostFlags) String() string { return strings.Join(*v, " ") }
+
+func (v *vhostFlags) Set(s string) error {
+	*v = append(*v, s)
+	return nil
+}
+
+// vhost is a parsed -vhost flag: requests for hosts are sent to workers
+// running command, or to the default workers if command is empty.
+type vhost struct {
+	hosts   []string
+	command string
+	args    []string
+}
+
+// parseVhost parses a -vhost flag of the form "host1,host2=command args...".
+func parseVhost(s string) (vhost, error) {
+	i := strings.Index(s, "=")
+	if i < 0 {
+		return vhost{}, fmt.Errorf("invalid -vhost %q, expected hosts=command", s)
+	}
+	var v vhost
+	for _, host := range strings.Split(s[:i], ",") {
+		host = strings.ToLower(strings.TrimSpace(host))
+		if host == "" {
+			return vhost{}, fmt.Errorf("invalid -vhost %q, empty host", s)
+		}
+		v.hosts = append(v.hosts, host)
+	}
+	if fields := strings.Fields(s[i+1:]); len(fields) > 0 {
+		v.command, v.args = fields[0], fields[1:]
+	}
+	return v, nil
+}
+
+// vhostConfig returns the configuration of the worker pool of v, which has its
+// own command, given the configuration of the default pool.
+func vhostConfig(config stabilizer.Config, v vhost) stabilizer.Config {
+	config.Command, config.Args = v.command, v.args
+	config.ShadowCommand = ""
+	config.FallbackCommand = ""
+	config.Registerer = prometheus.WrapRegistererWith(prometheus.Labels{"vhost": v.hosts[0]}, prometheus.DefaultRegisterer)
+	return config
+}
+
+// startVhosts starts a Stabilizer for each vhost with a command of its own,
+// sharing config other than the command, and returns them along with a router
+// sending requests to them (or to def) by Host. Metrics of each are labeled
+// with the vhost's first host.
+func startVhosts(config stabilizer.Config, def *stabilizer.Stabilizer, vhosts []vhost) (*stabilizer.HostRouter, []*stabilizer.Stabilizer) {
+	router := &stabilizer.HostRouter{
+		Hosts:                make(map[string]http.Handler),
+		UnmatchedStatus:      *flagVhostUnmatchedStatus,
+		UnmatchedContentType: *flagVhostUnmatchedContentType,
+	}
+	if *flagVhostUnmatchedBodyFile != "" {
+		body, err := ioutil.ReadFile(*flagVhostUnmatchedBodyFile)
+		if err != nil {
+			log.Fatalf("-vhost-unmatched-body-file: %v", err)
+		}
+		router.UnmatchedBody = body
+	}
+	if *flagVhostUnmatchedStatus == 0 && router.UnmatchedBody == nil {
+		router.Default = def
+	}
+	var pools []*stabilizer.Stabilizer
+	for _, v := range vhosts {
+		var h http.Handler = def
+		if v.command != "" {
+			s, err := stabilizer.New(vhostConfig(config, v))
+			if err != nil {
+				log.Fatalf("-vhost %s: %v", v.hosts[0], err)
+			}
+			if err := s.Start(context.Background()); err != nil {
+				log.Fatalf("-vhost %s: %v", v.hosts[0], err)
+			}
+			pools = append(pools, s)
+			h = s
+		}
+		for _, host := range v.hosts {
+			if _, ok := router.Hosts[host]; ok {
+				log.Fatalf("-vhost: %s given more than once", host)
+			}
+			router.Hosts[host] = h
+		}
+	}
+	return router, pools
+}
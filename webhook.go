@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/slimsag/http-server-stabilizer/stabilizer"
+)
+
+// webhookPayload is POSTed as JSON to -ready-webhook and -drain-webhook.
+type webhookPayload struct {
+	Status   string `json:"status"` // "ready" or "draining"
+	Hostname string `json:"hostname"`
+	Workers  int    `json:"workers"` // the configured number of workers
+	Ready    int    `json:"ready"`   // the number of workers currently ready
+}
+
+// postWebhook notifies url of a lifecycle transition, logging any failure.
+func postWebhook(url, status string, s *stabilizer.Stabilizer, workers int) {
+	hostname, _ := os.Hostname()
+	body, _ := json.Marshal(&webhookPayload{
+		Status:   status,
+		Hostname: hostname,
+		Workers:  workers,
+		Ready:    s.Ready(),
+	})
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			err = fmt.Errorf("unexpected status %v", resp.StatusCode)
+		}
+	}
+	if err != nil {
+		log.Printf("%s webhook: %v", status, err)
+		return
+	}
+	log.Printf("%s webhook: notified %s", status, url)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// parseWorkers parses the -workers flag, which is either a number of workers,
+// "auto" for one worker per available CPU, or a multiple of the available CPUs
+// such as "2x".
+func parseWorkers(s string) (int, error) {
+	multiple := 1.0
+	switch {
+	case s == "auto":
+	case strings.HasSuffix(s, "x"):
+		var err error
+		multiple, err = strconv.ParseFloat(strings.TrimSuffix(s, "x"), 64)
+		if err != nil || multiple <= 0 {
+			return 0, fmt.Errorf("invalid multiple of CPUs %q", s)
+		}
+	default:
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("invalid number of workers %q", s)
+		}
+		return n, nil
+	}
+	n := int(math.Ceil(availableCPUs() * multiple))
+	if n < 1 {
+		n = 1
+	}
+	return n, nil
+}
+
+// availableCPUs returns the number of CPUs available to us: the cgroup CPU
+// quota if there is one (which may be fractional), or else the number of CPUs.
+func availableCPUs() float64 {
+	cpus := float64(runtime.NumCPU())
+	if quota, ok := cgroupCPUQuota(); ok && quota < cpus {
+		return quota
+	}
+	return cpus
+}